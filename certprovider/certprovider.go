@@ -21,6 +21,8 @@ type CertProviderInterface interface {
 
 type STIPAInterface interface {
 	getSPCToken(scpcode string) (token string, err error)
+	getTrustList() (trustList []byte, err error)
+	getCRL() (crl []byte, err error)
 }
 
 type CertProvider struct {
@@ -31,6 +31,9 @@ type CertProviderInterface interface {
 var (
 	//TODO update to production URL https://authenticate-api.iconectiv.com
 	ICONECTIV_API = "https://authenticate-api-stg.iconectiv.com"
+	//paths to download the list of approved STI-CA root certificates and the STI-PA CRL. Can be overwritten with env vars STIPA_TRUST_LIST_URL and STIPA_CRL_URL
+	ICONECTIV_TRUST_LIST_PATH = "/api/v1/certificates/trustlist"
+	ICONECTIV_CRL_PATH        = "/api/v1/crl"
 )
 
 type ia5ExplicitString struct {
@@ -68,6 +71,12 @@ type PaAuthResponse struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+type PaTrustListResponse struct {
+	Status    string            `json:"status"`
+	Message   string            `json:"message"`
+	TrustList []json.RawMessage `json:"trustList"`
+}
+
 type PaErrorResponse struct {
 	Status    string `json:"status"`
 	Message   string `json:"message"`
@@ -303,3 +312,65 @@ func sendAuthRequest() (authToken string, errorResponse error) {
 
 	return authResp.AccessToken, nil
 }
+
+//getTrustList returns the list of approved STI-CA root certificates as JSON document with trustList field
+func (stipa *Iconectiv) getTrustList() (trustList []byte, err error) {
+	sendURL := os.Getenv("STIPA_TRUST_LIST_URL")
+	if sendURL == "" {
+		sendURL = ICONECTIV_API + ICONECTIV_TRUST_LIST_PATH
+	}
+	respBytes, err := sendHttpGetRequest(sendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlResp PaTrustListResponse
+	err = json.Unmarshal(respBytes, &tlResp)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling trust list response: %v", err)
+	}
+	if tlResp.Status == "error" {
+		return nil, fmt.Errorf("error during the request for trust list. Details: %v", tlResp.Message)
+	}
+	return respBytes, nil
+}
+
+//getCRL returns the STI-PA CRL in DER or PEM format
+func (stipa *Iconectiv) getCRL() (crl []byte, err error) {
+	sendURL := os.Getenv("STIPA_CRL_URL")
+	if sendURL == "" {
+		sendURL = ICONECTIV_API + ICONECTIV_CRL_PATH
+	}
+	return sendHttpGetRequest(sendURL)
+}
+
+//sendHttpGetRequest sends an authorized GET request to STI-PA and returns the body
+func sendHttpGetRequest(sendURL string) (httpBody []byte, err error) {
+
+	//send auth request
+	accessToken, err := sendAuthRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", sendURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", accessToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Status Code: %v, URL: %v", res.StatusCode, sendURL)
+	}
+
+	respBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response bytes: %v", err)
+	}
+	return respBytes, nil
+}
@@ -0,0 +1,129 @@
+package certprovider
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+//DownloadSTIPALists gets from STI-PA the list of approved STI-CA root certificates and the STI-PA CRL, validates them
+//and writes them to caFile (in PEM format, to be used for -ca-file) and crlFile (to be used for -crl-file).
+//The CRL signature must be verified by one of the trust list certificates or by one of the certificates in
+//crlIssuerFile (PEM or DER, optional).
+//Next env vars must be set: STIPAAPILogin, STIPAAPIPassword
+func DownloadSTIPALists(caFile string, crlFile string, crlIssuerFile string) error {
+	var paProvider STIPAInterface = &Iconectiv{}
+	return downloadSTIPALists(paProvider, caFile, crlFile, crlIssuerFile)
+}
+
+func downloadSTIPALists(paProvider STIPAInterface, caFile string, crlFile string, crlIssuerFile string) error {
+	//Last error number: 8009
+
+	if caFile == "" && crlFile == "" {
+		return fmt.Errorf("errorcode: 8001, errormsg: no file to write the trust list or the CRL")
+	}
+
+	trustListData, err := paProvider.getTrustList()
+	if err != nil {
+		return fmt.Errorf("errorcode: 8002, errormsg: cannot get trust list from STI-PA, errordetails: %v", err)
+	}
+	trustCerts, err := ValidateTrustList(trustListData)
+	if err != nil {
+		return fmt.Errorf("errorcode: 8003, errormsg: invalid trust list, errordetails: %v", err)
+	}
+
+	var crlData []byte
+	if crlFile != "" {
+		crlData, err = paProvider.getCRL()
+		if err != nil {
+			return fmt.Errorf("errorcode: 8004, errormsg: cannot get CRL from STI-PA, errordetails: %v", err)
+		}
+		crlIssuers := trustCerts
+		if crlIssuerFile != "" {
+			issuerData, err := ioutil.ReadFile(crlIssuerFile)
+			if err != nil {
+				return fmt.Errorf("errorcode: 8009, errormsg: cannot read CRL issuer file: %v, errordetails: %v", crlIssuerFile, err)
+			}
+			issuerCerts, _, err := secsipid.SJWTParseCertificates(issuerData)
+			if err != nil {
+				return fmt.Errorf("errorcode: 8009, errormsg: invalid CRL issuer file: %v, errordetails: %v", crlIssuerFile, err)
+			}
+			crlIssuers = append(append([]*x509.Certificate{}, trustCerts...), issuerCerts...)
+		}
+		if _, err = ValidateCRL(crlData, crlIssuers); err != nil {
+			return fmt.Errorf("errorcode: 8005, errormsg: invalid CRL, errordetails: %v", err)
+		}
+	}
+
+	//write the files only after both lists are validated
+	if caFile != "" {
+		var caPEM []byte
+		for _, cert := range trustCerts {
+			caPEM = append(caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		if err = secsipid.SJWTWriteFileAtomic(caFile, caPEM, 0644); err != nil {
+			return fmt.Errorf("errorcode: 8006, errormsg: cannot write CA file: %v, errordetails: %v", caFile, err)
+		}
+	}
+	if crlFile != "" {
+		if err = secsipid.SJWTWriteFileAtomic(crlFile, crlData, 0644); err != nil {
+			return fmt.Errorf("errorcode: 8007, errormsg: cannot write CRL file: %v, errordetails: %v", crlFile, err)
+		}
+	}
+	return nil
+}
+
+//ValidateTrustList parses the STI-PA trust list and returns the CA certificates that are currently valid
+func ValidateTrustList(trustListData []byte) ([]*x509.Certificate, error) {
+	certs, err := secsipid.SJWTParseSTIPATrustList(trustListData)
+	if err != nil {
+		return nil, err
+	}
+
+	tnow := time.Now()
+	var validCerts []*x509.Certificate
+	for _, cert := range certs {
+		if !cert.IsCA {
+			return nil, fmt.Errorf("certificate is not a CA: %v", cert.Subject.String())
+		}
+		if tnow.After(cert.NotAfter) || tnow.Before(cert.NotBefore) {
+			if debug {
+				fmt.Printf("skipping certificate out of validity period: %v\n", cert.Subject.String())
+			}
+			continue
+		}
+		validCerts = append(validCerts, cert)
+	}
+	if len(validCerts) == 0 {
+		return nil, fmt.Errorf("no valid certificate in trust list")
+	}
+	return validCerts, nil
+}
+
+//ValidateCRL parses the CRL (DER or PEM), checks that it is not outdated and that its signature is verified by
+//one of the issuerCerts with the subject matching the CRL issuer
+func ValidateCRL(crlData []byte, issuerCerts []*x509.Certificate) (*pkix.CertificateList, error) {
+	crl, err := x509.ParseCRL(crlData)
+	if err != nil {
+		return nil, err
+	}
+	if !crl.TBSCertList.NextUpdate.IsZero() && time.Now().After(crl.TBSCertList.NextUpdate) {
+		return nil, fmt.Errorf("CRL is outdated, next update: %v", crl.TBSCertList.NextUpdate)
+	}
+	err = fmt.Errorf("CRL issuer not trusted: %v", crl.TBSCertList.Issuer.String())
+	for _, cert := range issuerCerts {
+		if cert.Subject.String() != crl.TBSCertList.Issuer.String() {
+			continue
+		}
+		if err = cert.CheckCRLSignature(crl); err == nil {
+			return crl, nil
+		}
+		err = fmt.Errorf("invalid CRL signature: %v", err)
+	}
+	return nil, err
+}
@@ -0,0 +1,181 @@
+package certprovider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadSTIPALists(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test STI-CA Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caCert, _ := x509.ParseCertificate(caDER)
+	crlDER, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().AddDate(0, 0, 7),
+	}, caCert, caKey)
+	outdatedCRLDER, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(2),
+		ThisUpdate: time.Now().AddDate(0, 0, -7),
+		NextUpdate: time.Now().AddDate(0, 0, -1),
+	}, caCert, caKey)
+
+	// CRL issuer not in the trust list, as the STI-PA CRL issuer usually is
+	issuerKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuerTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Test STI-PA CRL Issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	issuerDER, _ := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+	issuerCert, _ := x509.ParseCertificate(issuerDER)
+	issuerCRLDER, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(4),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().AddDate(0, 0, 7),
+	}, issuerCert, issuerKey)
+	// CRL with the issuer name of the trust list CA, signed with another key
+	forgedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forgedCRLDER, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(5),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().AddDate(0, 0, 7),
+	}, caCert, forgedKey)
+
+	crlBody := crlDER
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auth/login":
+			json.NewEncoder(w).Encode(PaAuthResponse{Status: "success", AccessToken: "testtoken"})
+		case ICONECTIV_TRUST_LIST_PATH:
+			if r.Header.Get("Authorization") != "testtoken" {
+				w.WriteHeader(401)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":    "success",
+				"trustList": []string{base64.StdEncoding.EncodeToString(caDER)},
+			})
+		case ICONECTIV_CRL_PATH:
+			w.Write(crlBody)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	oldAPI := ICONECTIV_API
+	ICONECTIV_API = server.URL
+	defer func() { ICONECTIV_API = oldAPI }()
+	t.Setenv("STIPAAPILogin", "stipaUSER")
+	t.Setenv("STIPAAPIPassword", "stipaPASS")
+
+	workDir, _ := os.MkdirTemp("", "stipalists")
+	defer os.RemoveAll(workDir)
+	caFile := filepath.Join(workDir, "ca.pem")
+	crlFile := filepath.Join(workDir, "crl.der")
+	issuerFile := filepath.Join(workDir, "crl-issuer.pem")
+	os.WriteFile(issuerFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuerDER}), 0644)
+
+	tests := []struct {
+		name          string
+		crlBody       []byte
+		crlIssuerFile string
+		wantErr       bool
+		wantErrMsg    string
+	}{
+		{
+			"valid lists",
+			crlDER,
+			"",
+			false,
+			"",
+		},
+		{
+			"outdated CRL",
+			outdatedCRLDER,
+			"",
+			true,
+			"errorcode: 8005, errormsg: invalid CRL",
+		},
+		{
+			"CRL issuer not in trust list",
+			issuerCRLDER,
+			"",
+			true,
+			"errorcode: 8005, errormsg: invalid CRL, errordetails: CRL issuer not trusted",
+		},
+		{
+			"CRL issuer in CRL issuer file",
+			issuerCRLDER,
+			issuerFile,
+			false,
+			"",
+		},
+		{
+			"forged CRL signature",
+			forgedCRLDER,
+			issuerFile,
+			true,
+			"errorcode: 8005, errormsg: invalid CRL, errordetails: invalid CRL signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(caFile)
+			os.Remove(crlFile)
+			crlBody = tt.crlBody
+
+			err := DownloadSTIPALists(caFile, crlFile, tt.crlIssuerFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadSTIPALists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.HasPrefix(err.Error(), tt.wantErrMsg) {
+					t.Errorf("DownloadSTIPALists() error = %v, want %v", err, tt.wantErrMsg)
+				}
+				if _, err = os.Stat(caFile); err == nil {
+					t.Errorf("DownloadSTIPALists() CA file written for invalid lists")
+				}
+				return
+			}
+
+			caPEM, _ := os.ReadFile(caFile)
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				t.Errorf("DownloadSTIPALists() invalid CA file content: %s", caPEM)
+			}
+			crlData, _ := os.ReadFile(crlFile)
+			if _, err = x509.ParseCRL(crlData); err != nil {
+				t.Errorf("DownloadSTIPALists() invalid CRL file content: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CLICommand - a command of the command line, with its own options
+type CLICommand struct {
+	name    string
+	args    string
+	summary string
+	flags   func(fs *flag.FlagSet)
+	// minimum and maximum number of arguments after the options
+	minArgs int
+	maxArgs int
+	run     func(args []string) int
+}
+
+var cliCommands []*CLICommand
+
+func init() {
+	cliCommands = []*CLICommand{
+		{
+			name:    "sign",
+			summary: "sign the header and payload given as JSON documents or built from the individual values",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsPrvKey(fs)
+				cliFlagsToken(fs)
+				cliFlagsJSON(fs)
+			},
+			run: func(args []string) int {
+				return secsipidxCLISign()
+			},
+		},
+		{
+			name:    "sign-full",
+			summary: "build the full identity header value from the individual values",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsPrvKey(fs)
+				cliFlagsToken(fs)
+			},
+			run: func(args []string) int {
+				return secsipidxCLISignFull()
+			},
+		},
+		{
+			name:    "check",
+			args:    "[identity]",
+			summary: "check the validity of the identity header value",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsPubKey(fs)
+				cliFlagsIdentity(fs)
+				cliFlagsCheck(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+				cliFlagsCertVerify(fs)
+			},
+			maxArgs: 1,
+			run: func(args []string) int {
+				if len(args) > 0 {
+					cliops.identity = args[0]
+				}
+				return secsipidxCLICheckStatus(secsipidxCLICheck())
+			},
+		},
+		{
+			name:    "decode",
+			args:    "[identity|-]",
+			summary: "decode the identity value ('-' for stdin) without checking it and print its content",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsIdentity(fs)
+				cliFlagsDecode(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+				cliFlagsCertVerify(fs)
+			},
+			maxArgs: 1,
+			run: func(args []string) int {
+				if len(args) > 0 {
+					cliops.identity = args[0]
+				}
+				return secsipidxCLIDecode()
+			},
+		},
+		{
+			name:    "check-sip",
+			args:    "<file|->",
+			summary: "check all the identity headers of the SIP message in the file ('-' for stdin)",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsCheck(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+				cliFlagsCertVerify(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(args []string) int {
+				cliops.checksip = args[0]
+				return secsipidxCLICheckStatus(secsipidxCLICheckSIP())
+			},
+		},
+		{
+			name:    "sign-sip",
+			args:    "<file|->",
+			summary: "sign the SIP request in the file ('-' for stdin) and print it with the identity and date headers inserted",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsPrvKey(fs)
+				cliFlagsToken(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(args []string) int {
+				cliops.signsip = args[0]
+				return secsipidxCLISignSIP()
+			},
+		},
+		{
+			name:    "pcap",
+			args:    "<file>",
+			summary: "verify the identity headers of the SIP INVITEs in the pcap or pcapng file",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsCheck(fs)
+				cliFlagsPcap(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+				cliFlagsCertVerify(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(args []string) int {
+				cliops.pcap = args[0]
+				return secsipidxCLIPcap()
+			},
+		},
+		{
+			name:    "keygen",
+			summary: "generate P-256 private and public keys and optionally a SHAKEN test certificate (self-signed or signed by a CA)",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsKeygen(fs)
+			},
+			run: func(args []string) int {
+				return secsipidxCLIKeygen()
+			},
+		},
+		{
+			name: "pki",
+			args: "<dir>",
+			summary: "generate a lab PKI in the directory: STI-PA like root CA, STI-CA like intermediate CA, " +
+				"service provider certificates (valid, revoked and expired) and the CRL",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsPKI(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run: func(args []string) int {
+				cliops.pkibuild = args[0]
+				return secsipidxCLIPKIBuild()
+			},
+		},
+		{
+			name: "cache",
+			args: "list | show <url> | purge [url] | prewarm <file|-> | bundle <dir>",
+			summary: "manage the cached certificates: list them, show the one for an URL, remove all or the one for an URL, " +
+				"download the ones for the URLs in the file or build an offline bundle from them",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+			},
+			minArgs: 1,
+			maxArgs: 2,
+			run:     secsipidxCommandCache,
+		},
+		{
+			name: "cert",
+			args: "request | stipa-lists",
+			summary: "get a new certificate from the STI-CA (CERTIFICATE_PROVIDER and CERTIFICATE_AUTHORITY_TOKEN env vars) " +
+				"or download STI-PA trust list and CRL to the files given by -ca-file and -crl-file (STIPAAPILogin and STIPAAPIPassword env vars)",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsCertVerify(fs)
+				cliFlagsSTIPA(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run:     secsipidxCommandCert,
+		},
+		{
+			name:    "trust",
+			args:    "info | reload",
+			summary: "print the counts and fingerprints of the root and intermediate CA certificates, or load them again from the files",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsCertVerify(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run:     secsipidxCommandTrust,
+		},
+		{
+			name:    "serve",
+			summary: "run the http and https services for checking and building identity headers",
+			flags: func(fs *flag.FlagSet) {
+				cliFlagsGeneral(fs)
+				cliFlagsServer(fs)
+				cliFlagsPubKey(fs)
+				cliFlagsPrvKey(fs)
+				cliFlagsCheck(fs)
+				cliFlagsCache(fs)
+				cliFlagsFetch(fs)
+				cliFlagsCertVerify(fs)
+			},
+			run: func(args []string) int {
+				return secsipidxCLIServe()
+			},
+		},
+		{
+			name:    "test",
+			summary: "run the self-test with ephemeral keys and an in-process x5u server, printing a pass/fail table",
+			flags:   cliFlagsGeneral,
+			run: func(args []string) int {
+				return secsipidxCLISelfTest()
+			},
+		},
+		{
+			name:    "version",
+			summary: "print version",
+			flags:   func(fs *flag.FlagSet) {},
+			run: func(args []string) int {
+				fmt.Printf("%s v%s\n", filepath.Base(os.Args[0]), secsipidxVersion)
+				return 0
+			},
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "print the commands or the options of a command",
+			flags:   func(fs *flag.FlagSet) {},
+			maxArgs: 1,
+			run:     secsipidxCommandHelp,
+		},
+	}
+}
+
+// secsipidxFindCommand - return the command with the name, nil if not found
+func secsipidxFindCommand(name string) *CLICommand {
+	for _, cmd := range cliCommands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// secsipidxPrintCommands - print the list of commands
+func secsipidxPrintCommands(w io.Writer) {
+	fmt.Fprintf(w, "Commands (run '%s help <command>' to see the options of a command):\n", filepath.Base(os.Args[0]))
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// secsipidxCommandFlags - return the options of the command
+func secsipidxCommandFlags(cmd *CLICommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	cmd.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s (v%s):\n", filepath.Base(os.Args[0]), cmd.name, secsipidxVersion)
+		fmt.Fprintf(fs.Output(), "    %s %s [options] %s\n\n", filepath.Base(os.Args[0]), cmd.name, cmd.args)
+		fmt.Fprintf(fs.Output(), "%s\n\nOptions:\n", cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// secsipidxRunCommand - parse the options of the command and run it
+func secsipidxRunCommand(cmd *CLICommand, args []string) int {
+	fs := secsipidxCommandFlags(cmd)
+
+	// the options can be given also after the arguments
+	var cmdArgs []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		cmdArgs = append(cmdArgs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(cmdArgs) < cmd.minArgs || len(cmdArgs) > cmd.maxArgs {
+		fs.Usage()
+		return 1
+	}
+
+	if ret := secsipidxLibInit(); ret != 0 {
+		return ret
+	}
+	if cliops.verbosity > 0 {
+		fmt.Printf("Running with %s command\n", cmd.name)
+	}
+	return cmd.run(cmdArgs)
+}
+
+// secsipidxCommandHelp - print the commands or the options of a command
+func secsipidxCommandHelp(args []string) int {
+	if len(args) == 0 {
+		fmt.Printf("Usage of %s (v%s):\n", filepath.Base(os.Args[0]), secsipidxVersion)
+		fmt.Printf("    %s <command> [options] [arguments]\n\n", filepath.Base(os.Args[0]))
+		secsipidxPrintCommands(os.Stdout)
+		fmt.Printf("\nThe options without command (run '%s --help' to see them) are still supported.\n", filepath.Base(os.Args[0]))
+		return 0
+	}
+	cmd := secsipidxFindCommand(args[0])
+	if cmd == nil {
+		fmt.Printf("unknown command: %s\n", args[0])
+		return 1
+	}
+	fs := secsipidxCommandFlags(cmd)
+	fs.SetOutput(os.Stdout)
+	fs.Usage()
+	return 0
+}
+
+// secsipidxCommandCache - run the action of the cache command
+func secsipidxCommandCache(args []string) int {
+	action := args[0]
+	arg := ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	switch action {
+	case "list":
+		return secsipidxCLICacheList()
+	case "show":
+		if len(arg) == 0 {
+			fmt.Printf("URL not provided\n")
+			return 1
+		}
+		cliops.cacheshow = arg
+		return secsipidxCLICacheShow()
+	case "purge":
+		cliops.cachepurge = true
+		cliops.cachepurgeurl = arg
+		return secsipidxCLICachePurge()
+	case "prewarm":
+		if len(arg) == 0 {
+			fmt.Printf("path to file with URLs not provided\n")
+			return 1
+		}
+		cliops.cacheprewarm = arg
+		return secsipidxCLICachePrewarm()
+	case "bundle":
+		if len(arg) == 0 {
+			fmt.Printf("path to bundle directory not provided\n")
+			return 1
+		}
+		cliops.bundlebuild = arg
+		return secsipidxCLIBundleBuild()
+	}
+	fmt.Printf("unknown cache action: %s (expected: list, show, purge, prewarm, bundle)\n", action)
+	return 1
+}
+
+// secsipidxCommandCert - run the action of the cert command
+func secsipidxCommandCert(args []string) int {
+	switch strings.ToLower(args[0]) {
+	case "request":
+		return secsipidxCLIGetCertificate()
+	case "stipa-lists":
+		return secsipidxCLISTIPALists()
+	}
+	fmt.Printf("unknown cert action: %s (expected: request, stipa-lists)\n", args[0])
+	return 1
+}
+
+// secsipidxCommandTrust - run the action of the trust command
+func secsipidxCommandTrust(args []string) int {
+	switch strings.ToLower(args[0]) {
+	case "info":
+		return secsipidxCLITrustInfo()
+	case "reload":
+		return secsipidxCLITrustReload()
+	}
+	fmt.Printf("unknown trust action: %s (expected: info, reload)\n", args[0])
+	return 1
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,95 +13,199 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
-	"github.com/asipto/secsipidx/secsipid"
+	"github.com/olegromanchuk/secsipidx/certprovider"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+	"github.com/olegromanchuk/secsipidx/sipcapture"
 )
 
 const secsipidxVersion = "1.2.0"
 
 // CLIOptions - structure for command line options
 type CLIOptions struct {
-	httpsrv     string
-	httpssrv    string
-	httpspubkey string
-	httpsprvkey string
-	httpdir     string
-	fprvkey     string
-	fpubkey     string
-	header      string
-	fheader     string
-	payload     string
-	fpayload    string
-	identity    string
-	fidentity   string
-	alg         string
-	ppt         string
-	typ         string
-	x5u         string
-	attest      string
-	desttn      string
-	origtn      string
-	iat         int
-	origid      string
-	check       bool
-	sign        bool
-	signfull    bool
-	jsonparse   bool
-	expire      int
-	timeout     int
-	ltest       bool
-	version     bool
-	cachedir    string
-	cacheexpire int
-	cafile      string
-	cainter     string
-	crlfile     string
-	certverify  int
-	verbosity   int
-    	getcertificate bool
+	httpsrv          string
+	httpssrv         string
+	httpspubkey      string
+	httpsprvkey      string
+	httpdir          string
+	fprvkey          string
+	fpubkey          string
+	header           string
+	fheader          string
+	payload          string
+	fpayload         string
+	identity         string
+	fidentity        string
+	alg              string
+	ppt              string
+	typ              string
+	x5u              string
+	attest           string
+	desttn           string
+	origtn           string
+	iat              int
+	origid           string
+	check            bool
+	sign             bool
+	signfull         bool
+	jsonparse        bool
+	expire           int
+	timeout          int
+	ltest            bool
+	version          bool
+	cachedir         string
+	cachestorage     string
+	cacheexpire      int
+	cachemaxsize     int
+	cacheclean       int
+	cacherefresh     int
+	cacherefreshhits int
+	cafile           string
+	cainter          string
+	crlfile          string
+	cadir            string
+	catrustlist      string
+	certverify       int
+	verbosity        int
+	getcertificate   bool
+	stipalists       bool
+	cachelist        bool
+	cacheshow        string
+	cachepurge       bool
+	cachepurgeurl    string
+	cacheprewarm     string
+	offlinebundle    string
+	bundlebuild      string
+	checksip         string
+	signsip          string
+	pcap             string
+	pcapformat       string
+	decode           bool
+	decodefetch      bool
+	decodeformat     string
+	keygen           bool
+	keygenout        string
+	keygenpkcs8      bool
+	keygenspc        string
+	keygenca         bool
+	keygencn         string
+	keygendays       int
+	keygenpolicy     string
+	keygencrlurl     string
+	keygencacert     string
+	keygencakey      string
+	pkibuild         string
+	pkispec          string
+	legacyidentity   bool
+	legacysha1       bool
+	stipainterval    int
+	stipacrlissuer   string
+	negexpire        int
+	negstatusexpire  int
+	breakerthreshold int
+	breakeropentime  int
+	fetchhttps       bool
+	fetchblockpriv   bool
+	fetchallowhosts  string
+	fetchdenyhosts   string
+	fetchmaxsize     int
+	fetchmaxredirect int
+	fetchctypes      string
 }
 
 var cliops = CLIOptions{
-	httpsrv:     "",
-	httpssrv:    "",
-	httpspubkey: "",
-	httpsprvkey: "",
-	httpdir:     "",
-	fprvkey:     "",
-	fpubkey:     "",
-	header:      "",
-	fheader:     "",
-	payload:     "",
-	fpayload:    "",
-	identity:    "",
-	fidentity:   "",
-	alg:         "ES256",
-	ppt:         "shaken",
-	typ:         "passport",
-	x5u:         "",
-	attest:      "C",
-	desttn:      "",
-	origtn:      "",
-	iat:         0,
-	origid:      "",
-	check:       false,
-	sign:        false,
-	signfull:    false,
-	jsonparse:   false,
-	expire:      0,
-	timeout:     3,
-	ltest:       false,
-	version:     false,
-	cachedir:    "",
-	cacheexpire: 3600,
-	cafile:      "",
-	cainter:     "",
-	crlfile:     "",
-	certverify:  0,
-	verbosity:   0,
-    	getcertificate: false,
+	httpsrv:          "",
+	httpssrv:         "",
+	httpspubkey:      "",
+	httpsprvkey:      "",
+	httpdir:          "",
+	fprvkey:          "",
+	fpubkey:          "",
+	header:           "",
+	fheader:          "",
+	payload:          "",
+	fpayload:         "",
+	identity:         "",
+	fidentity:        "",
+	alg:              "ES256",
+	ppt:              "shaken",
+	typ:              "passport",
+	x5u:              "",
+	attest:           "C",
+	desttn:           "",
+	origtn:           "",
+	iat:              0,
+	origid:           "",
+	check:            false,
+	sign:             false,
+	signfull:         false,
+	jsonparse:        false,
+	expire:           0,
+	timeout:          3,
+	ltest:            false,
+	version:          false,
+	cachedir:         "",
+	cachestorage:     "",
+	cacheexpire:      3600,
+	cachemaxsize:     0,
+	cacheclean:       0,
+	cacherefresh:     0,
+	cacherefreshhits: 10,
+	cafile:           "",
+	cainter:          "",
+	crlfile:          "",
+	cadir:            "",
+	catrustlist:      "",
+	certverify:       0,
+	verbosity:        0,
+	getcertificate:   false,
+	stipalists:       false,
+	cachelist:        false,
+	cacheshow:        "",
+	cachepurge:       false,
+	cachepurgeurl:    "",
+	cacheprewarm:     "",
+	offlinebundle:    "",
+	bundlebuild:      "",
+	checksip:         "",
+	signsip:          "",
+	pcap:             "",
+	pcapformat:       "json",
+	decode:           false,
+	decodefetch:      false,
+	decodeformat:     "text",
+	keygen:           false,
+	keygenout:        "ec256",
+	keygenpkcs8:      false,
+	keygenspc:        "",
+	keygenca:         false,
+	keygencn:         "",
+	keygendays:       365,
+	keygenpolicy:     secsipid.SJWTShakenCertPolicy,
+	keygencrlurl:     "",
+	keygencacert:     "",
+	keygencakey:      "",
+	pkibuild:         "",
+	pkispec:          "",
+	legacyidentity:   false,
+	legacysha1:       false,
+	stipainterval:    0,
+	stipacrlissuer:   "",
+	negexpire:        0,
+	negstatusexpire:  0,
+	breakerthreshold: 0,
+	breakeropentime:  60,
+	fetchhttps:       false,
+	fetchblockpriv:   false,
+	fetchallowhosts:  "",
+	fetchdenyhosts:   "",
+	fetchmaxsize:     131072,
+	fetchmaxredirect: 10,
+	fetchctypes:      "",
 }
 
 // initialize application components
@@ -106,110 +213,198 @@ func init() {
 	// command line arguments
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s (v%s):\n", filepath.Base(os.Args[0]), secsipidxVersion)
-		fmt.Fprintf(os.Stderr, "    (some options have short and long version)\n")
+		fmt.Fprintf(os.Stderr, "    %s <command> [options] [arguments]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "    %s [options]\n\n", filepath.Base(os.Args[0]))
+		secsipidxPrintCommands(os.Stderr)
+		fmt.Fprintf(os.Stderr, "\nOptions without command (some options have short and long version):\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	flag.StringVar(&cliops.httpsrv, "http-srv", cliops.httpsrv, "http server bind address")
-	flag.StringVar(&cliops.httpsrv, "H", cliops.httpsrv, "http server bind address")
-	flag.StringVar(&cliops.httpssrv, "https-srv", cliops.httpssrv, "https server bind address")
-	flag.StringVar(&cliops.httpspubkey, "https-pubkey", cliops.httpspubkey, "https server public key")
-	flag.StringVar(&cliops.httpsprvkey, "https-prvkey", cliops.httpsprvkey, "https server private key")
-	flag.StringVar(&cliops.httpdir, "http-dir", cliops.httpdir, "directory to serve over http")
-	flag.StringVar(&cliops.fprvkey, "fprvkey", cliops.fprvkey, "path to private key")
-	flag.StringVar(&cliops.fprvkey, "k", cliops.fprvkey, "path to private key")
-	flag.StringVar(&cliops.fpubkey, "fpubkey", cliops.fpubkey, "path to public key")
-	flag.StringVar(&cliops.fpubkey, "p", cliops.fpubkey, "path to public key")
-	flag.StringVar(&cliops.fheader, "fheader", cliops.fheader, "path to file with header value in JSON format")
-	flag.StringVar(&cliops.header, "header", cliops.header, "header value in JSON format")
-	flag.StringVar(&cliops.fpayload, "fpayload", cliops.fpayload, "path to file with payload value in JSON format")
-	flag.StringVar(&cliops.payload, "payload", cliops.payload, "payload value in JSON format")
-	flag.StringVar(&cliops.fidentity, "fidentity", cliops.fidentity, "path to file with identity value")
-	flag.StringVar(&cliops.identity, "identity", cliops.identity, "identity value")
-	flag.StringVar(&cliops.alg, "alg", cliops.alg, "encryption algorithm (default: ES256)")
-	flag.StringVar(&cliops.ppt, "ppt", cliops.ppt, "used extension (default: shaken)")
-	flag.StringVar(&cliops.typ, "typ", cliops.typ, "token type (default: passport)")
-	flag.StringVar(&cliops.x5u, "x5u", cliops.x5u, "value of the field with the location of the certificate used to sign the token (default: '')")
-	flag.StringVar(&cliops.attest, "attest", cliops.attest, "attestation level (default: 'C')")
-	flag.StringVar(&cliops.attest, "a", cliops.attest, "attestation level (default: 'C')")
-	flag.StringVar(&cliops.desttn, "dest-tn", cliops.desttn, "destination (called) number (default: '')")
-	flag.StringVar(&cliops.desttn, "d", cliops.desttn, "destination (called) number (default: '')")
-	flag.StringVar(&cliops.origtn, "orig-tn", cliops.origtn, "origination (calling) number (default: '')")
-	flag.StringVar(&cliops.origtn, "o", cliops.origtn, "origination (calling) number (default: '')")
-	flag.IntVar(&cliops.iat, "iat", cliops.iat, "timestamp when the token was created")
-	flag.StringVar(&cliops.origid, "orig-id", cliops.origid, "origination identifier (default: '')")
-	flag.BoolVar(&cliops.check, "check", cliops.check, "check validity of the signature")
-	flag.BoolVar(&cliops.check, "c", cliops.check, "check validity of the signature")
-	flag.BoolVar(&cliops.sign, "sign", cliops.sign, "sign the header and payload given as full JSON documents")
-	flag.BoolVar(&cliops.sign, "s", cliops.sign, "sign the header and payload given as full JSON documents")
-	flag.BoolVar(&cliops.signfull, "sign-full", cliops.sign, "sign the header and payload build from the individual parameter values")
-	flag.BoolVar(&cliops.signfull, "S", cliops.sign, "sign the header and payload, with parameters")
-	flag.BoolVar(&cliops.jsonparse, "json-parse", cliops.jsonparse, "parse and re-serialize JSON header and payload values")
-	flag.IntVar(&cliops.expire, "expire", cliops.expire, "duration of token validity (in seconds)")
-	flag.IntVar(&cliops.timeout, "timeout", cliops.timeout, "http get timeout (in seconds, default: 3)")
-	flag.BoolVar(&cliops.ltest, "ltest", cliops.ltest, "run local basic test")
-	flag.BoolVar(&cliops.ltest, "l", cliops.ltest, "run local basic test")
-	flag.BoolVar(&cliops.version, "version", cliops.version, "print version")
-	flag.StringVar(&cliops.cachedir, "cache-dir", cliops.cachedir, "path to the directory with cached certificates (default: '')")
-	flag.IntVar(&cliops.cacheexpire, "cache-expire", cliops.cacheexpire, "duration of cached certificates (in seconds, default 3600)")
-	flag.StringVar(&cliops.cafile, "ca-file", cliops.cafile, "file with root CA certificates in pem format")
-	flag.StringVar(&cliops.cainter, "ca-inter", cliops.cainter, "file with intermediate CA certificates in pem format")
-	flag.StringVar(&cliops.crlfile, "crl-file", cliops.crlfile, "file with CRL in pem format")
-	flag.IntVar(&cliops.certverify, "cert-verify", cliops.certverify, "certificate verification mode (default 0)")
-	flag.IntVar(&cliops.verbosity, "verbosity", cliops.verbosity, "verbosity level (default 0)")
-	flag.IntVar(&cliops.verbosity, "vl", cliops.verbosity, "verbosity level (default 0)")
-    	flag.BoolVar(&cliops.getcertificate, "getcertificate", cliops.getcertificate, "get certificate from STI-CA. Next env vars must be set: CERTIFICATE_PROVIDER=TransNexus, CERTIFICATE_AUTHORITY_TOKEN=MyToken")
-
-}
-
-func localTest() {
-	var err error
+	cliFlagsModes(flag.CommandLine)
+	cliFlagsGeneral(flag.CommandLine)
+	cliFlagsServer(flag.CommandLine)
+	cliFlagsPrvKey(flag.CommandLine)
+	cliFlagsPubKey(flag.CommandLine)
+	cliFlagsToken(flag.CommandLine)
+	cliFlagsJSON(flag.CommandLine)
+	cliFlagsIdentity(flag.CommandLine)
+	cliFlagsCheck(flag.CommandLine)
+	cliFlagsPcap(flag.CommandLine)
+	cliFlagsDecode(flag.CommandLine)
+	cliFlagsKeygen(flag.CommandLine)
+	cliFlagsPKI(flag.CommandLine)
+	cliFlagsCache(flag.CommandLine)
+	cliFlagsFetch(flag.CommandLine)
+	cliFlagsCertVerify(flag.CommandLine)
+	cliFlagsSTIPA(flag.CommandLine)
+}
 
-	header := secsipid.SJWTHeader{
-		Alg: "ES256",
-		Ppt: "shaken",
-		Typ: "passport",
-		X5u: "https://certs.kamailio.org/stir-shaken/cert01.crt",
-	}
-
-	payload := secsipid.SJWTPayload{
-		ATTest: "A",
-		Dest: secsipid.SJWTDest{
-			TN: []string{"493044444444"},
-		},
-		IAT: time.Now().Unix(),
-		Orig: secsipid.SJWTOrig{
-			TN: "493055555555",
-		},
-		OrigID: "32c7e392-33fc-11ea-840b-784f435c76a8",
-	}
-	prvkey, _ := ioutil.ReadFile("../test/certs/ec256-private.pem")
-
-	var ecdsaPrvKey *ecdsa.PrivateKey
-	if ecdsaPrvKey, _, err = secsipid.SJWTParseECPrivateKeyFromPEM(prvkey); err != nil {
-		fmt.Printf("Unable to parse ECDSA private key: %v\n", err)
-		return
-	}
+// cliFlagsModes - options selecting the mode of the legacy command line (without command)
+func cliFlagsModes(fs *flag.FlagSet) {
+	fs.BoolVar(&cliops.check, "check", cliops.check, "check validity of the signature")
+	fs.BoolVar(&cliops.check, "c", cliops.check, "check validity of the signature")
+	fs.StringVar(&cliops.checksip, "check-sip", cliops.checksip, "check all the identity headers of the SIP message in the file ('-' for stdin)")
+	fs.BoolVar(&cliops.sign, "sign", cliops.sign, "sign the header and payload given as full JSON documents")
+	fs.BoolVar(&cliops.sign, "s", cliops.sign, "sign the header and payload given as full JSON documents")
+	fs.BoolVar(&cliops.signfull, "sign-full", cliops.sign, "sign the header and payload build from the individual parameter values")
+	fs.BoolVar(&cliops.signfull, "S", cliops.sign, "sign the header and payload, with parameters")
+	fs.StringVar(&cliops.signsip, "sign-sip", cliops.signsip, "sign the SIP request in the file ('-' for stdin) and print it with the identity and date headers inserted")
+	fs.BoolVar(&cliops.keygen, "keygen", cliops.keygen, "generate P-256 private and public keys and optionally a SHAKEN test certificate")
+	fs.StringVar(&cliops.pkibuild, "pki-build", cliops.pkibuild, "generate a lab PKI (root CA, intermediate CA, leaf certificates and CRL) in this directory")
+	fs.BoolVar(&cliops.decode, "decode", cliops.decode, "decode the identity value without checking it and print its content")
+	fs.StringVar(&cliops.pcap, "pcap", cliops.pcap, "verify the identity headers of the SIP INVITEs in the pcap or pcapng file")
+	fs.BoolVar(&cliops.ltest, "ltest", cliops.ltest, "run the self-test with ephemeral keys and an in-process x5u server")
+	fs.BoolVar(&cliops.ltest, "l", cliops.ltest, "run the self-test with ephemeral keys and an in-process x5u server")
+	fs.BoolVar(&cliops.version, "version", cliops.version, "print version")
+	fs.BoolVar(&cliops.cachelist, "cache-list", cliops.cachelist, "list the certificates in the cache directory")
+	fs.StringVar(&cliops.cacheshow, "cache-show", cliops.cacheshow, "show the details of the cached certificate for the URL")
+	fs.BoolVar(&cliops.cachepurge, "cache-purge", cliops.cachepurge, "remove all the certificates from the cache directory")
+	fs.StringVar(&cliops.cachepurgeurl, "cache-purge-url", cliops.cachepurgeurl, "remove the cached certificate for the URL")
+	fs.StringVar(&cliops.cacheprewarm, "cache-prewarm", cliops.cacheprewarm, "download into the cache the certificates for the URLs in the file (one per line, '-' for stdin)")
+	fs.StringVar(&cliops.bundlebuild, "bundle-build", cliops.bundlebuild, "build the offline bundle in this directory from the certificates in the cache directory")
+	fs.BoolVar(&cliops.getcertificate, "getcertificate", cliops.getcertificate, "get certificate from STI-CA. Next env vars must be set: CERTIFICATE_PROVIDER=TransNexus, CERTIFICATE_AUTHORITY_TOKEN=MyToken")
+	fs.BoolVar(&cliops.stipalists, "stipa-lists", cliops.stipalists, "download STI-PA trust list and CRL to the files given by -ca-file and -crl-file. Next env vars must be set: STIPAAPILogin, STIPAAPIPassword")
+}
+
+// cliFlagsGeneral - options common to all commands
+func cliFlagsGeneral(fs *flag.FlagSet) {
+	fs.IntVar(&cliops.verbosity, "verbosity", cliops.verbosity, "verbosity level (default 0)")
+	fs.IntVar(&cliops.verbosity, "vl", cliops.verbosity, "verbosity level (default 0)")
+	fs.IntVar(&cliops.timeout, "timeout", cliops.timeout, "http get timeout (in seconds, default: 3)")
+}
 
-	pubkey, _ := ioutil.ReadFile("../test/certs/ec256-public.pem")
+// cliFlagsServer - http and https server options
+func cliFlagsServer(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.httpsrv, "http-srv", cliops.httpsrv, "http server bind address")
+	fs.StringVar(&cliops.httpsrv, "H", cliops.httpsrv, "http server bind address")
+	fs.StringVar(&cliops.httpssrv, "https-srv", cliops.httpssrv, "https server bind address")
+	fs.StringVar(&cliops.httpspubkey, "https-pubkey", cliops.httpspubkey, "https server public key")
+	fs.StringVar(&cliops.httpsprvkey, "https-prvkey", cliops.httpsprvkey, "https server private key")
+	fs.StringVar(&cliops.httpdir, "http-dir", cliops.httpdir, "directory to serve over http")
+}
 
-	var ecdsaPubKey *ecdsa.PublicKey
-	if ecdsaPubKey, _, err = secsipid.SJWTParseECPublicKeyFromPEM(pubkey); err != nil {
-		fmt.Printf("Unable to parse ECDSA public key: %v\n", err)
-		return
-	}
+// cliFlagsPrvKey - private key used for signing
+func cliFlagsPrvKey(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.fprvkey, "fprvkey", cliops.fprvkey, "path to private key")
+	fs.StringVar(&cliops.fprvkey, "k", cliops.fprvkey, "path to private key")
+}
+
+// cliFlagsPubKey - public key used for checking
+func cliFlagsPubKey(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.fpubkey, "fpubkey", cliops.fpubkey, "path to public key")
+	fs.StringVar(&cliops.fpubkey, "p", cliops.fpubkey, "path to public key")
+}
+
+// cliFlagsToken - header and payload values of the token to sign
+func cliFlagsToken(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.alg, "alg", cliops.alg, "encryption algorithm (default: ES256)")
+	fs.StringVar(&cliops.ppt, "ppt", cliops.ppt, "used extension (default: shaken)")
+	fs.StringVar(&cliops.typ, "typ", cliops.typ, "token type (default: passport)")
+	fs.StringVar(&cliops.x5u, "x5u", cliops.x5u, "value of the field with the location of the certificate used to sign the token (default: '')")
+	fs.StringVar(&cliops.attest, "attest", cliops.attest, "attestation level (default: 'C')")
+	fs.StringVar(&cliops.attest, "a", cliops.attest, "attestation level (default: 'C')")
+	fs.StringVar(&cliops.desttn, "dest-tn", cliops.desttn, "destination (called) number (default: '')")
+	fs.StringVar(&cliops.desttn, "d", cliops.desttn, "destination (called) number (default: '')")
+	fs.StringVar(&cliops.origtn, "orig-tn", cliops.origtn, "origination (calling) number (default: '')")
+	fs.StringVar(&cliops.origtn, "o", cliops.origtn, "origination (calling) number (default: '')")
+	fs.IntVar(&cliops.iat, "iat", cliops.iat, "timestamp when the token was created")
+	fs.StringVar(&cliops.origid, "orig-id", cliops.origid, "origination identifier (default: '')")
+}
+
+// cliFlagsJSON - header and payload given as JSON documents
+func cliFlagsJSON(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.fheader, "fheader", cliops.fheader, "path to file with header value in JSON format")
+	fs.StringVar(&cliops.header, "header", cliops.header, "header value in JSON format")
+	fs.StringVar(&cliops.fpayload, "fpayload", cliops.fpayload, "path to file with payload value in JSON format")
+	fs.StringVar(&cliops.payload, "payload", cliops.payload, "payload value in JSON format")
+	fs.BoolVar(&cliops.jsonparse, "json-parse", cliops.jsonparse, "parse and re-serialize JSON header and payload values")
+}
+
+// cliFlagsIdentity - identity value to check
+func cliFlagsIdentity(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.fidentity, "fidentity", cliops.fidentity, "path to file with identity value")
+	fs.StringVar(&cliops.identity, "identity", cliops.identity, "identity value")
+}
+
+// cliFlagsCheck - options of checking identity headers
+func cliFlagsCheck(fs *flag.FlagSet) {
+	fs.IntVar(&cliops.expire, "expire", cliops.expire, "duration of token validity (in seconds)")
+	fs.BoolVar(&cliops.legacyidentity, "legacy-identity", cliops.legacyidentity, "verify also RFC 4474 identity headers (with identity-info header) when checking SIP messages")
+	fs.BoolVar(&cliops.legacysha1, "legacy-identity-sha1", cliops.legacysha1, "allow the rsa-sha1 algorithm for RFC 4474 identity headers")
+}
+
+// cliFlagsPcap - options of checking packet captures
+func cliFlagsPcap(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.pcapformat, "pcap-format", cliops.pcapformat, "format of the pcap verification report: 'json' or 'csv' (default: json)")
+}
+
+// cliFlagsDecode - options of decoding identity headers
+func cliFlagsDecode(fs *flag.FlagSet) {
+	fs.BoolVar(&cliops.decodefetch, "decode-fetch", cliops.decodefetch, "download the certificate from x5u when decoding, to show its details and verify it")
+	fs.StringVar(&cliops.decodeformat, "decode-format", cliops.decodeformat, "format of the decoded identity: 'text' or 'json' (default: text)")
+}
+
+// cliFlagsKeygen - options of generating keys and test certificates
+func cliFlagsKeygen(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.keygenout, "keygen-out", cliops.keygenout, "prefix of the generated files: <prefix>-private.pem, <prefix>-public.pem and <prefix>-cert.pem (default: ec256)")
+	fs.BoolVar(&cliops.keygenpkcs8, "keygen-pkcs8", cliops.keygenpkcs8, "write the private key in PKCS#8 format instead of SEC1")
+	fs.StringVar(&cliops.keygenspc, "keygen-spc", cliops.keygenspc, "generate also a SHAKEN test certificate with this SPC in TNAuthList extension (default: '' - no certificate)")
+	fs.BoolVar(&cliops.keygenca, "keygen-ca", cliops.keygenca, "generate a test CA certificate (for -keygen-ca-cert) instead of a SHAKEN end-entity certificate")
+	fs.StringVar(&cliops.keygencn, "keygen-cn", cliops.keygencn, "subject common name of the test certificate (default: 'SHAKEN <spc>')")
+	fs.IntVar(&cliops.keygendays, "keygen-days", cliops.keygendays, "validity of the test certificate (in days, default 365)")
+	fs.StringVar(&cliops.keygenpolicy, "keygen-policy", cliops.keygenpolicy, "certificate policy OID of the test certificate (default: SHAKEN policy)")
+	fs.StringVar(&cliops.keygencrlurl, "keygen-crl-url", cliops.keygencrlurl, "CRL distribution point URL of the test certificate (default: '')")
+	fs.StringVar(&cliops.keygencacert, "keygen-ca-cert", cliops.keygencacert, "CA certificate to sign the test certificate, instead of self-signed (default: '')")
+	fs.StringVar(&cliops.keygencakey, "keygen-ca-key", cliops.keygencakey, "private key of the CA certificate given by -keygen-ca-cert (default: '')")
+}
+
+// cliFlagsPKI - options of generating the lab PKI
+func cliFlagsPKI(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.pkispec, "pki-spec", cliops.pkispec, "JSON file with the spec of the lab PKI (default: '' - root, intermediate, two valid, one revoked and one expired leaf certificates)")
+}
+
+// cliFlagsCache - options of caching downloaded certificates
+func cliFlagsCache(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.cachedir, "cache-dir", cliops.cachedir, "path to the directory with cached certificates (default: '')")
+	fs.StringVar(&cliops.cachestorage, "cache-storage", cliops.cachestorage, "storage of cached certificates instead of cache directory: 'memory', 'file:///path' or 'redis://[:password@]host[:port][/db]' (default: '')")
+	fs.IntVar(&cliops.cacheexpire, "cache-expire", cliops.cacheexpire, "duration of cached certificates (in seconds, default 3600)")
+	fs.IntVar(&cliops.cachemaxsize, "cache-max-size", cliops.cachemaxsize, "maximum size of the cache directory in bytes, enforced when cleaning it (default 0 - unlimited)")
+	fs.IntVar(&cliops.cacheclean, "cache-clean-interval", cliops.cacheclean, "interval to remove expired entries from the cache directory (in seconds, default 0 - disabled)")
+	fs.IntVar(&cliops.cacherefresh, "cache-refresh-ahead", cliops.cacherefresh, "download again the frequently used cached certificates when they expire in less than this interval (in seconds, default 0 - disabled)")
+	fs.IntVar(&cliops.cacherefreshhits, "cache-refresh-min-hits", cliops.cacherefreshhits, "number of uses of a cached certificate to be refreshed before expiry (default 10)")
+	fs.StringVar(&cliops.offlinebundle, "offline-bundle", cliops.offlinebundle, "offline mode: get x5u certificates only from the bundle directory or manifest file, without downloading them")
+}
+
+// cliFlagsFetch - options of downloading certificates
+func cliFlagsFetch(fs *flag.FlagSet) {
+	fs.IntVar(&cliops.negexpire, "neg-cache-expire", cliops.negexpire, "duration of caching connection failures and timeouts of x5u downloads (in seconds, default 0 - disabled)")
+	fs.IntVar(&cliops.negstatusexpire, "neg-cache-status-expire", cliops.negstatusexpire, "duration of caching http status errors of x5u downloads (in seconds, default 0 - disabled)")
+	fs.IntVar(&cliops.breakerthreshold, "breaker-threshold", cliops.breakerthreshold, "number of consecutive connection failures after which downloads from a x5u host fail fast (default 0 - disabled)")
+	fs.IntVar(&cliops.breakeropentime, "breaker-open-time", cliops.breakeropentime, "duration of failing fast for a x5u host before trying again (in seconds, default 60)")
+	fs.BoolVar(&cliops.fetchhttps, "fetch-https", cliops.fetchhttps, "download x5u certificates only over https")
+	fs.BoolVar(&cliops.fetchblockpriv, "fetch-block-private", cliops.fetchblockpriv, "do not download x5u certificates from private, loopback or link-local addresses")
+	fs.StringVar(&cliops.fetchallowhosts, "fetch-allow-hosts", cliops.fetchallowhosts, "comma separated list of host patterns (e.g., '*.example.com') allowed for x5u downloads (default: '' - all)")
+	fs.StringVar(&cliops.fetchdenyhosts, "fetch-deny-hosts", cliops.fetchdenyhosts, "comma separated list of host patterns denied for x5u downloads (default: '')")
+	fs.IntVar(&cliops.fetchmaxsize, "fetch-max-size", cliops.fetchmaxsize, "maximum size of downloaded x5u content (in bytes, 0 - unlimited)")
+	fs.IntVar(&cliops.fetchmaxredirect, "fetch-max-redirects", cliops.fetchmaxredirect, "maximum number of redirects for x5u downloads (default 10)")
+	fs.StringVar(&cliops.fetchctypes, "fetch-content-types", cliops.fetchctypes, "comma separated list of content types allowed for x5u downloads (default: '' - all)")
+}
 
-	token := secsipid.SJWTEncode(header, payload, ecdsaPrvKey)
-	fmt.Printf("Result: %s\n", token)
-	payloadOut, _ := secsipid.SJWTDecodeWithPubKey(token, cliops.expire, ecdsaPubKey)
-	jsonPayload, _ := json.Marshal(payloadOut)
-	fmt.Printf("Payload: %s\n", jsonPayload)
+// cliFlagsCertVerify - options of verifying certificates
+func cliFlagsCertVerify(fs *flag.FlagSet) {
+	fs.StringVar(&cliops.cafile, "ca-file", cliops.cafile, "file with root CA certificates in pem format")
+	fs.StringVar(&cliops.cainter, "ca-inter", cliops.cainter, "file with intermediate CA certificates in pem format")
+	fs.StringVar(&cliops.crlfile, "crl-file", cliops.crlfile, "file with CRL in pem format")
+	fs.StringVar(&cliops.cadir, "ca-dir", cliops.cadir, "hashed directory (c_rehash style) with root CA certificates in pem format")
+	fs.StringVar(&cliops.catrustlist, "ca-trust-list", cliops.catrustlist, "file with STI-PA trust list of root CA certificates in JSON format")
+	fs.IntVar(&cliops.certverify, "cert-verify", cliops.certverify, "certificate verification mode (default 0)")
+}
 
-	headerJSON, _ := json.Marshal(header)
-	payloadJSON, _ := json.Marshal(payload)
-	signatureText, _, _ := secsipid.SJWTEncodeText(string(headerJSON), string(payloadJSON), "certs/ec256-private.pem")
-	fmt.Printf("Signature: %s\n", signatureText)
+// cliFlagsSTIPA - options of downloading STI-PA lists
+func cliFlagsSTIPA(fs *flag.FlagSet) {
+	fs.IntVar(&cliops.stipainterval, "stipa-interval", cliops.stipainterval, "repeat the download of STI-PA lists at this interval (in seconds, default 0 - download once)")
+	fs.StringVar(&cliops.stipacrlissuer, "stipa-crl-issuer", cliops.stipacrlissuer, "file with the certificate of the STI-PA CRL issuer, if it is not in the trust list")
 }
 
 func secsipidxCLISignFull() int {
@@ -391,6 +586,48 @@ func httpHandleV1Check(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK\n")
 }
 
+func httpHandleV1CheckSIP(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("incoming request for SIP message check ...\n")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("error reading body: %v\n", err)
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	result, ret, err := secsipid.SJWTCheckSIPMessage(body, cliops.expire, cliops.timeout)
+	if result == nil {
+		fmt.Printf("failed parsing SIP message: %v\n", err)
+		http.Error(w, "invalid SIP message", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed checking SIP message: (%d) %v\n", ret, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if ret != secsipid.SJWTRetOK {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func httpHandleV1StatusHosts(w http.ResponseWriter, r *http.Request) {
+	// all hosts with failures are listed with ?all=1, otherwise only the tripped ones
+	onlyTripped := len(r.URL.Query().Get("all")) == 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secsipid.SJWTGetHostsStatus(onlyTripped))
+}
+
+func httpHandleV1StatusTrustStore(w http.ResponseWriter, r *http.Request) {
+	// the trust store is loaded again with POST
+	if r.Method == http.MethodPost {
+		if ret, err := secsipid.SJWTReloadTrustStore(); ret != secsipid.SJWTRetOK {
+			fmt.Printf("failed to reload trust store: (%d) %v\n", ret, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secsipid.SJWTGetTrustStoreInfo())
+}
+
 func httpHandleV1SignCSV(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("incoming request for building identity ...\n")
 	body, err := ioutil.ReadAll(r.Body)
@@ -448,24 +685,619 @@ func startHTTPServices() chan error {
 	return errchan
 }
 
-func main() {
-	var ret int
+// download STI-PA trust list and CRL, once or periodically
+func secsipidxCLISTIPALists() int {
+	if len(cliops.cafile) <= 0 && len(cliops.crlfile) <= 0 {
+		fmt.Printf("path to CA file or CRL file not provided\n")
+		return -1
+	}
+	for {
+		err := certprovider.DownloadSTIPALists(cliops.cafile, cliops.crlfile, cliops.stipacrlissuer)
+		if err != nil {
+			log.Println(err)
+			if cliops.stipainterval <= 0 {
+				return -1
+			}
+		} else if cliops.verbosity > 0 {
+			log.Printf("STI-PA lists downloaded (ca file: %s, crl file: %s)", cliops.cafile, cliops.crlfile)
+		}
+		if cliops.stipainterval <= 0 {
+			return 0
+		}
+		time.Sleep(time.Duration(cliops.stipainterval) * time.Second)
+	}
+}
 
-	flag.Parse()
+// print the counts and the certificates of the trust store
+func secsipidxCLITrustInfo() int {
+	info := secsipid.SJWTGetTrustStoreInfo()
+	fmt.Printf("roots: %d, intermediates: %d\n", info.Roots, info.Intermediates)
+	if !info.Loaded.IsZero() {
+		fmt.Printf("loaded: %s\n", info.Loaded.UTC().Format(time.RFC3339))
+	}
+	if len(info.LastError) > 0 {
+		fmt.Printf("last error: %s\n", info.LastError)
+	}
+	if len(info.Certificates) == 0 {
+		return 0
+	}
+	fmt.Printf("\n")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\tSUBJECT\tNOT AFTER\tSOURCE\tFINGERPRINT\n")
+	for _, cert := range info.Certificates {
+		certType := "root"
+		if cert.Intermediate {
+			certType = "intermediate"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", certType, cert.Subject,
+			cert.NotAfter.UTC().Format(time.RFC3339), cert.Source, cert.Fingerprint)
+	}
+	tw.Flush()
+	return 0
+}
 
-	if cliops.version {
-		fmt.Printf("%s v%s\n", filepath.Base(os.Args[0]), secsipidxVersion)
-		os.Exit(1)
+// load again the certificates of the trust store
+func secsipidxCLITrustReload() int {
+	ret, err := secsipid.SJWTReloadTrustStore()
+	if ret != secsipid.SJWTRetOK {
+		fmt.Printf("failed to reload trust store: (%d) %v\n", ret, err)
+		return -1
 	}
+	return secsipidxCLITrustInfo()
+}
 
-	if cliops.ltest {
-		localTest()
-		os.Exit(1)
+// list the certificates in the cache directory
+func secsipidxCLICacheList() int {
+	if len(cliops.cachedir) <= 0 {
+		fmt.Printf("path to cache directory not provided\n")
+		return -1
+	}
+	entries, err := secsipid.SJWTListURLCache(cliops.cachedir)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	tnow := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "URL\tSUBJECT\tSPC\tNOT AFTER\tAGE\tSTATUS\n")
+	for _, entry := range entries {
+		urlVal := entry.URL
+		if len(urlVal) == 0 {
+			urlVal = filepath.Base(entry.FilePath)
+		}
+		status := "valid"
+		if len(entry.Error) > 0 {
+			status = "invalid"
+		} else if entry.Expired {
+			status = "expired"
+		}
+		notAfter := "-"
+		if !entry.NotAfter.IsZero() {
+			notAfter = entry.NotAfter.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", urlVal, entry.Subject, entry.SPC, notAfter,
+			tnow.Sub(entry.Fetched).Truncate(time.Second), status)
+	}
+	tw.Flush()
+	return 0
+}
+
+// show the details of the cached certificate for an URL
+func secsipidxCLICacheShow() int {
+	if len(cliops.cachedir) <= 0 {
+		fmt.Printf("path to cache directory not provided\n")
+		return -1
+	}
+	entry, err := secsipid.SJWTGetURLCacheEntry(cliops.cachedir, cliops.cacheshow)
+	if err != nil {
+		fmt.Printf("certificate not cached: %s\n", cliops.cacheshow)
+		return -1
+	}
+	data, _ := json.MarshalIndent(entry, "", "  ")
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// remove all the cached certificates or the one for an URL
+func secsipidxCLICachePurge() int {
+	if len(cliops.cachepurgeurl) > 0 && (len(cliops.cachestorage) > 0 || len(cliops.cachedir) > 0) {
+		if err := secsipid.SJWTDeleteURLCachedContent(cliops.cachepurgeurl); err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		fmt.Printf("removed: %s\n", cliops.cachepurgeurl)
+		return 0
+	}
+	if len(cliops.cachedir) <= 0 {
+		fmt.Printf("path to cache directory not provided\n")
+		return -1
+	}
+	removed, err := secsipid.SJWTPurgeURLCache(cliops.cachedir, "")
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	fmt.Printf("removed: %d\n", removed)
+	return 0
+}
+
+// download into the cache the certificates for the URLs listed in a file
+func secsipidxCLICachePrewarm() int {
+	if len(cliops.cachedir) <= 0 && len(cliops.cachestorage) <= 0 {
+		fmt.Printf("path to cache directory or cache storage not provided\n")
+		return -1
+	}
+	var data []byte
+	var err error
+	if cliops.cacheprewarm == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(cliops.cacheprewarm)
+	}
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	ret := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		urlVal := strings.TrimSpace(line)
+		if len(urlVal) == 0 || strings.HasPrefix(urlVal, "#") {
+			continue
+		}
+		_, cret, err := secsipid.SJWTGetURLContent(urlVal, cliops.timeout)
+		if cret != secsipid.SJWTRetOK {
+			fmt.Printf("failed: %s (%d: %v)\n", urlVal, cret, err)
+			ret = -1
+			continue
+		}
+		fmt.Printf("cached: %s\n", urlVal)
+	}
+	return ret
+}
+
+// check all the identity headers of a SIP message, printing the results
+func secsipidxCLICheckSIP() int {
+	var data []byte
+	var err error
+	if cliops.checksip == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(cliops.checksip)
+	}
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	result, ret, err := secsipid.SJWTCheckSIPMessage(data, cliops.expire, cliops.timeout)
+	if result == nil {
+		fmt.Printf("error message: %v\n", err)
+		return ret
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Printf("%s\n", out)
+	return ret
+}
+
+// sign a SIP request, printing it with the identity header inserted
+func secsipidxCLISignSIP() int {
+	if len(cliops.fprvkey) <= 0 {
+		fmt.Printf("path to private key not provided\n")
+		return -1
+	}
+	prvkey, err := ioutil.ReadFile(cliops.fprvkey)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	var data []byte
+	if cliops.signsip == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(cliops.signsip)
+	}
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	signed, ret, err := secsipid.SJWTSignSIPMessage(data, cliops.attest, cliops.origid, cliops.x5u, prvkey)
+	if ret != secsipid.SJWTRetOK {
+		fmt.Printf("error message: %v\n", err)
+		return ret
+	}
+	os.Stdout.Write(signed)
+	return 0
+}
+
+// pcapIdentityRow - the result of verifying an identity header found in a
+// SIP INVITE of a packet capture
+type pcapIdentityRow struct {
+	Time   string `json:"time"`
+	CallID string `json:"callid"`
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	Ppt    string `json:"ppt"`
+	Orig   string `json:"orig"`
+	Dest   string `json:"dest"`
+	Attest string `json:"attest"`
+	X5u    string `json:"x5u"`
+	Ret    int    `json:"ret"`
+	Result string `json:"result"`
+}
+
+// pcapDecodeIdentity - fill the row with the values from the JWT header and
+// payload of the identity header
+func pcapDecodeIdentity(row *pcapIdentityRow, identityVal string) {
+	decoded, ret, _ := secsipid.SJWTDecodeIdentity(identityVal, false, cliops.timeout)
+	if ret != secsipid.SJWTRetOK {
+		return
+	}
+	row.X5u = decoded.X5u
+	row.Ppt = decoded.Ppt
+	var header secsipid.SJWTHeader
+	if len(row.Ppt) == 0 && json.Unmarshal(decoded.Header, &header) == nil {
+		row.Ppt = header.Ppt
+	}
+	var payload secsipid.SJWTPayload
+	if json.Unmarshal(decoded.Payload, &payload) == nil {
+		row.Orig = payload.Orig.TN
+		row.Dest = strings.Join(payload.Dest.TN, ",")
+		row.Attest = payload.ATTest
+	}
+}
+
+// write the content to a new file, not overwriting an existing one
+func secsipidxWriteNewFile(filePath string, data []byte, perm os.FileMode) error {
+	fd, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// generate the private and public keys and optionally a test certificate
+func secsipidxCLIKeygen() int {
+	var caCerts []*x509.Certificate
+	var caKey *ecdsa.PrivateKey
+	if len(cliops.keygencacert) > 0 || len(cliops.keygencakey) > 0 {
+		if len(cliops.keygencacert) <= 0 || len(cliops.keygencakey) <= 0 {
+			fmt.Printf("both CA certificate and CA private key have to be provided\n")
+			return -1
+		}
+		data, err := ioutil.ReadFile(cliops.keygencacert)
+		if err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		if caCerts, _, err = secsipid.SJWTParseCertificates(data); err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		if data, err = ioutil.ReadFile(cliops.keygencakey); err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		if caKey, _, err = secsipid.SJWTParseECPrivateKeyFromPEM(data); err != nil {
+			fmt.Printf("Unable to parse ECDSA private key: %v\n", err)
+			return -1
+		}
+	}
+
+	key, _, err := secsipid.SJWTGenerateECKey()
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	prvPEM, _, err := secsipid.SJWTEncodeECPrivateKeyToPEM(key, cliops.keygenpkcs8)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	pubPEM, _, err := secsipid.SJWTEncodeECPublicKeyToPEM(&key.PublicKey)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	type keygenFile struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}
+	files := []keygenFile{
+		{cliops.keygenout + "-private.pem", prvPEM, 0600},
+		{cliops.keygenout + "-public.pem", pubPEM, 0644},
+	}
+
+	if len(cliops.keygenspc) > 0 || cliops.keygenca {
+		opts := &secsipid.SJWTCertOptions{
+			IsCA:       cliops.keygenca,
+			SPC:        cliops.keygenspc,
+			CommonName: cliops.keygencn,
+			Days:       cliops.keygendays,
+			PolicyOID:  cliops.keygenpolicy,
+			CRLURL:     cliops.keygencrlurl,
+		}
+		var certPEM []byte
+		if caKey != nil {
+			certPEM, _, err = secsipid.SJWTCreateCertificate(opts, &key.PublicKey, caCerts[0], caKey)
+			// the chain up to the root is served at x5u URL, without the root
+			for _, caCert := range caCerts {
+				if caCert.Subject.String() != caCert.Issuer.String() {
+					certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+				}
+			}
+		} else {
+			certPEM, _, err = secsipid.SJWTCreateCertificate(opts, &key.PublicKey, nil, key)
+		}
+		if err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		files = append(files, keygenFile{cliops.keygenout + "-cert.pem", certPEM, 0644})
+	}
+
+	for _, file := range files {
+		if err = secsipidxWriteNewFile(file.path, file.data, file.perm); err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		fmt.Printf("written: %s\n", file.path)
+	}
+	return 0
+}
+
+// generate the lab PKI in the directory and print the options to use it
+func secsipidxCLIPKIBuild() int {
+	spec := secsipid.SJWTDefaultLabPKISpec()
+	if len(cliops.pkispec) > 0 {
+		data, err := ioutil.ReadFile(cliops.pkispec)
+		if err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		if spec, err = secsipid.SJWTParseLabPKISpec(data); err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+	}
+	manifest, err := secsipid.SJWTBuildLabPKI(spec, cliops.pkibuild)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	for _, leaf := range manifest.Leaves {
+		status := "valid"
+		if leaf.Revoked {
+			status = "revoked"
+		} else if leaf.Expired {
+			status = "expired"
+		}
+		fmt.Printf("leaf: %s spc: %s serial: %s status: %s key: %s cert: %s chain: %s\n", leaf.Name, leaf.SPC,
+			leaf.Serial, status, leaf.KeyFile, leaf.CertFile, leaf.ChainFile)
+	}
+	fmt.Printf("manifest: %s\n", filepath.Join(cliops.pkibuild, "manifest.json"))
+	fmt.Printf("verify options: -ca-file %s -ca-inter %s -crl-file %s -cert-verify 29\n",
+		filepath.Join(cliops.pkibuild, manifest.CAFile), filepath.Join(cliops.pkibuild, manifest.CAInterFile),
+		filepath.Join(cliops.pkibuild, manifest.CRLFile))
+	return 0
+}
+
+// decode the identity header without checking it, printing its content
+func secsipidxCLIDecode() int {
+	var identityVal string
+	if cliops.identity == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		identityVal = string(data)
+	} else if len(cliops.fidentity) > 0 {
+		data, err := ioutil.ReadFile(cliops.fidentity)
+		if err != nil {
+			fmt.Printf("error message: %v\n", err)
+			return -1
+		}
+		identityVal = string(data)
+	} else if len(cliops.identity) > 0 {
+		identityVal = cliops.identity
+	} else {
+		fmt.Printf("Identity value not provided\n")
+		return -1
+	}
+	// the value can be copied with the header name
+	identityVal = strings.TrimSpace(identityVal)
+	if idx := strings.IndexByte(identityVal, ':'); idx > 0 && strings.EqualFold(strings.TrimSpace(identityVal[:idx]), "identity") {
+		identityVal = strings.TrimSpace(identityVal[idx+1:])
+	}
+
+	decoded, ret, err := secsipid.SJWTDecodeIdentity(identityVal, cliops.decodefetch, cliops.timeout)
+	if ret != secsipid.SJWTRetOK {
+		fmt.Printf("error message: %v\n", err)
+		return ret
+	}
+	if cliops.decodeformat == "json" {
+		out, _ := json.MarshalIndent(decoded, "", "  ")
+		fmt.Printf("%s\n", out)
+		return 0
+	}
+
+	fmt.Printf("Identity parameters:\n")
+	fmt.Printf("  info: %s\n", decoded.Info)
+	fmt.Printf("  alg: %s\n", decoded.Alg)
+	fmt.Printf("  ppt: %s\n", decoded.Ppt)
+	for name, value := range decoded.Params {
+		fmt.Printf("  %s: %s\n", name, value)
+	}
+	header, _ := json.MarshalIndent(decoded.Header, "  ", "  ")
+	fmt.Printf("JWT header:\n  %s\n", header)
+	payload, _ := json.MarshalIndent(decoded.Payload, "  ", "  ")
+	fmt.Printf("JWT payload:\n  %s\n", payload)
+	if decoded.IAT > 0 {
+		fmt.Printf("Issued at: %s (age: %s)\n", decoded.IATDate, time.Duration(decoded.Age)*time.Second)
+	} else {
+		fmt.Printf("Issued at: -\n")
+	}
+	fmt.Printf("Signature length: %d bytes\n", decoded.SignatureLength)
+	if cert := decoded.Cert; cert != nil {
+		fmt.Printf("Certificate:\n")
+		fmt.Printf("  url: %s\n", cert.URL)
+		if cert.ChainCerts > 0 {
+			fmt.Printf("  subject: %s\n", cert.Subject)
+			fmt.Printf("  issuer: %s\n", cert.Issuer)
+			fmt.Printf("  spc: %s\n", cert.SPC)
+			fmt.Printf("  not before: %s\n", cert.NotBefore.Format(time.RFC3339))
+			fmt.Printf("  not after: %s\n", cert.NotAfter.Format(time.RFC3339))
+			fmt.Printf("  chain certificates: %d\n", cert.ChainCerts)
+		}
+		if len(cert.Error) > 0 {
+			fmt.Printf("  chain status: %s (%d: %s)\n", cert.ChainStatus, cert.Ret, cert.Error)
+		} else {
+			fmt.Printf("  chain status: %s\n", cert.ChainStatus)
+		}
+	}
+	return 0
+}
+
+// verify the identity headers of the SIP INVITEs in a pcap or pcapng file,
+// printing a report with one row per identity header
+func secsipidxCLIPcap() int {
+	fd, err := os.Open(cliops.pcap)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	defer fd.Close()
+	msgs, err := sipcapture.ReadSIPMessages(fd)
+	if err != nil && len(msgs) == 0 {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+
+	var rows []pcapIdentityRow
+	seen := make(map[string]bool)
+	ret := 0
+	for _, m := range msgs {
+		msg, mret, _ := secsipid.SJWTParseSIPMessage(m.Data)
+		if mret != secsipid.SJWTRetOK || msg.Method != "INVITE" || len(msg.Identity) == 0 || seen[msg.CallID] {
+			continue
+		}
+		// only the first INVITE of the call, not the retransmissions and re-INVITEs
+		seen[msg.CallID] = true
+
+		// the validity of the token is evaluated at the time of the capture
+		expire := int(time.Since(m.Time).Seconds()) + cliops.expire
+		result, _, _ := secsipid.SJWTCheckSIPMessage(m.Data, expire, cliops.timeout)
+		if result == nil {
+			continue
+		}
+		newRow := func(itemRet int, itemErr string) pcapIdentityRow {
+			row := pcapIdentityRow{
+				Time:   m.Time.Format(time.RFC3339Nano),
+				CallID: msg.CallID,
+				Src:    m.Transport + ":" + m.Src,
+				Dst:    m.Transport + ":" + m.Dst,
+				Ret:    itemRet,
+				Result: "ok",
+			}
+			if itemRet != secsipid.SJWTRetOK {
+				row.Result = itemErr
+				ret = -1
+			}
+			return row
+		}
+		for _, item := range result.Results {
+			row := newRow(item.Ret, item.Error)
+			pcapDecodeIdentity(&row, item.Identity)
+			rows = append(rows, row)
+		}
+		for _, item := range result.Legacy {
+			row := newRow(item.Ret, item.Error)
+			row.Ppt = "rfc4474"
+			row.X5u = item.Info
+			row.Orig = msg.From
+			row.Dest = msg.To
+			rows = append(rows, row)
+		}
+	}
+
+	if cliops.pcapformat == "csv" {
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"time", "callid", "src", "dst", "ppt", "orig", "dest", "attest", "x5u", "ret", "result"})
+		for _, row := range rows {
+			w.Write([]string{row.Time, row.CallID, row.Src, row.Dst, row.Ppt, row.Orig, row.Dest,
+				row.Attest, row.X5u, strconv.Itoa(row.Ret), row.Result})
+		}
+		w.Flush()
+	} else {
+		if rows == nil {
+			rows = []pcapIdentityRow{}
+		}
+		out, _ := json.MarshalIndent(rows, "", "  ")
+		fmt.Printf("%s\n", out)
 	}
+	return ret
+}
 
+// build the offline bundle from the certificates in the cache directory
+func secsipidxCLIBundleBuild() int {
+	if len(cliops.cachedir) <= 0 {
+		fmt.Printf("path to cache directory not provided\n")
+		return -1
+	}
+	n, err := secsipid.SJWTBuildOfflineBundle(cliops.cachedir, cliops.bundlebuild)
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	fmt.Printf("certificates in bundle: %d\n", n)
+	return 0
+}
+
+// set the library options from the command line options
+func secsipidxLibInit() int {
 	if len(cliops.cachedir) > 0 {
 		secsipid.SetURLFileCacheOptions(cliops.cachedir, cliops.cacheexpire)
+		secsipid.SJWTLibOptSetN("CacheMaxSize", cliops.cachemaxsize)
+		secsipid.SJWTLibOptSetN("CacheCleanInterval", cliops.cacheclean)
+	}
+	if len(cliops.cachestorage) > 0 {
+		secsipid.SJWTLibOptSetN("CacheExpires", cliops.cacheexpire)
+		if secsipid.SJWTLibOptSetS("CacheStorage", cliops.cachestorage) != secsipid.SJWTRetOK {
+			fmt.Printf("invalid cache storage: %s\n", cliops.cachestorage)
+			return 1
+		}
+	}
+	if len(cliops.cachedir) > 0 || len(cliops.cachestorage) > 0 {
+		secsipid.SJWTLibOptSetN("CacheRefreshMinHits", cliops.cacherefreshhits)
+		secsipid.SJWTLibOptSetN("CacheRefreshAhead", cliops.cacherefresh)
+	}
+
+	if len(cliops.offlinebundle) > 0 {
+		if secsipid.SJWTLibOptSetS("OfflineBundle", cliops.offlinebundle) != secsipid.SJWTRetOK {
+			fmt.Printf("invalid offline bundle: %s\n", cliops.offlinebundle)
+			return 1
+		}
+	}
+
+	secsipid.SJWTLibOptSetN("NegCacheExpire", cliops.negexpire)
+	secsipid.SJWTLibOptSetN("NegCacheStatusExpire", cliops.negstatusexpire)
+	secsipid.SJWTLibOptSetN("HostBreakerThreshold", cliops.breakerthreshold)
+	secsipid.SJWTLibOptSetN("HostBreakerOpenTime", cliops.breakeropentime)
+	if cliops.fetchhttps {
+		secsipid.SJWTLibOptSetN("URLRequireHTTPS", 1)
+	}
+	if cliops.fetchblockpriv {
+		secsipid.SJWTLibOptSetN("URLBlockPrivateIPs", 1)
 	}
+	secsipid.SJWTLibOptSetS("URLAllowHosts", cliops.fetchallowhosts)
+	secsipid.SJWTLibOptSetS("URLDenyHosts", cliops.fetchdenyhosts)
+	secsipid.SJWTLibOptSetN("URLMaxBodySize", cliops.fetchmaxsize)
+	secsipid.SJWTLibOptSetN("URLMaxRedirects", cliops.fetchmaxredirect)
+	secsipid.SJWTLibOptSetS("URLContentTypes", cliops.fetchctypes)
 
 	if len(cliops.cafile) > 0 {
 		secsipid.SJWTLibOptSetS("CertCAFile", cliops.cafile)
@@ -476,56 +1308,179 @@ func main() {
 	if len(cliops.crlfile) > 0 {
 		secsipid.SJWTLibOptSetS("CertCRLFile", cliops.crlfile)
 	}
+	if len(cliops.cadir) > 0 {
+		secsipid.SJWTLibOptSetS("CertCADir", cliops.cadir)
+	}
+	if len(cliops.catrustlist) > 0 {
+		secsipid.SJWTLibOptSetS("CertCATrustList", cliops.catrustlist)
+	}
 	if cliops.certverify > 0 {
 		secsipid.SJWTLibOptSetN("CertVerify", cliops.certverify)
 	}
 	if len(cliops.x5u) > 0 {
 		secsipid.SJWTLibOptSetS("x5u", cliops.x5u)
 	}
+	if cliops.legacyidentity {
+		secsipid.SJWTLibOptSetN("LegacyIdentity", 1)
+	}
+	if cliops.legacysha1 {
+		secsipid.SJWTLibOptSetN("LegacyIdentitySHA1", 1)
+	}
+	return 0
+}
+
+// run the http and https services until one of them fails
+func secsipidxCLIServe() int {
+	if len(cliops.httpsrv) <= 0 && (len(cliops.httpssrv) <= 0 || len(cliops.httpspubkey) <= 0 || len(cliops.httpsprvkey) <= 0) {
+		fmt.Printf("http server bind address or https server bind address and keys not provided\n")
+		return 1
+	}
+	http.HandleFunc("/v1/check", httpHandleV1Check)
+	http.HandleFunc("/v1/check-sip", httpHandleV1CheckSIP)
+	http.HandleFunc("/v1/sign-csv", httpHandleV1SignCSV)
+	http.HandleFunc("/v1/status/hosts", httpHandleV1StatusHosts)
+	http.HandleFunc("/v1/status/truststore", httpHandleV1StatusTrustStore)
+	if len(cliops.httpdir) > 0 {
+		fmt.Printf("serving files over http from directory: %s\n", cliops.httpdir)
+		http.Handle("/v1/pub/", http.StripPrefix("/v1/pub/", http.FileServer(http.Dir(cliops.httpdir))))
+	}
+	fmt.Printf("starting http services ...\n")
 
-	if (len(cliops.httpsrv) > 0) || (len(cliops.httpssrv) > 0 && len(cliops.httpspubkey) > 0 && len(cliops.httpsprvkey) > 0) {
-		http.HandleFunc("/v1/check", httpHandleV1Check)
-		http.HandleFunc("/v1/sign-csv", httpHandleV1SignCSV)
-		if len(cliops.httpdir) > 0 {
-			fmt.Printf("serving files over http from directory: %s\n", cliops.httpdir)
-			http.Handle("/v1/pub/", http.StripPrefix("/v1/pub/", http.FileServer(http.Dir(cliops.httpdir))))
+	errchan := startHTTPServices()
+	select {
+	case err := <-errchan:
+		log.Printf("unable to start http services due to (error: %v)", err)
+	}
+	return 1
+}
+
+// get a new certificate from the STI-CA given by the environment
+func secsipidxCLIGetCertificate() int {
+	//get certificate provider from env
+	certProviderValue := os.Getenv("CERTIFICATE_PROVIDER")
+	var certProvider *certprovider.CertProvider = &certprovider.CertProvider{}
+
+	switch certProviderValue {
+	case "transnexus":
+		certProvider.Provider = &certprovider.TransNexus{}
+	case "peeringhub":
+		certProvider.Provider = &certprovider.PeeringHub{}
+	default:
+		if certProviderValue == "" {
+			fmt.Printf("Environment variable must be set: CERTIFICATE_PROVIDER\n")
+		} else {
+			fmt.Printf("CERTIFICATE_PROVIDER=%v is not supported yet. Only supported values: transnexus, peeringhub\n", certProviderValue)
 		}
-		fmt.Printf("starting http services ...\n")
+		return 1
+	}
+
+	err := certProvider.IssueNewCertificate()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	certProvider.PrintCertificate(os.Stdout)
+	return 0
+}
+
+// print the status of a check command
+func secsipidxCLICheckStatus(ret int) int {
+	if ret == 0 {
+		fmt.Printf("ok\n")
+	} else {
+		fmt.Printf("not-ok\n")
+	}
+	return ret
+}
+
+func main() {
+	var ret int
 
-		errchan := startHTTPServices()
-		select {
-		case err := <-errchan:
-			log.Printf("unable to start http services due to (error: %v)", err)
+	if len(os.Args) > 1 {
+		if cmd := secsipidxFindCommand(os.Args[1]); cmd != nil {
+			os.Exit(secsipidxRunCommand(cmd, os.Args[2:]))
 		}
+	}
+
+	// no command - the mode is selected by the options
+	flag.Parse()
+
+	if cliops.version {
+		fmt.Printf("%s v%s\n", filepath.Base(os.Args[0]), secsipidxVersion)
 		os.Exit(1)
 	}
 
+	if cliops.ltest {
+		os.Exit(secsipidxCLISelfTest())
+	}
+
+	if ret = secsipidxLibInit(); ret != 0 {
+		os.Exit(ret)
+	}
+
+	if (len(cliops.httpsrv) > 0) || (len(cliops.httpssrv) > 0 && len(cliops.httpspubkey) > 0 && len(cliops.httpsprvkey) > 0) {
+		os.Exit(secsipidxCLIServe())
+	}
+
 	if cliops.getcertificate {
-		//get certificate provider from env
-		certProviderValue := os.Getenv("CERTIFICATE_PROVIDER")
-		var certProvider *certprovider.CertProvider = &certprovider.CertProvider{}
-
-		switch certProviderValue {
-		case "transnexus":
-			certProvider.Provider = &certprovider.TransNexus{}
-		case "peeringhub":
-			certProvider.Provider = &certprovider.PeeringHub{}
-		default:
-			if certProviderValue == "" {
-				fmt.Printf("Environment variable must be set: CERTIFICATE_PROVIDER\n")
-			} else {
-				fmt.Printf("CERTIFICATE_PROVIDER=%v is not supported yet. Only supported values: transnexus, peeringhub\n", certProviderValue)
-			}
-			os.Exit(1)
-		}
+		os.Exit(secsipidxCLIGetCertificate())
+	}
 
-		err := certProvider.IssueNewCertificate()
-		if err != nil {
-			log.Println(err)
-			os.Exit(1)
-		}
-		certProvider.PrintCertificate(os.Stdout)
-		os.Exit(0)
+	if cliops.stipalists {
+		ret = secsipidxCLISTIPALists()
+		os.Exit(ret)
+	}
+
+	if cliops.cachelist {
+		ret = secsipidxCLICacheList()
+		os.Exit(ret)
+	}
+	if len(cliops.cacheshow) > 0 {
+		ret = secsipidxCLICacheShow()
+		os.Exit(ret)
+	}
+	if cliops.cachepurge || len(cliops.cachepurgeurl) > 0 {
+		ret = secsipidxCLICachePurge()
+		os.Exit(ret)
+	}
+	if len(cliops.cacheprewarm) > 0 {
+		ret = secsipidxCLICachePrewarm()
+		os.Exit(ret)
+	}
+
+	if len(cliops.bundlebuild) > 0 {
+		ret = secsipidxCLIBundleBuild()
+		os.Exit(ret)
+	}
+
+	if len(cliops.checksip) > 0 {
+		ret = secsipidxCLICheckStatus(secsipidxCLICheckSIP())
+		os.Exit(ret)
+	}
+
+	if len(cliops.signsip) > 0 {
+		ret = secsipidxCLISignSIP()
+		os.Exit(ret)
+	}
+
+	if len(cliops.pcap) > 0 {
+		ret = secsipidxCLIPcap()
+		os.Exit(ret)
+	}
+
+	if cliops.decode {
+		ret = secsipidxCLIDecode()
+		os.Exit(ret)
+	}
+
+	if cliops.keygen {
+		ret = secsipidxCLIKeygen()
+		os.Exit(ret)
+	}
+
+	if len(cliops.pkibuild) > 0 {
+		ret = secsipidxCLIPKIBuild()
+		os.Exit(ret)
 	}
 
 	ret = 0
@@ -533,12 +1488,7 @@ func main() {
 		if cliops.verbosity > 0 {
 			fmt.Printf("Running with check command\n")
 		}
-		ret = secsipidxCLICheck()
-		if ret == 0 {
-			fmt.Printf("ok\n")
-		} else {
-			fmt.Printf("not-ok\n")
-		}
+		ret = secsipidxCLICheckStatus(secsipidxCLICheck())
 		os.Exit(ret)
 	} else if cliops.signfull {
 		if cliops.verbosity > 0 {
@@ -554,7 +1504,8 @@ func main() {
 		os.Exit(ret)
 	} else {
 		fmt.Printf("%s v%s\n", filepath.Base(os.Args[0]), secsipidxVersion)
-		fmt.Printf("run '%s --help' to see the options\n", filepath.Base(os.Args[0]))
+		fmt.Printf("run '%s help' or '%s --help' to see the commands and the options\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
 	}
 	os.Exit(ret)
 }
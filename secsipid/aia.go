@@ -0,0 +1,146 @@
+package secsipid
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aiaCacheItem - issuer certificates downloaded from an AIA caIssuers URL
+type aiaCacheItem struct {
+	certs   []*x509.Certificate
+	expires time.Time
+}
+
+// aiaCache keeps the parsed issuer certificates per caIssuers URL, to avoid
+// downloading and parsing them again for every verification
+var aiaCache = struct {
+	sync.Mutex
+	items map[string]aiaCacheItem
+}{items: make(map[string]aiaCacheItem)}
+
+// SJWTResetAIACache - drop the parsed AIA issuer certificates
+func SJWTResetAIACache() {
+	aiaCache.Lock()
+	aiaCache.items = make(map[string]aiaCacheItem)
+	aiaCache.Unlock()
+}
+
+// sjwtIsSelfSigned - true if the certificate is issued by itself
+func sjwtIsSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	return cert.CheckSignatureFrom(cert) == nil
+}
+
+// sjwtFindIssuer - return the certificate from the list that signed cert
+func sjwtFindIssuer(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, c := range certs {
+		if !bytes.Equal(cert.RawIssuer, c.RawSubject) {
+			continue
+		}
+		if cert.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// sjwtParseAIACertificates - parse the content served at a caIssuers URL,
+// which is usually a DER certificate or a PKCS#7 certs-only bundle, but PEM
+// is accepted as well
+func sjwtParseAIACertificates(data []byte) ([]*x509.Certificate, error) {
+	certs, _, err := SJWTParseCertificates(data)
+	return certs, err
+}
+
+// sjwtGetAIAIssuers - get the certificates from caIssuers URL, using the
+// parsed certificates cache and then the URL content cache
+func sjwtGetAIAIssuers(urlVal string) ([]*x509.Certificate, int, error) {
+	aiaCache.Lock()
+	item, ok := aiaCache.items[urlVal]
+	aiaCache.Unlock()
+	if ok && time.Now().Before(item.expires) {
+		return item.certs, SJWTRetOK, nil
+	}
+
+	data, expires, ret, err := sjwtFetchCertificate(urlVal, globalLibOptions.certAIATimeout)
+	if data == nil {
+		if err == nil {
+			err = errors.New("no content")
+		}
+		return nil, ret, err
+	}
+	certs, err := sjwtParseAIACertificates(data)
+	if err != nil || len(certs) == 0 {
+		return nil, SJWTRetErrCertInvalidFormat, fmt.Errorf("failed to parse issuer certificate: %v", err)
+	}
+
+	for _, c := range certs {
+		if c.NotAfter.Before(expires) {
+			expires = c.NotAfter
+		}
+	}
+	aiaCache.Lock()
+	aiaCache.items[urlVal] = aiaCacheItem{certs: certs, expires: expires}
+	aiaCache.Unlock()
+
+	return certs, SJWTRetOK, nil
+}
+
+// SJWTCompleteChainAIA - follow the AIA caIssuers URLs starting from the
+// certificate to download the missing intermediate certificates
+// * certVal - the certificate to build the chain for
+// * certInter - intermediate certificates that are already available
+// * return: the downloaded intermediate certificates
+func SJWTCompleteChainAIA(certVal *x509.Certificate, certInter []*x509.Certificate) ([]*x509.Certificate, int, error) {
+	var fetched []*x509.Certificate
+
+	known := append([]*x509.Certificate{}, certInter...)
+	cert := certVal
+	for depth := 0; depth < globalLibOptions.certAIADepth; depth++ {
+		if sjwtIsSelfSigned(cert) {
+			break
+		}
+		if issuer := sjwtFindIssuer(cert, known); issuer != nil {
+			cert = issuer
+			continue
+		}
+
+		var issuer *x509.Certificate
+		ret := SJWTRetOK
+		var err error
+		for _, urlVal := range cert.IssuingCertificateURL {
+			if !(strings.HasPrefix(urlVal, "http://") || strings.HasPrefix(urlVal, "https://")) {
+				continue
+			}
+			var certs []*x509.Certificate
+			certs, ret, err = sjwtGetAIAIssuers(urlVal)
+			if err != nil {
+				continue
+			}
+			if issuer = sjwtFindIssuer(cert, certs); issuer != nil {
+				break
+			}
+			ret = SJWTRetErrCertAIAFetch
+			err = fmt.Errorf("no issuer certificate at %s", urlVal)
+		}
+		if issuer == nil {
+			if err == nil {
+				// no usable caIssuers URL, nothing more can be done
+				break
+			}
+			return fetched, SJWTRetErrCertAIAFetch, fmt.Errorf("failed to get issuer via AIA: (%d) %v", ret, err)
+		}
+		fetched = append(fetched, issuer)
+		known = append(known, issuer)
+		cert = issuer
+	}
+
+	return fetched, SJWTRetOK, nil
+}
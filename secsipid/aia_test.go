@@ -0,0 +1,136 @@
+package secsipid_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+type aiaTestChain struct {
+	rootPEM  []byte
+	interDER []byte
+	leafPEM  []byte
+}
+
+func newAIATestChain(aiaURL string) aiaTestChain {
+	root := newTestCA("AIA Test Root", nil)
+	inter := newTestCA("AIA Test Intermediate", root)
+	leaf := newTestCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "AIA Test Leaf"},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		IssuingCertificateURL: []string{aiaURL},
+	}, inter)
+
+	return aiaTestChain{
+		rootPEM:  root.certPEM(),
+		interDER: inter.der,
+		leafPEM:  leaf.certPEM(),
+	}
+}
+
+func TestPubKeyVerifyAIA(t *testing.T) {
+	var chain aiaTestChain
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/inter.der" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(chain.interDER)
+	}))
+	defer server.Close()
+
+	chain = newAIATestChain(server.URL + "/inter.der")
+	os.WriteFile("dummyAIACA.pem", chain.rootPEM, 0640)
+	defer os.Remove("dummyAIACA.pem")
+	secsipid.SJWTLibOptSetS("CertCAFile", "dummyAIACA.pem")
+	secsipid.SetURLFileCacheOptions("", 3600)
+
+	t.Run("ErrCertInvalid without AIA chain completion", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetAIACache()
+		secsipid.SJWTLibOptSetN("CertVerify", 0b000100)
+
+		errCode, err := secsipid.SJWTPubKeyVerify(chain.leafPEM)
+
+		expect(errCode).ToBe(secsipid.SJWTRetErrCertInvalid)
+		expect(err).NotToBe(nil)
+		expect(requests).ToBe(0)
+	})
+
+	t.Run("OK with AIA chain completion", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetAIACache()
+		secsipid.SJWTLibOptSetN("CertVerify", 0b100100)
+		requests = 0
+
+		errCode, err := secsipid.SJWTPubKeyVerify(chain.leafPEM)
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(getMsgFromErr(err)).ToBe("")
+
+		// the issuer is taken from the parsed certificates cache
+		errCode, _ = secsipid.SJWTPubKeyVerify(chain.leafPEM)
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(requests).ToBe(1)
+	})
+
+	t.Run("OK with AIA chain completion from the certificate fetcher", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetAIACache()
+		secsipid.SJWTLibOptSetN("CertVerify", 0b100100)
+		workDir, _ := os.MkdirTemp("", "secsipid-aia")
+		defer os.RemoveAll(workDir)
+
+		aiaURL := "https://certs.example.invalid/inter.der"
+		fetcherChain := newAIATestChain(aiaURL)
+		caFile := path.Join(workDir, "ca.pem")
+		os.WriteFile(caFile, fetcherChain.rootPEM, 0640)
+		secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+		defer secsipid.SJWTLibOptSetS("CertCAFile", "dummyAIACA.pem")
+		secsipid.SJWTSetCertificateFetcher(secsipid.NewSJWTStaticFetcher(map[string][]byte{
+			aiaURL: fetcherChain.interDER,
+		}))
+		defer secsipid.SJWTSetCertificateFetcher(nil)
+
+		errCode, err := secsipid.SJWTPubKeyVerify(fetcherChain.leafPEM)
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(getMsgFromErr(err)).ToBe("")
+	})
+
+	t.Run("ErrCertAIAFetch when caIssuers URL is not available", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetAIACache()
+		secsipid.SJWTLibOptSetN("CertVerify", 0b100100)
+
+		badChain := newAIATestChain(server.URL + "/missing.der")
+		os.WriteFile("dummyAIACA.pem", badChain.rootPEM, 0640)
+
+		errCode, err := secsipid.SJWTPubKeyVerify(badChain.leafPEM)
+		expect(errCode).ToBe(secsipid.SJWTRetErrCertAIAFetch)
+		expect(getMsgFromErr(err)).ToBe("failed to get issuer via AIA: (-403) http status error: 404")
+	})
+
+	t.Run("ErrCertInvalid when AIA depth is 0", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetAIACache()
+		secsipid.SJWTLibOptSetN("CertVerify", 0b100100)
+		secsipid.SJWTLibOptSetN("CertAIADepth", 0)
+		defer secsipid.SJWTLibOptSetN("CertAIADepth", 4)
+		os.WriteFile("dummyAIACA.pem", chain.rootPEM, 0640)
+
+		errCode, _ := secsipid.SJWTPubKeyVerify(chain.leafPEM)
+		expect(errCode).ToBe(secsipid.SJWTRetErrCertInvalid)
+	})
+
+	secsipid.SJWTLibOptSetN("CertVerify", 0)
+	secsipid.SJWTLibOptSetS("CertCAFile", "")
+}
@@ -0,0 +1,179 @@
+package secsipid
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// oidTNAuthList - the TN Authorization List certificate extension (RFC 8226)
+var oidTNAuthList = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 26}
+
+// SJWTCacheEntry - details of a certificate stored in the cache directory
+type SJWTCacheEntry struct {
+	URL      string    `json:"url,omitempty"`
+	FilePath string    `json:"filePath"`
+	Size     int64     `json:"size"`
+	Fetched  time.Time `json:"fetched"`
+	Expires  time.Time `json:"expires"`
+	Expired  bool      `json:"expired"`
+	Legacy   bool      `json:"legacy,omitempty"`
+	ETag     string    `json:"etag,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Issuer   string    `json:"issuer,omitempty"`
+	SPC      string    `json:"spc,omitempty"`
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// SJWTCertTNAuthListSPC - return the Service Provider Code from the TN
+// Authorization List extension of the certificate, empty if not found
+func SJWTCertTNAuthListSPC(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTNAuthList) {
+			continue
+		}
+		var entries []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &entries); err != nil {
+			return ""
+		}
+		for _, entry := range entries {
+			// TNEntry ::= CHOICE { spc [0] ServiceProviderCode, ... }
+			if entry.Class != asn1.ClassContextSpecific || entry.Tag != 0 {
+				continue
+			}
+			var spc string
+			if _, err := asn1.UnmarshalWithParams(entry.Bytes, &spc, "ia5"); err == nil {
+				return spc
+			}
+		}
+	}
+	return ""
+}
+
+// sjwtCacheEntryInfo - build the details of the cache file
+func sjwtCacheEntryInfo(filePath string, fileInfo os.FileInfo, tnow time.Time) SJWTCacheEntry {
+	entry := SJWTCacheEntry{
+		FilePath: filePath,
+		Size:     fileInfo.Size(),
+		Fetched:  fileInfo.ModTime(),
+		Expires:  fileInfo.ModTime().Add(time.Duration(globalLibOptions.cacheExpire) * time.Second),
+		Legacy:   len(fileInfo.Name()) != 64,
+	}
+	if meta := sjwtReadURLCacheMeta(filePath); meta != nil {
+		entry.URL = meta.URL
+		entry.ETag = meta.ETag
+		entry.Fetched = meta.Fetched
+		entry.Expires = meta.Expires
+	}
+	entry.Expired = !tnow.Before(entry.Expires)
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		entry.Error = "no PEM certificate"
+		return entry
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Subject = cert.Subject.String()
+	entry.Issuer = cert.Issuer.String()
+	entry.SPC = SJWTCertTNAuthListSPC(cert)
+	entry.NotAfter = cert.NotAfter
+	return entry
+}
+
+// SJWTListURLCache - return the details of the certificates stored in the
+// cache directory, sorted by URL (and file path for the files without URL)
+func SJWTListURLCache(dirPath string) ([]SJWTCacheEntry, error) {
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	tnow := time.Now()
+	entries := make([]SJWTCacheEntry, 0, len(files))
+	for _, fileInfo := range files {
+		if !fileInfo.Mode().IsRegular() || !sjwtIsCacheFileName(fileInfo.Name()) ||
+			strings.HasSuffix(fileInfo.Name(), ".meta") || strings.HasSuffix(fileInfo.Name(), ".lock") {
+			continue
+		}
+		entries = append(entries, sjwtCacheEntryInfo(filepath.Join(dirPath, fileInfo.Name()), fileInfo, tnow))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL != entries[j].URL {
+			return entries[i].URL < entries[j].URL
+		}
+		return entries[i].FilePath < entries[j].FilePath
+	})
+	return entries, nil
+}
+
+// SJWTGetURLCacheEntry - return the details of the certificate stored in the
+// cache directory for the URL
+func SJWTGetURLCacheEntry(dirPath string, urlVal string) (*SJWTCacheEntry, error) {
+	var lastErr error
+	for _, filePath := range []string{sjwtURLCacheFilePath(dirPath, urlVal), sjwtLegacyURLCacheFilePath(dirPath, urlVal)} {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entry := sjwtCacheEntryInfo(filePath, fileInfo, time.Now())
+		entry.URL = urlVal
+		return &entry, nil
+	}
+	return nil, lastErr
+}
+
+// SJWTPurgeURLCache - remove from the cache directory the files for the URL,
+// or all the cache files if the URL is empty; return the number of removed
+// entries
+func SJWTPurgeURLCache(dirPath string, urlVal string) (int, error) {
+	if len(urlVal) > 0 {
+		removed := 0
+		for _, filePath := range []string{sjwtURLCacheFilePath(dirPath, urlVal), sjwtLegacyURLCacheFilePath(dirPath, urlVal)} {
+			os.Remove(filePath + ".meta")
+			if err := os.Remove(filePath); err == nil {
+				removed++
+			} else if !os.IsNotExist(err) {
+				return removed, err
+			}
+		}
+		return removed, nil
+	}
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		if !fileInfo.Mode().IsRegular() || strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		if strings.HasSuffix(name, ".meta") {
+			if sjwtIsCacheFileName(strings.TrimSuffix(name, ".meta")) {
+				os.Remove(filepath.Join(dirPath, name))
+			}
+			continue
+		}
+		if sjwtIsCacheFileName(name) && os.Remove(filepath.Join(dirPath, name)) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,80 @@
+package secsipid_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// newTNAuthListTestCert - self-signed certificate with the SPC in the TN
+// Authorization List extension
+func newTNAuthListTestCert(spc string) []byte {
+	spcVal, _ := asn1.MarshalWithParams(spc, "ia5")
+	tnAuthList, _ := asn1.Marshal([]asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: spcVal},
+	})
+	return newTestCert(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "SHAKEN " + spc},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 26}, Value: tnAuthList},
+		},
+	}, nil).certPEM()
+}
+
+func TestURLCacheEntries(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-cacheinfo")
+	defer os.RemoveAll(workDir)
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+
+	secsipid.SJWTSetURLCachedContent("https://certs.example.com/a.pem", newTNAuthListTestCert("119F"))
+	secsipid.SJWTSetURLCachedContent("https://certs.example.com/b.pem", []byte("not a certificate"))
+	os.WriteFile(filepath.Join(workDir, "https_certs.example.com_c.pem"), newTNAuthListTestCert("1234"), 0640)
+	os.WriteFile(filepath.Join(workDir, "notes.txt"), []byte("not a cache file"), 0640)
+
+	t.Run("OK listing cached certificates", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		entries, err := secsipid.SJWTListURLCache(workDir)
+		expect(err).ToBe(nil)
+		expect(len(entries)).ToBe(3)
+
+		expect(entries[0].URL).ToBe("")
+		expect(entries[0].Legacy).ToBe(true)
+		expect(entries[0].SPC).ToBe("1234")
+		expect(entries[1].URL).ToBe("https://certs.example.com/a.pem")
+		expect(entries[1].Subject).ToBe("CN=SHAKEN 119F")
+		expect(entries[1].SPC).ToBe("119F")
+		expect(entries[1].Expired).ToBe(false)
+		expect(entries[2].URL).ToBe("https://certs.example.com/b.pem")
+		expect(entries[2].Error).ToBe("no PEM certificate")
+	})
+
+	t.Run("OK showing legacy cached certificate", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		entry, err := secsipid.SJWTGetURLCacheEntry(workDir, "https://certs.example.com/c.pem")
+		expect(err).ToBe(nil)
+		expect(entry.SPC).ToBe("1234")
+		expect(entry.Legacy).ToBe(true)
+	})
+
+	t.Run("OK purging one and then all cached certificates", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		removed, err := secsipid.SJWTPurgeURLCache(workDir, "https://certs.example.com/a.pem")
+		expect(err).ToBe(nil)
+		expect(removed).ToBe(1)
+		_, err = secsipid.SJWTGetURLCacheEntry(workDir, "https://certs.example.com/a.pem")
+		expect(os.IsNotExist(err)).ToBe(true)
+
+		removed, err = secsipid.SJWTPurgeURLCache(workDir, "")
+		expect(err).ToBe(nil)
+		expect(removed).ToBe(2)
+		files, _ := os.ReadDir(workDir)
+		expect(len(files)).ToBe(1)
+	})
+}
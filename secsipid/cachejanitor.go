@@ -0,0 +1,214 @@
+package secsipid
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTmpMaxAge - how long the temporary files of interrupted writes are
+// kept in the cache directory
+const cacheTmpMaxAge = time.Hour
+
+// SJWTCacheCleanResult - the outcome of cleaning the cache directory
+type SJWTCacheCleanResult struct {
+	Files        int   `json:"files"`
+	Size         int64 `json:"size"`
+	Removed      int   `json:"removed"`
+	RemovedBytes int64 `json:"removedBytes"`
+}
+
+// cacheDirEntry - a cached content file and its metadata file
+type cacheDirEntry struct {
+	path    string
+	size    int64
+	used    time.Time
+	expires time.Time
+	hasMeta bool
+	removed bool
+}
+
+// globalCacheJanitor - the background cleaning of the cache directory
+var globalCacheJanitor = struct {
+	sync.Mutex
+	stop chan struct{}
+}{}
+
+// sjwtIsCacheFileName - true for the names of the files stored in the cache
+// directory, hashed or named by older versions
+func sjwtIsCacheFileName(name string) bool {
+	if strings.HasPrefix(name, "http_") || strings.HasPrefix(name, "https_") {
+		return true
+	}
+	if len(name) != 64 {
+		return false
+	}
+	for _, c := range name {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// SJWTCleanURLCache - remove from the cache directory the expired entries,
+// the metadata files without content, the unused lock files without content
+// and the temporary files of interrupted writes; if maxSize is greater than 0,
+// the least recently fetched entries are removed until the size of the cache
+// is not greater than maxSize bytes; only the files named like the cache
+// entries are touched
+func SJWTCleanURLCache(dirPath string, maxSize int64) (SJWTCacheCleanResult, error) {
+	var result SJWTCacheCleanResult
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return result, err
+	}
+	tnow := time.Now()
+	remove := func(filePath string, size int64) {
+		if os.Remove(filePath) == nil {
+			result.Removed++
+			result.RemovedBytes += size
+		}
+	}
+
+	entries := make(map[string]*cacheDirEntry)
+	metas := make(map[string]os.FileInfo)
+	locks := make(map[string]os.FileInfo)
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		if !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp"):
+			baseName := strings.SplitN(name[1:], ".tmp", 2)[0]
+			baseName = strings.TrimSuffix(baseName, ".meta")
+			if sjwtIsCacheFileName(baseName) && tnow.Sub(fileInfo.ModTime()) > cacheTmpMaxAge {
+				remove(filepath.Join(dirPath, name), fileInfo.Size())
+			}
+		case strings.HasSuffix(name, ".meta"):
+			if sjwtIsCacheFileName(strings.TrimSuffix(name, ".meta")) {
+				metas[strings.TrimSuffix(name, ".meta")] = fileInfo
+			}
+		case strings.HasSuffix(name, ".lock"):
+			if sjwtIsCacheFileName(strings.TrimSuffix(name, ".lock")) {
+				locks[strings.TrimSuffix(name, ".lock")] = fileInfo
+			}
+		case sjwtIsCacheFileName(name):
+			entries[name] = &cacheDirEntry{
+				path:    filepath.Join(dirPath, name),
+				size:    fileInfo.Size(),
+				used:    fileInfo.ModTime(),
+				expires: fileInfo.ModTime().Add(time.Duration(globalLibOptions.cacheExpire) * time.Second),
+			}
+		}
+	}
+
+	for name, metaInfo := range metas {
+		entry, ok := entries[name]
+		if !ok {
+			// the content is written before the metadata, so skip the fresh ones
+			if tnow.Sub(metaInfo.ModTime()) > cacheTmpMaxAge {
+				remove(filepath.Join(dirPath, name+".meta"), metaInfo.Size())
+			}
+			continue
+		}
+		entry.hasMeta = true
+		entry.size += metaInfo.Size()
+		if meta := sjwtReadURLCacheMeta(entry.path); meta != nil {
+			entry.expires = meta.Expires
+			if !meta.Fetched.IsZero() {
+				entry.used = meta.Fetched
+			}
+		}
+	}
+
+	removeEntry := func(entry *cacheDirEntry) {
+		if os.Remove(entry.path) != nil {
+			return
+		}
+		if entry.hasMeta {
+			os.Remove(entry.path + ".meta")
+		}
+		entry.removed = true
+		result.Removed++
+		result.RemovedBytes += entry.size
+	}
+
+	live := make([]*cacheDirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !tnow.Before(entry.expires) {
+			removeEntry(entry)
+			continue
+		}
+		live = append(live, entry)
+		result.Files++
+		result.Size += entry.size
+	}
+
+	if maxSize > 0 && result.Size > maxSize {
+		sort.Slice(live, func(i, j int) bool {
+			return live[i].used.Before(live[j].used)
+		})
+		for _, entry := range live {
+			if result.Size <= maxSize {
+				break
+			}
+			removeEntry(entry)
+			result.Files--
+			result.Size -= entry.size
+		}
+	}
+
+	// the locks may be held by other processes while downloading, so only
+	// the ones that can be taken without waiting are removed; a downloader
+	// waiting on a removed lock file locks again the new one
+	for name, lockInfo := range locks {
+		if entry, ok := entries[name]; ok && !entry.removed {
+			continue
+		}
+		lockPath := filepath.Join(dirPath, name+".lock")
+		unlock, err := sjwtTryLockFile(lockPath)
+		if err != nil {
+			continue
+		}
+		remove(lockPath, lockInfo.Size())
+		unlock()
+	}
+
+	return result, nil
+}
+
+// sjwtSetCacheCleanInterval - start, restart or stop (if interval is 0) the
+// periodic cleaning of the cache directory
+func sjwtSetCacheCleanInterval(interval int) {
+	globalCacheJanitor.Lock()
+	defer globalCacheJanitor.Unlock()
+	if globalCacheJanitor.stop != nil {
+		close(globalCacheJanitor.stop)
+		globalCacheJanitor.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	globalCacheJanitor.stop = stop
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if len(globalLibOptions.cacheDirPath) > 0 {
+					SJWTCleanURLCache(globalLibOptions.cacheDirPath, int64(globalLibOptions.cacheMaxSize))
+				}
+			}
+		}
+	}()
+}
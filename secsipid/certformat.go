@@ -0,0 +1,233 @@
+package secsipid
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"mime"
+	"strings"
+)
+
+// oidPKCS7SignedData - the content type of PKCS#7 signed data (RFC 2315)
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// pkcs7ContentInfo - the outer structure of a PKCS#7 (CMS) message
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// pkcs7SignedData - the signed data of a PKCS#7 message, for certs-only
+// bundles only the certificates are used
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// sjwtParsePKCS7Certificates - parse the certificates of a PKCS#7 bundle
+// in DER format
+func sjwtParsePKCS7Certificates(der []byte) ([]*x509.Certificate, error) {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, err
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, errors.New("PKCS#7 content is not signed data")
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	if len(signedData.Certificates.Bytes) == 0 {
+		return nil, errors.New("no certificates in PKCS#7 bundle")
+	}
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return sjwtOrderCertChain(certs), nil
+}
+
+// sjwtIsIssuerOf - true if the certificate is the issuer of the other one
+func sjwtIsIssuerOf(issuer *x509.Certificate, cert *x509.Certificate) bool {
+	return issuer != cert && bytes.Equal(cert.RawIssuer, issuer.RawSubject)
+}
+
+// sjwtOrderCertChain - order the certificates of a PKCS#7 bundle, which are
+// a set without defined order, as a chain: the leaf (the certificate that
+// is not the issuer of any other) first, followed by its issuers and then
+// by the remaining certificates
+func sjwtOrderCertChain(certs []*x509.Certificate) []*x509.Certificate {
+	if len(certs) < 2 {
+		return certs
+	}
+	leaf := -1
+	for i, cert := range certs {
+		isIssuer := false
+		for _, other := range certs {
+			if sjwtIsIssuerOf(cert, other) {
+				isIssuer = true
+				break
+			}
+		}
+		if !isIssuer {
+			leaf = i
+			break
+		}
+	}
+	if leaf < 0 {
+		return certs
+	}
+	used := make([]bool, len(certs))
+	ordered := make([]*x509.Certificate, 0, len(certs))
+	for i := leaf; i >= 0; {
+		used[i] = true
+		ordered = append(ordered, certs[i])
+		next := -1
+		for j, cert := range certs {
+			if !used[j] && sjwtIsIssuerOf(cert, certs[i]) {
+				next = j
+				break
+			}
+		}
+		i = next
+	}
+	for i, cert := range certs {
+		if !used[i] {
+			ordered = append(ordered, cert)
+		}
+	}
+	return ordered
+}
+
+// sjwtIsPEM - true if the data has PEM blocks
+func sjwtIsPEM(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN "))
+}
+
+// sjwtIsPEMPKCS7 - true if the data has PEM blocks with PKCS#7 bundles
+func sjwtIsPEMPKCS7(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN PKCS7-----")) || bytes.Contains(data, []byte("-----BEGIN CMS-----"))
+}
+
+// sjwtEncodeCertificatesPEM - encode the certificates as PEM blocks
+func sjwtEncodeCertificatesPEM(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// sjwtIsPKCS7ContentType - true for the media types of PKCS#7 bundles
+func sjwtIsPKCS7ContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(mediaType) {
+	case "application/pkcs7-mime", "application/x-pkcs7-mime", "application/x-pkcs7-certificates":
+		return true
+	}
+	return false
+}
+
+// sjwtParseDERCertificates - parse DER certificates or a PKCS#7 bundle,
+// trying first the format indicated by the content type
+func sjwtParseDERCertificates(der []byte, contentType string) ([]*x509.Certificate, error) {
+	if len(der) < 2 || der[0] != 0x30 {
+		return nil, errors.New("not DER encoded")
+	}
+	if sjwtIsPKCS7ContentType(contentType) {
+		if certs, err := sjwtParsePKCS7Certificates(der); err == nil {
+			return certs, nil
+		}
+		return x509.ParseCertificates(der)
+	}
+	certs, err := x509.ParseCertificates(der)
+	if err == nil {
+		return certs, nil
+	}
+	if certs, perr := sjwtParsePKCS7Certificates(der); perr == nil {
+		return certs, nil
+	}
+	return nil, err
+}
+
+// sjwtParseCertificates - parse the certificate chain served at a x5u URL
+// (leaf first), detecting the format by content type and magic bytes
+func sjwtParseCertificates(data []byte, contentType string) ([]*x509.Certificate, int, error) {
+	if !sjwtIsPEM(data) {
+		certs, err := sjwtParseDERCertificates(data, contentType)
+		if err != nil || len(certs) == 0 {
+			return nil, SJWTRetErrCertInvalidFormat, errors.New("failed to parse certificate PEM")
+		}
+		return certs, SJWTRetOK, nil
+	}
+
+	var certs []*x509.Certificate
+	var block *pem.Block
+	toDecode := data
+	for {
+		block, toDecode = pem.Decode(toDecode)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PKCS7", "CMS":
+			blockCerts, err := sjwtParsePKCS7Certificates(block.Bytes)
+			if err != nil {
+				return nil, SJWTRetErrCertInvalidFormat, err
+			}
+			certs = append(certs, blockCerts...)
+		default:
+			blockCert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, SJWTRetErrCertInvalidFormat, err
+			}
+			certs = append(certs, blockCert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, SJWTRetErrCertInvalidFormat, errors.New("failed to parse certificate PEM")
+	}
+	return certs, SJWTRetOK, nil
+}
+
+// SJWTParseCertificates - parse the certificate chain (leaf first) given as
+// PEM certificates, PEM or DER PKCS#7 certs-only bundle or DER certificates
+func SJWTParseCertificates(data []byte) ([]*x509.Certificate, int, error) {
+	return sjwtParseCertificates(data, "")
+}
+
+// sjwtParseLeafCertificate - return the first certificate of the content,
+// nil if it cannot be parsed
+func sjwtParseLeafCertificate(data []byte) *x509.Certificate {
+	certs, _, _ := sjwtParseCertificates(data, "")
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// sjwtNormalizeCertContent - convert the downloaded DER certificates or
+// PKCS#7 bundle (DER or PEM) to PEM certificates, so the cached content has
+// the same format; other content is returned unchanged
+func sjwtNormalizeCertContent(data []byte, contentType string) []byte {
+	var certs []*x509.Certificate
+	if sjwtIsPEM(data) {
+		if !sjwtIsPEMPKCS7(data) {
+			return data
+		}
+		certs, _, _ = sjwtParseCertificates(data, contentType)
+	} else {
+		certs, _ = sjwtParseDERCertificates(data, contentType)
+	}
+	if len(certs) == 0 {
+		return data
+	}
+	return sjwtEncodeCertificatesPEM(certs)
+}
@@ -0,0 +1,151 @@
+package secsipid_test
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// newPKCS7TestBundle - PKCS#7 certs-only bundle in DER format with the
+// given DER certificates
+func newPKCS7TestBundle(certsDER ...[]byte) []byte {
+	emptySet := asn1.RawValue{Tag: asn1.TagSet, IsCompound: true}
+	dataContentInfo, _ := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+	}{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	signedData, _ := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      asn1.RawValue{FullBytes: dataContentInfo},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+			Bytes: bytes.Join(certsDER, nil)},
+		SignerInfos: emptySet,
+	})
+	bundle, _ := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	return bundle
+}
+
+func TestParseCertificates(t *testing.T) {
+	caPEM, certPEM, _ := newTestCertChain("Key Cache Test")
+	caBlock, _ := pem.Decode(caPEM)
+	certBlock, _ := pem.Decode(certPEM)
+	pkcs7DER := newPKCS7TestBundle(certBlock.Bytes, caBlock.Bytes)
+	pkcs7CAFirstDER := newPKCS7TestBundle(caBlock.Bytes, certBlock.Bytes)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected int
+	}{
+		{"OK with PEM chain", append(append([]byte{}, certPEM...), caPEM...), 2},
+		{"OK with DER certificate", certBlock.Bytes, 1},
+		{"OK with DER PKCS#7 bundle", pkcs7DER, 2},
+		{"OK with PEM PKCS#7 bundle", pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: pkcs7DER}), 2},
+		{"OK with DER PKCS#7 bundle with CA first", pkcs7CAFirstDER, 2},
+		{"OK with PEM PKCS#7 bundle with CA first", pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: pkcs7CAFirstDER}), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect := expectate.Expect(t)
+			certs, ret, err := secsipid.SJWTParseCertificates(tt.data)
+			expect(err).ToBe(nil)
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+			expect(len(certs)).ToBe(tt.expected)
+			expect(certs[0].Subject.CommonName).ToBe("Key Cache Test")
+			if tt.expected > 1 {
+				expect(certs[1].Subject.CommonName).ToBe("Key Cache Test CA")
+			}
+		})
+	}
+
+	t.Run("ErrCertInvalidFormat with invalid content", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		certs, ret, err := secsipid.SJWTParseCertificates([]byte{0x30, 0x03, 0x02, 0x01, 0x01})
+		expect(len(certs)).ToBe(0)
+		expect(ret).ToBe(secsipid.SJWTRetErrCertInvalidFormat)
+		expect(getMsgFromErr(err)).ToBe("failed to parse certificate PEM")
+	})
+
+	t.Run("OK parsing EC public key from DER certificate", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		key, ret, err := secsipid.SJWTParseECPublicKeyFromPEM(certBlock.Bytes)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(key == nil).ToBe(false)
+	})
+}
+
+func TestDERAndPKCS7CertificateURL(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-certformat")
+	defer os.RemoveAll(workDir)
+
+	caPEM, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	caBlock, _ := pem.Decode(caPEM)
+	certBlock, _ := pem.Decode(certPEM)
+	caFile := workDir + "/ca.pem"
+	os.WriteFile(caFile, caPEM, 0640)
+
+	leafFirst := newPKCS7TestBundle(certBlock.Bytes, caBlock.Bytes)
+	caFirst := newPKCS7TestBundle(caBlock.Bytes, certBlock.Bytes)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.der":
+			w.Header().Set("Content-Type", "application/pkix-cert")
+			w.Write(certBlock.Bytes)
+		case "/chain.p7c":
+			w.Header().Set("Content-Type", "application/pkcs7-mime")
+			w.Write(leafFirst)
+		case "/chain-ca-first.p7c":
+			w.Header().Set("Content-Type", "application/pkcs7-mime")
+			w.Write(caFirst)
+		case "/chain.p7b":
+			w.Write(pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: leafFirst}))
+		case "/chain-ca-first.p7b":
+			w.Write(pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: caFirst}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+	secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+	defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+	secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+	defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	for _, x5u := range []string{server.URL + "/cert.der", server.URL + "/chain.p7c", server.URL + "/chain-ca-first.p7c",
+		server.URL + "/chain.p7b", server.URL + "/chain-ca-first.p7b"} {
+		t.Run("OK verifying with certificate at "+x5u[len(server.URL):], func(t *testing.T) {
+			expect := expectate.Expect(t)
+			secsipid.SJWTResetKeyCache()
+			identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", x5u, keyPEM)
+			ret, err := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+			expect(getMsgFromErr(err)).ToBe("")
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+
+			cached, _ := os.ReadFile(secsipid.SJWTGetURLCacheFilePath(x5u))
+			expect(bytes.HasPrefix(cached, []byte("-----BEGIN CERTIFICATE-----"))).ToBe(true)
+		})
+	}
+}
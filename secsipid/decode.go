@@ -0,0 +1,143 @@
+package secsipid
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SJWTDecodedCert - details of the certificate downloaded from the x5u URL of
+// a decoded identity
+type SJWTDecodedCert struct {
+	URL         string    `json:"url"`
+	Subject     string    `json:"subject,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	SPC         string    `json:"spc,omitempty"`
+	NotBefore   time.Time `json:"notBefore,omitempty"`
+	NotAfter    time.Time `json:"notAfter,omitempty"`
+	ChainCerts  int       `json:"chainCerts"`
+	ChainStatus string    `json:"chainStatus"`
+	Ret         int       `json:"ret"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// SJWTDecodedIdentity - the content of an identity header, decoded without
+// verifying the signature
+type SJWTDecodedIdentity struct {
+	Info            string            `json:"info,omitempty"`
+	Alg             string            `json:"alg,omitempty"`
+	Ppt             string            `json:"ppt,omitempty"`
+	Params          map[string]string `json:"params,omitempty"`
+	Header          json.RawMessage   `json:"header"`
+	Payload         json.RawMessage   `json:"payload"`
+	X5u             string            `json:"x5u,omitempty"`
+	IAT             int64             `json:"iat"`
+	IATDate         string            `json:"iatDate,omitempty"`
+	Age             int64             `json:"age"`
+	SignatureLength int               `json:"signatureLength"`
+	Cert            *SJWTDecodedCert  `json:"cert,omitempty"`
+}
+
+// sjwtDecodeJSONPart - decode the base64 part of the token and check that it
+// is a JSON object
+func sjwtDecodeJSONPart(part string, name string) (json.RawMessage, error) {
+	val, err := SJWTBase64DecodeString(part)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	var obj map[string]interface{}
+	if err = json.Unmarshal([]byte(val), &obj); err != nil {
+		return nil, fmt.Errorf("invalid %s JSON: %v", name, err)
+	}
+	return json.RawMessage(val), nil
+}
+
+// SJWTDecodeIdentity - decode the identity header (with or without
+// parameters) without checking the signature, returning the parameters, the
+// JWT header and payload, the age of the token and the signature length; if
+// fetchCert is set, the certificate from x5u is downloaded and verified
+func SJWTDecodeIdentity(identityVal string, fetchCert bool, timeoutVal int) (*SJWTDecodedIdentity, int, error) {
+	hdr, ret, err := SJWTParseIdentityHeader(identityVal)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	decoded := &SJWTDecodedIdentity{
+		Info: hdr.Info,
+		Alg:  hdr.Alg,
+		Ppt:  hdr.Ppt,
+	}
+	if len(hdr.Params) > 0 {
+		decoded.Params = hdr.Params
+	}
+
+	token := strings.Split(hdr.Token, ".")
+	if len(token) != 3 {
+		return nil, SJWTRetErrSIPHdrParse, fmt.Errorf("invalid token - expected 3 parts, got %d", len(token))
+	}
+	if decoded.Header, err = sjwtDecodeJSONPart(token[0], "header"); err != nil {
+		return nil, SJWTRetErrJSONHdrParse, err
+	}
+	if decoded.Payload, err = sjwtDecodeJSONPart(token[1], "payload"); err != nil {
+		return nil, SJWTRetErrJSONPayloadParse, err
+	}
+	signature, err := SJWTBase64DecodeString(token[2])
+	if err != nil {
+		return nil, SJWTRetErrJSONSignatureInvalid, fmt.Errorf("invalid signature: %v", err)
+	}
+	decoded.SignatureLength = len(signature)
+
+	var header SJWTHeader
+	json.Unmarshal(decoded.Header, &header)
+	decoded.X5u = header.X5u
+	if len(decoded.X5u) == 0 {
+		decoded.X5u = hdr.Info
+	}
+	var payload SJWTPayload
+	json.Unmarshal(decoded.Payload, &payload)
+	decoded.IAT = payload.IAT
+	if payload.IAT > 0 {
+		iat := time.Unix(payload.IAT, 0)
+		decoded.IATDate = iat.UTC().Format(time.RFC3339)
+		decoded.Age = int64(time.Since(iat) / time.Second)
+	}
+
+	if fetchCert && len(decoded.X5u) > 0 {
+		decoded.Cert = sjwtDecodeCert(decoded.X5u, timeoutVal)
+	}
+	return decoded, SJWTRetOK, nil
+}
+
+// sjwtDecodeCert - download the certificate from the URL and return its
+// details and the outcome of verifying it
+func sjwtDecodeCert(urlVal string, timeoutVal int) *SJWTDecodedCert {
+	cert := &SJWTDecodedCert{URL: urlVal}
+	data, ret, err := SJWTGetURLContent(urlVal, timeoutVal)
+	if ret != SJWTRetOK {
+		cert.ChainStatus = "unavailable"
+		cert.Ret, cert.Error = ret, err.Error()
+		return cert
+	}
+	certs, ret, err := SJWTParseCertificates(data)
+	if ret != SJWTRetOK {
+		cert.ChainStatus = "invalid"
+		cert.Ret, cert.Error = ret, err.Error()
+		return cert
+	}
+	cert.Subject = certs[0].Subject.String()
+	cert.Issuer = certs[0].Issuer.String()
+	cert.SPC = SJWTCertTNAuthListSPC(certs[0])
+	cert.NotBefore = certs[0].NotBefore.UTC()
+	cert.NotAfter = certs[0].NotAfter.UTC()
+	cert.ChainCerts = len(certs)
+
+	if ret, err = SJWTPubKeyVerify(data); ret != SJWTRetOK {
+		cert.ChainStatus = "invalid"
+		cert.Ret, cert.Error = ret, err.Error()
+	} else if globalLibOptions.certVerify == 0 {
+		cert.ChainStatus = "not-verified"
+	} else {
+		cert.ChainStatus = "valid"
+	}
+	return cert
+}
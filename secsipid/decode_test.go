@@ -0,0 +1,81 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestDecodeIdentity(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-decode")
+	defer os.RemoveAll(workDir)
+
+	caPEM, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	caFile := path.Join(workDir, "ca.pem")
+	os.WriteFile(caFile, caPEM, 0640)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(certPEM)
+	}))
+	defer server.Close()
+	x5u := server.URL + "/cert.pem"
+
+	identity, _, _ := secsipid.SJWTGetIdentityPrvKey("15551234567", "15557654321", "A", "", x5u, keyPEM)
+
+	t.Run("OK without fetching the certificate", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		decoded, ret, err := secsipid.SJWTDecodeIdentity(identity+";foo=bar", false, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(decoded.Info).ToBe(x5u)
+		expect(decoded.Alg).ToBe("ES256")
+		expect(decoded.Ppt).ToBe("shaken")
+		expect(decoded.Params["foo"]).ToBe("bar")
+		expect(decoded.X5u).ToBe(x5u)
+		expect(decoded.SignatureLength).ToBe(64)
+		expect(decoded.Age < 5).ToBe(true)
+		expect(strings.Contains(string(decoded.Payload), `"orig":{"tn":"15551234567"}`)).ToBe(true)
+		expect(strings.Contains(string(decoded.Header), `"x5u":"`+x5u+`"`)).ToBe(true)
+		expect(decoded.Cert == nil).ToBe(true)
+	})
+
+	t.Run("OK with the verified certificate", func(t *testing.T) {
+		secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+		defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+		secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+		defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+		expect := expectate.Expect(t)
+		decoded, ret, _ := secsipid.SJWTDecodeIdentity(identity, true, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(decoded.Cert.Subject).ToBe("CN=Key Cache Test")
+		expect(decoded.Cert.Issuer).ToBe("CN=Key Cache Test CA")
+		expect(decoded.Cert.ChainCerts).ToBe(1)
+		expect(decoded.Cert.ChainStatus).ToBe("valid")
+	})
+
+	t.Run("invalid chain without CA file", func(t *testing.T) {
+		secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+		defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+		expect := expectate.Expect(t)
+		decoded, ret, _ := secsipid.SJWTDecodeIdentity(identity, true, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(decoded.Cert.ChainStatus).ToBe("invalid")
+		expect(decoded.Cert.Ret).ToBe(secsipid.SJWTRetErrCertNoCAFile)
+	})
+
+	t.Run("ErrJSONPayloadParse with invalid payload", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		token := strings.Split(strings.Split(identity, ";")[0], ".")
+		_, ret, err := secsipid.SJWTDecodeIdentity(token[0]+".bm90LWpzb24."+token[2], false, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrJSONPayloadParse)
+		expect(strings.HasPrefix(getMsgFromErr(err), "invalid payload JSON")).ToBe(true)
+	})
+}
@@ -0,0 +1,218 @@
+package secsipid
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SJWTCertificateFetcher - a source of the certificates referenced by x5u
+// URLs; Fetch returns the content, the time until it can be used and the
+// error code, which is SJWTRetErrFetchNotFound if the source does not have
+// the certificate
+type SJWTCertificateFetcher interface {
+	Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error)
+}
+
+// SJWTCertificateStorer - a source that can keep the certificates found by
+// the next sources in a fetcher chain (e.g., a cache)
+type SJWTCertificateStorer interface {
+	Store(urlVal string, data []byte, expires time.Time) error
+}
+
+var sjwtErrFetchNotFound = errors.New("certificate not found")
+
+// globalFetcher - the fetcher used by the verification functions, if nil
+// the default of URL file cache and then HTTP download is used
+var globalFetcher = struct {
+	sync.RWMutex
+	fetcher SJWTCertificateFetcher
+}{}
+
+// SJWTSetCertificateFetcher - set the fetcher used by the verification
+// functions to get the certificates from x5u URLs; nil restores the default;
+// the parsed public keys cache is reset
+func SJWTSetCertificateFetcher(fetcher SJWTCertificateFetcher) {
+	globalFetcher.Lock()
+	globalFetcher.fetcher = fetcher
+	globalFetcher.Unlock()
+	SJWTResetKeyCache()
+}
+
+// sjwtFetchCertificate - get the certificate content for the x5u URL using
+// the offline bundle, if enabled, or the configured fetcher
+func sjwtFetchCertificate(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	if bundle := sjwtOfflineBundle(); bundle != nil {
+		return sjwtOfflineFetch(bundle, urlVal)
+	}
+	globalFetcher.RLock()
+	fetcher := globalFetcher.fetcher
+	globalFetcher.RUnlock()
+	if fetcher == nil {
+		return sjwtGetURLContent(urlVal, timeoutVal)
+	}
+	return fetcher.Fetch(urlVal, timeoutVal)
+}
+
+// sjwtStaticExpires - expire time for content without HTTP metadata
+func sjwtStaticExpires(data []byte) time.Time {
+	expires := time.Now().Add(time.Duration(globalLibOptions.cacheExpire) * time.Second)
+	return sjwtCapExpiresNotAfter(data, expires)
+}
+
+// SJWTFetcherChain - fetchers tried in order until one has the certificate;
+// the content is stored in the previous fetchers that can store it
+type SJWTFetcherChain []SJWTCertificateFetcher
+
+// Fetch - get the certificate from the first fetcher that has it
+func (chain SJWTFetcherChain) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	ret, err := SJWTRetErrFetchNotFound, sjwtErrFetchNotFound
+	for i, fetcher := range chain {
+		var data []byte
+		var expires time.Time
+		data, expires, ret, err = fetcher.Fetch(urlVal, timeoutVal)
+		if ret != SJWTRetOK {
+			continue
+		}
+		for _, prev := range chain[:i] {
+			if storer, ok := prev.(SJWTCertificateStorer); ok {
+				storer.Store(urlVal, data, expires)
+			}
+		}
+		return data, expires, SJWTRetOK, nil
+	}
+	return nil, time.Time{}, ret, err
+}
+
+// SJWTDefaultFetcher - the default fetcher, using the URL file cache set in
+// library options and then downloading over HTTP
+type SJWTDefaultFetcher struct{}
+
+// Fetch - get the certificate from the URL cache or download it
+func (f SJWTDefaultFetcher) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	return sjwtGetURLContent(urlVal, timeoutVal)
+}
+
+// SJWTHTTPFetcher - download the certificate over HTTP, without caching
+//   - Client - the HTTP client to use (e.g., with a proxy or custom TLS root
+//     CAs); if nil, a client enforcing the fetch policy is used
+type SJWTHTTPFetcher struct {
+	Client *http.Client
+}
+
+// Fetch - download the certificate
+func (f SJWTHTTPFetcher) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	if ret, err := sjwtCheckFetchURL(urlVal); ret != SJWTRetOK {
+		return nil, time.Time{}, ret, err
+	}
+	fetchKey := urlVal
+	if f.Client != nil {
+		fetchKey = "client:" + urlVal
+	}
+	return sjwtGuardedFetch(urlVal, fetchKey, func() ([]byte, time.Time, int, error) {
+		data, meta, ret, err := sjwtHTTPGetContent(urlVal, timeoutVal, nil, f.Client)
+		if data == nil {
+			return nil, time.Time{}, ret, err
+		}
+		return data, meta.Expires, SJWTRetOK, nil
+	})
+}
+
+// SJWTStorageFetcher - certificates kept in a cache storage (e.g., a RESP
+// server shared by several nodes)
+type SJWTStorageFetcher struct {
+	Storage SJWTCacheStorage
+}
+
+// Fetch - get the certificate from the storage if it is not expired
+func (f SJWTStorageFetcher) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	data, expires, err := f.Storage.Get(urlVal)
+	if err != nil {
+		return nil, time.Time{}, SJWTRetErrFileRead, err
+	}
+	if data == nil {
+		return nil, time.Time{}, SJWTRetErrFetchNotFound, sjwtErrFetchNotFound
+	}
+	return data, expires, SJWTRetOK, nil
+}
+
+// Store - keep the certificate in the storage until it expires
+func (f SJWTStorageFetcher) Store(urlVal string, data []byte, expires time.Time) error {
+	return f.Storage.Set(urlVal, data, time.Until(expires))
+}
+
+// SJWTFileCacheFetcher - certificates stored in files in a directory, with
+// the same layout as the URL file cache
+// * Dir - the directory; if empty, the cache directory from library options
+type SJWTFileCacheFetcher struct {
+	Dir string
+}
+
+func (f SJWTFileCacheFetcher) storage() SJWTStorageFetcher {
+	if len(f.Dir) > 0 {
+		return SJWTStorageFetcher{Storage: SJWTFileStorage{Dir: f.Dir}}
+	}
+	return SJWTStorageFetcher{Storage: SJWTFileStorage{Dir: globalLibOptions.cacheDirPath}}
+}
+
+// Fetch - get the certificate from the file if it is not expired
+func (f SJWTFileCacheFetcher) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	if len(f.Dir) == 0 && len(globalLibOptions.cacheDirPath) == 0 {
+		return nil, time.Time{}, SJWTRetErrFetchNotFound, sjwtErrFetchNotFound
+	}
+	return f.storage().Fetch(urlVal, timeoutVal)
+}
+
+// Store - write the certificate to the file, with its expire time
+func (f SJWTFileCacheFetcher) Store(urlVal string, data []byte, expires time.Time) error {
+	if len(f.Dir) == 0 && len(globalLibOptions.cacheDirPath) == 0 {
+		return errors.New("no cache directory")
+	}
+	return f.storage().Store(urlVal, data, expires)
+}
+
+// SJWTMemoryCacheFetcher - certificates kept in memory, in a bounded LRU
+type SJWTMemoryCacheFetcher struct {
+	SJWTStorageFetcher
+}
+
+// NewSJWTMemoryCacheFetcher - create a memory cache for up to maxSize
+// certificates
+func NewSJWTMemoryCacheFetcher(maxSize int) *SJWTMemoryCacheFetcher {
+	return &SJWTMemoryCacheFetcher{SJWTStorageFetcher{Storage: NewSJWTMemoryStorage(maxSize)}}
+}
+
+// SJWTStaticFetcher - certificates given in a map indexed by x5u URL (e.g.,
+// pre-seeded from a local bundle)
+type SJWTStaticFetcher struct {
+	mu    sync.RWMutex
+	certs map[string][]byte
+}
+
+// NewSJWTStaticFetcher - create a static fetcher with the certificates
+func NewSJWTStaticFetcher(certs map[string][]byte) *SJWTStaticFetcher {
+	f := &SJWTStaticFetcher{certs: make(map[string][]byte)}
+	for urlVal, data := range certs {
+		f.certs[urlVal] = data
+	}
+	return f
+}
+
+// Set - add or replace the certificate for the URL
+func (f *SJWTStaticFetcher) Set(urlVal string, data []byte) {
+	f.mu.Lock()
+	f.certs[urlVal] = data
+	f.mu.Unlock()
+}
+
+// Fetch - get the certificate from the map
+func (f *SJWTStaticFetcher) Fetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	f.mu.RLock()
+	data, ok := f.certs[urlVal]
+	f.mu.RUnlock()
+	if !ok {
+		return nil, time.Time{}, SJWTRetErrFetchNotFound, sjwtErrFetchNotFound
+	}
+	return data, sjwtStaticExpires(data), SJWTRetOK, nil
+}
@@ -0,0 +1,91 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestCertificateFetcher(t *testing.T) {
+	_, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(certPEM)
+	}))
+	defer server.Close()
+
+	secsipid.SetURLFileCacheOptions("", 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+	defer secsipid.SJWTSetCertificateFetcher(nil)
+
+	t.Run("OK verifying with static certificate", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		x5u := "https://certs.example.invalid/cert.pem"
+		identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", x5u, keyPEM)
+		memCache := secsipid.NewSJWTMemoryCacheFetcher(10)
+		secsipid.SJWTSetCertificateFetcher(secsipid.SJWTFetcherChain{
+			memCache,
+			secsipid.NewSJWTStaticFetcher(map[string][]byte{x5u: certPEM}),
+		})
+
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(getMsgFromErr(err)).ToBe("")
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+
+		data, _, ret, _ := memCache.Fetch(x5u, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(data).ToEqual(certPEM)
+	})
+
+	t.Run("OK storing downloaded certificate in file cache", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		workDir, _ := os.MkdirTemp("", "secsipid-fetcher")
+		defer os.RemoveAll(workDir)
+		x5u := server.URL + "/cert.pem"
+		identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", x5u, keyPEM)
+		fileCache := secsipid.SJWTFileCacheFetcher{Dir: workDir}
+		secsipid.SJWTSetCertificateFetcher(secsipid.SJWTFetcherChain{
+			secsipid.NewSJWTStaticFetcher(nil),
+			fileCache,
+			secsipid.SJWTHTTPFetcher{},
+		})
+		requests = 0
+
+		ret, _ := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(requests).ToBe(1)
+
+		data, _, ret, _ := fileCache.Fetch(x5u, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(data).ToEqual(certPEM)
+	})
+
+	t.Run("ErrFetchNotFound when no fetcher has the certificate", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		chain := secsipid.SJWTFetcherChain{
+			secsipid.NewSJWTMemoryCacheFetcher(10),
+			secsipid.NewSJWTStaticFetcher(nil),
+		}
+
+		data, _, ret, err := chain.Fetch("https://certs.example.invalid/other.pem", 5)
+		expect(data == nil).ToBe(true)
+		expect(ret).ToBe(secsipid.SJWTRetErrFetchNotFound)
+		expect(getMsgFromErr(err)).ToBe("certificate not found")
+	})
+	t.Run("OK getting URL content with configured fetcher", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		x5u := "https://certs.example.invalid/content.pem"
+		secsipid.SJWTSetCertificateFetcher(secsipid.NewSJWTStaticFetcher(map[string][]byte{x5u: certPEM}))
+
+		data, ret, err := secsipid.SJWTGetURLContent(x5u, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(data).ToEqual(certPEM)
+	})
+}
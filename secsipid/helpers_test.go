@@ -0,0 +1,71 @@
+package secsipid_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math"
+	"math/big"
+	"time"
+)
+
+// testCert - certificate generated for the tests, with its private key
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert - EC P-256 certificate from the template, with a random serial
+// number, valid from one hour ago for one year, signed by the issuer or
+// self-signed if the issuer is nil
+func newTestCert(tmpl *x509.Certificate, issuer *testCert) *testCert {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl.SerialNumber, _ = rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().AddDate(1, 0, 0)
+	parent, parentKey := tmpl, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// newTestCA - CA certificate with the common name, signed by the issuer or
+// self-signed if the issuer is nil
+func newTestCA(name string, issuer *testCert) *testCert {
+	return newTestCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}, issuer)
+}
+
+// newTestCertChain - certificate with the common name signed by a new CA
+// named "<name> CA", returning the CA PEM, the certificate PEM and the
+// private key PEM of the certificate
+func newTestCertChain(name string) ([]byte, []byte, []byte) {
+	ca := newTestCA(name+" CA", nil)
+	leaf := newTestCert(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: name},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}, ca)
+	return ca.certPEM(), leaf.certPEM(), leaf.keyPEM()
+}
+
+// certPEM - the certificate in PEM format
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+// keyPEM - the private key in PEM format (SEC 1)
+func (c *testCert) keyPEM() []byte {
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,214 @@
+package secsipid
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SJWTIdentityHeader - the parsed value of the SIP Identity header (RFC 8224)
+type SJWTIdentityHeader struct {
+	// Token - the PASSporT in compact form (header.payload.signature)
+	Token string
+	// Info - the URI of the info parameter, without the angle brackets
+	Info string
+	// Alg - the value of the alg parameter
+	Alg string
+	// Ppt - the value of the ppt parameter, without the quotes
+	Ppt string
+	// Params - the extension parameters, with lower case names and unquoted
+	// values (empty for the parameters without value)
+	Params map[string]string
+}
+
+// sjwtIsSWS - true for the characters of the SIP separator white space,
+// including the ones of folded lines
+func sjwtIsSWS(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// sjwtIsIdentityTokenChar - true for the characters of the signed identity
+// digest (base64 characters and dot)
+func sjwtIsIdentityTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		strings.IndexByte("/+-_=.", c) >= 0
+}
+
+// sjwtIsSIPTokenChar - true for the characters of the SIP token (RFC 3261)
+func sjwtIsSIPTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
+
+// sjwtIdentityParser - the state of parsing the Identity header value
+type sjwtIdentityParser struct {
+	s   string
+	pos int
+}
+
+// skipSWS - skip the separator white space
+func (p *sjwtIdentityParser) skipSWS() {
+	for p.pos < len(p.s) && sjwtIsSWS(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+// readWhile - return the characters matching the function, from the current
+// position
+func (p *sjwtIdentityParser) readWhile(match func(byte) bool) string {
+	start := p.pos
+	for p.pos < len(p.s) && match(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// readParamValue - return the parameter value, as quoted string, URI in
+// angle brackets or token (host characters are accepted as well)
+func (p *sjwtIdentityParser) readParamValue(name string) (string, error) {
+	if p.pos >= len(p.s) {
+		return "", fmt.Errorf("missing value for %s header parameter", name)
+	}
+	switch p.s[p.pos] {
+	case '"':
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.s); p.pos++ {
+			c := p.s[p.pos]
+			if c == '"' {
+				p.pos++
+				return sb.String(), nil
+			}
+			if c == '\\' && p.pos+1 < len(p.s) {
+				p.pos++
+				c = p.s[p.pos]
+			}
+			sb.WriteByte(c)
+		}
+		return "", fmt.Errorf("unterminated quoted value for %s header parameter", name)
+	case '<':
+		end := strings.IndexByte(p.s[p.pos:], '>')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated URI value for %s header parameter", name)
+		}
+		value := p.s[p.pos : p.pos+end+1]
+		p.pos += end + 1
+		return value, nil
+	}
+	value := p.readWhile(func(c byte) bool {
+		return sjwtIsSIPTokenChar(c) || c == ':' || c == '[' || c == ']'
+	})
+	if len(value) == 0 {
+		return "", fmt.Errorf("invalid value for %s header parameter", name)
+	}
+	return value, nil
+}
+
+// readParams - return the parameters (prefixed by ';') up to the end of the
+// header value, with lower case names and unquoted values
+func (p *sjwtIdentityParser) readParams(hdrName string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		p.skipSWS()
+		if p.pos >= len(p.s) {
+			return params, nil
+		}
+		if p.s[p.pos] != ';' {
+			return nil, fmt.Errorf("invalid character '%c' at position %d in %s", p.s[p.pos], p.pos, hdrName)
+		}
+		p.pos++
+		p.skipSWS()
+		name := strings.ToLower(p.readWhile(sjwtIsSIPTokenChar))
+		if len(name) == 0 {
+			return nil, fmt.Errorf("missing parameter name at position %d in %s", p.pos, hdrName)
+		}
+		if _, ok := params[name]; ok {
+			return nil, fmt.Errorf("duplicate %s header parameter", name)
+		}
+
+		value := ""
+		p.skipSWS()
+		if p.pos < len(p.s) && p.s[p.pos] == '=' {
+			p.pos++
+			p.skipSWS()
+			var err error
+			if value, err = p.readParamValue(name); err != nil {
+				return nil, err
+			}
+		}
+		params[name] = value
+	}
+}
+
+// SJWTParseIdentityHeader - parse the value of the SIP Identity header
+// following the grammar of RFC 8224 (with the SIP separators of RFC 3261):
+// the signed identity digest, followed by the info, alg, ppt and extension
+// parameters; the parameter names are case insensitive
+func SJWTParseIdentityHeader(identityVal string) (*SJWTIdentityHeader, int, error) {
+	p := &sjwtIdentityParser{s: identityVal}
+	hdr := &SJWTIdentityHeader{Params: make(map[string]string)}
+
+	p.skipSWS()
+	hdr.Token = p.readWhile(sjwtIsIdentityTokenChar)
+	if len(hdr.Token) == 0 {
+		if p.pos >= len(p.s) {
+			return nil, SJWTRetErrSIPHdrEmpty, fmt.Errorf("empty identity header")
+		}
+		return nil, SJWTRetErrSIPHdrParse, fmt.Errorf("missing identity token")
+	}
+
+	params, err := p.readParams("identity header")
+	if err != nil {
+		return nil, SJWTRetErrSIPHdrParse, err
+	}
+	for name, value := range params {
+		switch name {
+		case "info":
+			if len(value) > 2 && value[0] == '<' && value[len(value)-1] == '>' {
+				value = value[1 : len(value)-1]
+			}
+			hdr.Info = value
+		case "alg":
+			hdr.Alg = value
+		case "ppt":
+			hdr.Ppt = value
+		default:
+			hdr.Params[name] = value
+		}
+	}
+	return hdr, SJWTRetOK, nil
+}
+
+// sjwtIdentityHasParams - true if the Identity header has any parameter
+func sjwtIdentityHasParams(hdr *SJWTIdentityHeader) bool {
+	return len(hdr.Info) > 0 || len(hdr.Alg) > 0 || len(hdr.Ppt) > 0 || len(hdr.Params) > 0
+}
+
+// SJWTCheckIdentityParams - check that the info parameter is set and the
+// values of alg and ppt parameters, if set, are the ones of SHAKEN
+func SJWTCheckIdentityParams(hdr *SJWTIdentityHeader) (int, error) {
+	return sjwtCheckIdentityParamsPpt(hdr, []string{"shaken"})
+}
+
+// sjwtContainsFold - true if the value is in the list, ignoring the case
+func sjwtContainsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sjwtCheckIdentityParamsPpt - check the parameters of the Identity header,
+// accepting the PASSporT types in ppts
+func sjwtCheckIdentityParamsPpt(hdr *SJWTIdentityHeader, ppts []string) (int, error) {
+	if len(hdr.Alg) > 0 && !strings.EqualFold(hdr.Alg, "ES256") {
+		return SJWTRetErrSIPHdrAlg, fmt.Errorf("invalid value for alg header parameter")
+	}
+	if len(hdr.Ppt) > 0 && !sjwtContainsFold(ppts, hdr.Ppt) {
+		return SJWTRetErrSIPHdrPpt, fmt.Errorf("invalid value for ppt header parameter")
+	}
+	if len(hdr.Info) == 0 || hdr.Info == "<>" {
+		return SJWTRetErrSIPHdrInfo, fmt.Errorf("invalid value info header parameter")
+	}
+	return SJWTRetOK, nil
+}
@@ -0,0 +1,97 @@
+package secsipid_test
+
+import (
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestParseIdentityHeader(t *testing.T) {
+	t.Run("OK with typical header", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		hdr, ret, err := secsipid.SJWTParseIdentityHeader("aaa.bbb.ccc;info=<https://certs.example.com/cert.pem>;alg=ES256;ppt=shaken")
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(hdr.Token).ToBe("aaa.bbb.ccc")
+		expect(hdr.Info).ToBe("https://certs.example.com/cert.pem")
+		expect(hdr.Alg).ToBe("ES256")
+		expect(hdr.Ppt).ToBe("shaken")
+		expect(len(hdr.Params)).ToBe(0)
+	})
+
+	t.Run("OK with white spaces, case variations, quoted and extension values", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		hdr, ret, err := secsipid.SJWTParseIdentityHeader(" aaa.bbb.ccc ;\r\n INFO = <https://certs.example.com/cert.pem?a=b;c=d> ;" +
+			" ALG=es256; ppt=\"shaken\" ; x-note=\"a; b=\\\"c\\\"\"; flag ")
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(hdr.Token).ToBe("aaa.bbb.ccc")
+		expect(hdr.Info).ToBe("https://certs.example.com/cert.pem?a=b;c=d")
+		expect(hdr.Alg).ToBe("es256")
+		expect(hdr.Ppt).ToBe("shaken")
+		expect(hdr.Params["x-note"]).ToBe(`a; b="c"`)
+		_, ok := hdr.Params["flag"]
+		expect(ok).ToBe(true)
+
+		ret, err = secsipid.SJWTCheckIdentityParams(hdr)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	errTests := []struct {
+		name        string
+		value       string
+		expectedRet int
+		expectedMsg string
+	}{
+		{"ErrSIPHdrEmpty with empty header", " ", secsipid.SJWTRetErrSIPHdrEmpty, "empty identity header"},
+		{"ErrSIPHdrParse with missing token", ";info=<https://a.b/c>", secsipid.SJWTRetErrSIPHdrParse,
+			"missing identity token"},
+		{"ErrSIPHdrParse with invalid character", "aaa.bbb.ccc info=<https://a.b/c>", secsipid.SJWTRetErrSIPHdrParse,
+			"invalid character 'i' at position 12 in identity header"},
+		{"ErrSIPHdrParse with unterminated URI", "aaa.bbb.ccc;info=<https://a.b/c", secsipid.SJWTRetErrSIPHdrParse,
+			"unterminated URI value for info header parameter"},
+		{"ErrSIPHdrParse with unterminated quoted value", "aaa.bbb.ccc;ppt=\"shaken", secsipid.SJWTRetErrSIPHdrParse,
+			"unterminated quoted value for ppt header parameter"},
+		{"ErrSIPHdrParse with duplicate parameter", "aaa.bbb.ccc;alg=ES256;Alg=ES256", secsipid.SJWTRetErrSIPHdrParse,
+			"duplicate alg header parameter"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect := expectate.Expect(t)
+			hdr, ret, err := secsipid.SJWTParseIdentityHeader(tt.value)
+			expect(hdr == nil).ToBe(true)
+			expect(ret).ToBe(tt.expectedRet)
+			expect(getMsgFromErr(err)).ToBe(tt.expectedMsg)
+		})
+	}
+}
+
+func TestCheckIdentityParams(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expectedRet int
+		expectedMsg string
+	}{
+		{"ErrSIPHdrAlg with other algorithm", "aaa.bbb.ccc;info=<https://a.b/c>;alg=RS256", secsipid.SJWTRetErrSIPHdrAlg,
+			"invalid value for alg header parameter"},
+		{"ErrSIPHdrPpt with other ppt", "aaa.bbb.ccc;info=<https://a.b/c>;ppt=div", secsipid.SJWTRetErrSIPHdrPpt,
+			"invalid value for ppt header parameter"},
+		{"ErrSIPHdrInfo with missing info", "aaa.bbb.ccc;alg=ES256", secsipid.SJWTRetErrSIPHdrInfo,
+			"invalid value info header parameter"},
+		{"ErrSIPHdrInfo with empty info", "aaa.bbb.ccc;info=<>", secsipid.SJWTRetErrSIPHdrInfo,
+			"invalid value info header parameter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect := expectate.Expect(t)
+			hdr, ret, _ := secsipid.SJWTParseIdentityHeader(tt.value)
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+			ret, err := secsipid.SJWTCheckIdentityParams(hdr)
+			expect(ret).ToBe(tt.expectedRet)
+			expect(getMsgFromErr(err)).ToBe(tt.expectedMsg)
+		})
+	}
+}
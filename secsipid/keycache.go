@@ -0,0 +1,266 @@
+package secsipid
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// keyCacheItem - parsed certificate and public key and the outcome of the
+// certificate verification for a x5u URL
+type keyCacheItem struct {
+	x5u       string
+	cert      *x509.Certificate
+	pubKey    *ecdsa.PublicKey
+	keyRet    int
+	keyErr    error
+	verifyRet int
+	verifyErr error
+	verifyCtx string
+	expires   time.Time
+	// expire time of the downloaded content, for refreshing it before expiry
+	fetchExpires time.Time
+}
+
+// keyCache - bounded LRU with the parsed public keys per x5u URL, to avoid
+// reading, parsing and verifying the certificate for every identity check
+var keyCache = struct {
+	sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+}{items: make(map[string]*list.Element), lru: list.New()}
+
+// SJWTKeyCacheInfo - statistics of the parsed public keys cache
+type SJWTKeyCacheInfo struct {
+	Size    int `json:"size"`
+	MaxSize int `json:"maxSize"`
+	Hits    int `json:"hits"`
+	Misses  int `json:"misses"`
+}
+
+var keyCacheStats = struct {
+	sync.Mutex
+	hits   int
+	misses int
+}{}
+
+// SJWTResetKeyCache - drop the parsed public keys and verification outcomes
+func SJWTResetKeyCache() {
+	keyCache.Lock()
+	keyCache.items = make(map[string]*list.Element)
+	keyCache.lru.Init()
+	keyCache.Unlock()
+	keyCacheStats.Lock()
+	keyCacheStats.hits = 0
+	keyCacheStats.misses = 0
+	keyCacheStats.Unlock()
+}
+
+// SJWTGetKeyCacheInfo - return the statistics of the parsed public keys cache
+func SJWTGetKeyCacheInfo() SJWTKeyCacheInfo {
+	keyCache.Lock()
+	size := keyCache.lru.Len()
+	keyCache.Unlock()
+	keyCacheStats.Lock()
+	defer keyCacheStats.Unlock()
+	return SJWTKeyCacheInfo{
+		Size:    size,
+		MaxSize: globalLibOptions.certMemCacheSize,
+		Hits:    keyCacheStats.hits,
+		Misses:  keyCacheStats.misses,
+	}
+}
+
+// keyCacheCRL - stamp of the CRL file, checked again only after the
+// certificate reload interval
+var keyCacheCRL = struct {
+	sync.Mutex
+	path    string
+	stamp   string
+	checked time.Time
+}{}
+
+// sjwtCRLStamp - build a value that changes when the CRL file is updated
+func sjwtCRLStamp() string {
+	crlFile := globalLibOptions.certCRLFile
+	interval := time.Duration(globalLibOptions.certReloadInterval) * time.Second
+	tnow := time.Now()
+
+	keyCacheCRL.Lock()
+	defer keyCacheCRL.Unlock()
+	if keyCacheCRL.path == crlFile && interval > 0 && tnow.Sub(keyCacheCRL.checked) < interval {
+		return keyCacheCRL.stamp
+	}
+	keyCacheCRL.path = crlFile
+	keyCacheCRL.stamp = sjwtSourceStamp(SJWTTrustSource{Type: SJWTTrustSourceFile, Path: crlFile})
+	keyCacheCRL.checked = tnow
+	return keyCacheCRL.stamp
+}
+
+// sjwtVerifyContext - build a value that changes when the certificate
+// verification settings are changed or the trust stores and the CRL file
+// are reloaded
+func sjwtVerifyContext() string {
+	certVerify := globalLibOptions.certVerify
+	var rootGen, interGen uint64
+	if (certVerify & (1 << 2)) != 0 {
+		state, _, _ := sjwtGlobalRootStore((certVerify & (1 << 1)) != 0).snapshot()
+		if state != nil {
+			rootGen = state.generation
+		}
+	}
+	if (certVerify & (1 << 3)) != 0 {
+		state, _, _ := sjwtGlobalInterStore().snapshot()
+		if state != nil {
+			interGen = state.generation
+		}
+	}
+	crlStamp := ""
+	if (certVerify & (1 << 4)) != 0 {
+		crlStamp = sjwtCRLStamp()
+	}
+	return fmt.Sprintf("%d|%d|%d|%d|%s", certVerify, sjwtSystemCertGeneration(), rootGen, interGen, crlStamp)
+}
+
+// sjwtKeyCacheGet - return the cached item for x5u if it is not expired and
+// it was verified with the same settings
+func sjwtKeyCacheGet(x5u string, verifyCtx string) *keyCacheItem {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	elem, ok := keyCache.items[x5u]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*keyCacheItem)
+	if !time.Now().Before(item.expires) || item.verifyCtx != verifyCtx {
+		keyCache.lru.Remove(elem)
+		delete(keyCache.items, x5u)
+		return nil
+	}
+	keyCache.lru.MoveToFront(elem)
+	return item
+}
+
+// sjwtKeyCacheSet - add the item to the cache, evicting the least recently
+// used items when the cache is full
+func sjwtKeyCacheSet(item *keyCacheItem) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	if elem, ok := keyCache.items[item.x5u]; ok {
+		elem.Value = item
+		keyCache.lru.MoveToFront(elem)
+		return
+	}
+	keyCache.items[item.x5u] = keyCache.lru.PushFront(item)
+	for keyCache.lru.Len() > globalLibOptions.certMemCacheSize {
+		elem := keyCache.lru.Back()
+		keyCache.lru.Remove(elem)
+		delete(keyCache.items, elem.Value.(*keyCacheItem).x5u)
+	}
+}
+
+// sjwtKeyCacheable - true if the verification outcome does not depend on
+// transient conditions (e.g., failure to read files or download certificates)
+func sjwtKeyCacheable(ret int) bool {
+	switch ret {
+	case SJWTRetOK, SJWTRetErrCertInvalid, SJWTRetErrCertExpired, SJWTRetErrCertRevoked:
+		return true
+	}
+	return false
+}
+
+// sjwtGetVerifiedPubKey - get the EC public key from the x5u URL, verify the
+// certificate and parse it, using the parsed public keys cache if enabled
+func sjwtGetVerifiedPubKey(x5u string, timeoutVal int) (*ecdsa.PublicKey, int, error) {
+	item, ret, err := sjwtGetVerifiedItem(x5u, timeoutVal)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	if item.pubKey == nil {
+		return nil, item.keyRet, item.keyErr
+	}
+	return item.pubKey, SJWTRetOK, nil
+}
+
+// sjwtGetVerifiedCertificate - get the leaf certificate from the URL and
+// verify it, using the parsed public keys cache if enabled
+func sjwtGetVerifiedCertificate(x5u string, timeoutVal int) (*x509.Certificate, int, error) {
+	item, ret, err := sjwtGetVerifiedItem(x5u, timeoutVal)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	if item.cert == nil {
+		return nil, SJWTRetErrCertInvalidFormat, errors.New("no certificate")
+	}
+	return item.cert, SJWTRetOK, nil
+}
+
+// sjwtNewKeyCacheItem - verify the certificate content and parse it
+func sjwtNewKeyCacheItem(x5u string, data []byte, expires time.Time, verifyCtx string) *keyCacheItem {
+	validUntil, ret, err := sjwtPubKeyVerify(data)
+	item := &keyCacheItem{
+		x5u:          x5u,
+		verifyRet:    ret,
+		verifyErr:    err,
+		verifyCtx:    verifyCtx,
+		expires:      expires,
+		fetchExpires: expires,
+	}
+	if !validUntil.IsZero() && validUntil.Before(item.expires) {
+		item.expires = validUntil
+	}
+	if ret == SJWTRetOK {
+		item.cert = sjwtParseLeafCertificate(data)
+		item.pubKey, item.keyRet, item.keyErr = SJWTParseECPublicKeyFromPEM(data)
+	}
+	return item
+}
+
+// sjwtGetVerifiedItem - get the certificate from the URL, verify it and
+// parse it, using the parsed public keys cache if enabled
+func sjwtGetVerifiedItem(x5u string, timeoutVal int) (*keyCacheItem, int, error) {
+	if globalLibOptions.certMemCacheSize <= 0 {
+		data, expires, ret, err := sjwtFetchCertificate(x5u, timeoutVal)
+		if data == nil {
+			return nil, ret, err
+		}
+		item := sjwtNewKeyCacheItem(x5u, data, expires, "")
+		if item.verifyRet != SJWTRetOK {
+			return nil, item.verifyRet, item.verifyErr
+		}
+		return item, SJWTRetOK, nil
+	}
+
+	verifyCtx := sjwtVerifyContext()
+	if item := sjwtKeyCacheGet(x5u, verifyCtx); item != nil {
+		keyCacheStats.Lock()
+		keyCacheStats.hits++
+		keyCacheStats.Unlock()
+		// the content is not read from the cache, but it is still in use
+		sjwtRefreshTrack(x5u, item.fetchExpires)
+		if item.verifyRet != SJWTRetOK {
+			return nil, item.verifyRet, item.verifyErr
+		}
+		return item, SJWTRetOK, nil
+	}
+	keyCacheStats.Lock()
+	keyCacheStats.misses++
+	keyCacheStats.Unlock()
+
+	data, expires, ret, err := sjwtFetchCertificate(x5u, timeoutVal)
+	if data == nil {
+		return nil, ret, err
+	}
+	item := sjwtNewKeyCacheItem(x5u, data, expires, verifyCtx)
+	if sjwtKeyCacheable(item.verifyRet) && time.Now().Before(item.expires) {
+		sjwtKeyCacheSet(item)
+	}
+	if item.verifyRet != SJWTRetOK {
+		return nil, item.verifyRet, item.verifyErr
+	}
+	return item, SJWTRetOK, nil
+}
@@ -0,0 +1,115 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestKeyCache(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-keycache")
+	defer os.RemoveAll(workDir)
+
+	caPEM, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	otherCAPEM, _, _ := newTestCertChain("Key Cache Test")
+	caFile := path.Join(workDir, "ca.pem")
+	os.WriteFile(caFile, caPEM, 0640)
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(certPEM)
+	}))
+	defer server.Close()
+
+	x5u := server.URL + "/cert.pem"
+	identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", x5u, keyPEM)
+
+	secsipid.SetURLFileCacheOptions("", 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+	secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+	defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+	secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+	defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	t.Run("OK downloading and verifying only once", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetKeyCache()
+		downloads = 0
+
+		for i := 0; i < 3; i++ {
+			ret, err := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+			expect(getMsgFromErr(err)).ToBe("")
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+		}
+		expect(downloads).ToBe(1)
+		info := secsipid.SJWTGetKeyCacheInfo()
+		expect(info.Size).ToBe(1)
+		expect(info.Hits).ToBe(2)
+		expect(info.Misses).ToBe(1)
+	})
+
+	t.Run("ErrCertInvalid when the CA file changes", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetKeyCache()
+		secsipid.SJWTLibOptSetN("CertReloadInterval", 0)
+		defer secsipid.SJWTLibOptSetN("CertReloadInterval", 60)
+		downloads = 0
+
+		ret, _ := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+
+		os.WriteFile(caFile, otherCAPEM, 0640)
+		defer os.WriteFile(caFile, caPEM, 0640)
+
+		for i := 0; i < 2; i++ {
+			ret, _ = secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+			expect(ret).ToBe(secsipid.SJWTRetErrCertInvalid)
+		}
+		expect(downloads).ToBe(2)
+	})
+
+	t.Run("ErrCertInvalid when the CA file changes and the trust store is reloaded", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetKeyCache()
+		downloads = 0
+
+		ret, _ := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+
+		os.WriteFile(caFile, otherCAPEM, 0640)
+		defer func() {
+			os.WriteFile(caFile, caPEM, 0640)
+			secsipid.SJWTReloadTrustStore()
+		}()
+
+		ret, _ = secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(downloads).ToBe(1)
+
+		secsipid.SJWTReloadTrustStore()
+		ret, _ = secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrCertInvalid)
+		expect(downloads).ToBe(2)
+	})
+
+	t.Run("OK downloading every time when the cache is disabled", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetKeyCache()
+		secsipid.SJWTLibOptSetN("CertMemCacheSize", 0)
+		defer secsipid.SJWTLibOptSetN("CertMemCacheSize", 1024)
+		downloads = 0
+
+		for i := 0; i < 2; i++ {
+			ret, _ := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+		}
+		expect(downloads).ToBe(2)
+		expect(secsipid.SJWTGetKeyCacheInfo().Size).ToBe(0)
+	})
+}
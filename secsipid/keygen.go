@@ -0,0 +1,195 @@
+package secsipid
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SJWTShakenCertPolicy - the SHAKEN certificate policy OID (ATIS-1000080)
+const SJWTShakenCertPolicy = "2.16.840.1.114569.1.1.1"
+
+// SJWTCertOptions - attributes of a generated SHAKEN test certificate
+type SJWTCertOptions struct {
+	// Service Provider Code set in the TNAuthList extension (not for CA)
+	SPC string
+	// subject common name, default "SHAKEN <SPC>" (or "SHAKEN Test CA")
+	CommonName   string
+	Organization string
+	Country      string
+	// validity from now, default 365 days
+	Days int
+	// validity period overriding Days, when both are set
+	NotBefore time.Time
+	NotAfter  time.Time
+	// certificate policy OID, default SJWTShakenCertPolicy
+	PolicyOID string
+	// URL set in the CRL distribution points extension
+	CRLURL string
+	// CA certificate (for signing other certificates) instead of end-entity
+	IsCA bool
+	// serial number, random if 0
+	SerialNumber int64
+}
+
+// SJWTGenerateECKey - generate a new P-256 private key
+func SJWTGenerateECKey() (*ecdsa.PrivateKey, int, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, SJWTRetErrPrvKeyInvalid, err
+	}
+	return key, SJWTRetOK, nil
+}
+
+// SJWTEncodeECPrivateKeyToPEM - encode the private key in PEM format, as
+// SEC1 (EC PRIVATE KEY) or PKCS#8 (PRIVATE KEY)
+func SJWTEncodeECPrivateKeyToPEM(key *ecdsa.PrivateKey, pkcs8 bool) ([]byte, int, error) {
+	if pkcs8 {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, SJWTRetErrPrvKeyInvalid, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), SJWTRetOK, nil
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, SJWTRetErrPrvKeyInvalid, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), SJWTRetOK, nil
+}
+
+// SJWTEncodeECPublicKeyToPEM - encode the public key in PEM format (PKIX)
+func SJWTEncodeECPublicKeyToPEM(pubKey *ecdsa.PublicKey) ([]byte, int, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, SJWTRetErrCertInvalidEC, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), SJWTRetOK, nil
+}
+
+// sjwtParseOID - parse the dotted OID string
+func sjwtParseOID(oidVal string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(oidVal, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID: %s", oidVal)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID: %s", oidVal)
+	}
+	return oid, nil
+}
+
+// sjwtTNAuthListExtension - build the TNAuthList extension with the SPC
+func sjwtTNAuthListExtension(spc string) (pkix.Extension, error) {
+	spcVal, err := asn1.MarshalWithParams(spc, "ia5")
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	// TNAuthorizationList ::= SEQUENCE OF TNEntry, TNEntry ::= CHOICE { spc [0] ServiceProviderCode, ... }
+	value, err := asn1.Marshal([]asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: spcVal},
+	})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidTNAuthList, Value: value}, nil
+}
+
+// SJWTCreateCertificate - create a SHAKEN profile certificate for the public
+// key, signed by the issuer certificate and key, or self-signed with the
+// private key given as issuer key when the issuer certificate is nil; the
+// end-entity certificate has the TNAuthList extension with the SPC, the
+// certificate policy and the digital signature key usage; the certificate
+// is returned in PEM format
+func SJWTCreateCertificate(opts *SJWTCertOptions, pubKey *ecdsa.PublicKey, issuerCert *x509.Certificate, issuerKey *ecdsa.PrivateKey) ([]byte, int, error) {
+	if !opts.IsCA && len(opts.SPC) == 0 {
+		return nil, SJWTRetErrCertInvalid, fmt.Errorf("SPC not provided")
+	}
+	policyVal := opts.PolicyOID
+	if len(policyVal) == 0 {
+		policyVal = SJWTShakenCertPolicy
+	}
+	policy, err := sjwtParseOID(policyVal)
+	if err != nil {
+		return nil, SJWTRetErrCertInvalid, err
+	}
+	days := opts.Days
+	if days <= 0 {
+		days = 365
+	}
+	serial := big.NewInt(opts.SerialNumber)
+	if opts.SerialNumber == 0 {
+		if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127)); err != nil {
+			return nil, SJWTRetErrCertInvalid, err
+		}
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, SJWTRetErrCertInvalidEC, err
+	}
+	keyID := sha1.Sum(pubDER)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		SubjectKeyId:          keyID[:],
+		PolicyIdentifiers:     []asn1.ObjectIdentifier{policy},
+		BasicConstraintsValid: true,
+	}
+	if !opts.NotBefore.IsZero() && !opts.NotAfter.IsZero() {
+		tmpl.NotBefore = opts.NotBefore
+		tmpl.NotAfter = opts.NotAfter
+	}
+	tmpl.Subject.CommonName = opts.CommonName
+	if len(opts.Organization) > 0 {
+		tmpl.Subject.Organization = []string{opts.Organization}
+	}
+	if len(opts.Country) > 0 {
+		tmpl.Subject.Country = []string{opts.Country}
+	}
+	if len(opts.CRLURL) > 0 {
+		tmpl.CRLDistributionPoints = []string{opts.CRLURL}
+	}
+	if opts.IsCA {
+		if len(tmpl.Subject.CommonName) == 0 {
+			tmpl.Subject.CommonName = "SHAKEN Test CA"
+		}
+		tmpl.IsCA = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		if len(tmpl.Subject.CommonName) == 0 {
+			tmpl.Subject.CommonName = "SHAKEN " + opts.SPC
+		}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		ext, err := sjwtTNAuthListExtension(opts.SPC)
+		if err != nil {
+			return nil, SJWTRetErrCertInvalid, err
+		}
+		tmpl.ExtraExtensions = []pkix.Extension{ext}
+	}
+
+	parent := issuerCert
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pubKey, issuerKey)
+	if err != nil {
+		return nil, SJWTRetErrCertInvalid, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), SJWTRetOK, nil
+}
@@ -0,0 +1,269 @@
+package secsipid
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// SJWTLabCASpec - subject of a CA certificate of the lab PKI
+type SJWTLabCASpec struct {
+	CommonName   string `json:"cn,omitempty"`
+	Organization string `json:"org,omitempty"`
+	Country      string `json:"country,omitempty"`
+}
+
+// SJWTLabLeafSpec - a service provider certificate of the lab PKI
+type SJWTLabLeafSpec struct {
+	// name used as prefix of the files
+	Name       string `json:"name"`
+	SPC        string `json:"spc"`
+	CommonName string `json:"cn,omitempty"`
+	// listed in the CRL
+	Revoked bool `json:"revoked,omitempty"`
+	// validity ended a day ago
+	Expired bool `json:"expired,omitempty"`
+}
+
+// SJWTLabPKISpec - the hierarchy of the lab PKI: a STI-PA like root CA, a
+// STI-CA like intermediate CA signing the service provider certificates and
+// the CRL
+type SJWTLabPKISpec struct {
+	// validity of the certificates and of the CRL, default 365 days
+	Days int `json:"days,omitempty"`
+	// URL set in the CRL distribution points of the leaf certificates
+	CRLURL       string            `json:"crlURL,omitempty"`
+	Root         SJWTLabCASpec     `json:"root"`
+	Intermediate SJWTLabCASpec     `json:"intermediate"`
+	Leaves       []SJWTLabLeafSpec `json:"leaves"`
+}
+
+// SJWTLabPKILeaf - the files and the attributes of a generated service
+// provider certificate
+type SJWTLabPKILeaf struct {
+	Name    string `json:"name"`
+	SPC     string `json:"spc"`
+	Serial  string `json:"serial"`
+	Revoked bool   `json:"revoked,omitempty"`
+	Expired bool   `json:"expired,omitempty"`
+	// private key
+	KeyFile string `json:"keyFile"`
+	// the leaf certificate
+	CertFile string `json:"certFile"`
+	// the leaf and intermediate certificates, to be served at x5u
+	ChainFile string `json:"chainFile"`
+}
+
+// SJWTLabPKIManifest - the files of the generated lab PKI, written also in
+// the manifest.json file of the directory
+type SJWTLabPKIManifest struct {
+	// root CA certificate, for CertCAFile
+	CAFile    string `json:"caFile"`
+	CAKeyFile string `json:"caKeyFile"`
+	// intermediate CA certificate, for CertCAInter
+	CAInterFile    string `json:"caInterFile"`
+	CAInterKeyFile string `json:"caInterKeyFile"`
+	// CRL of the intermediate CA, for CertCRLFile
+	CRLFile string           `json:"crlFile"`
+	Leaves  []SJWTLabPKILeaf `json:"leaves"`
+}
+
+// sjwtLabNameRegexp - allowed names of the leaf certificates, used in the
+// file names
+var sjwtLabNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// SJWTDefaultLabPKISpec - return the spec of a lab PKI with two valid, one
+// revoked and one expired service provider certificates
+func SJWTDefaultLabPKISpec() *SJWTLabPKISpec {
+	return &SJWTLabPKISpec{
+		Root:         SJWTLabCASpec{CommonName: "STI-PA Lab Root CA", Organization: "STI-PA Lab", Country: "US"},
+		Intermediate: SJWTLabCASpec{CommonName: "STI-CA Lab Intermediate CA", Organization: "STI-CA Lab", Country: "US"},
+		Leaves: []SJWTLabLeafSpec{
+			{Name: "sp1", SPC: "1001"},
+			{Name: "sp2", SPC: "1002"},
+			{Name: "revoked", SPC: "1003", Revoked: true},
+			{Name: "expired", SPC: "1004", Expired: true},
+		},
+	}
+}
+
+// SJWTParseLabPKISpec - parse the lab PKI spec in JSON format
+func SJWTParseLabPKISpec(data []byte) (*SJWTLabPKISpec, error) {
+	spec := &SJWTLabPKISpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("invalid lab PKI spec: %v", err)
+	}
+	return spec, nil
+}
+
+// sjwtLabWritePEM - write the PEM content to the file of the directory
+func sjwtLabWritePEM(dirPath string, fileName string, data []byte, perm os.FileMode) error {
+	return SJWTWriteFileAtomic(filepath.Join(dirPath, fileName), data, perm)
+}
+
+// sjwtLabNewKey - generate a private key and write it to the file
+func sjwtLabNewKey(dirPath string, fileName string) (*ecdsa.PrivateKey, error) {
+	key, _, err := SJWTGenerateECKey()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, _, err := SJWTEncodeECPrivateKeyToPEM(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return key, sjwtLabWritePEM(dirPath, fileName, keyPEM, 0600)
+}
+
+// sjwtLabNewCert - create the certificate, write it to the file and return
+// it parsed as well
+func sjwtLabNewCert(dirPath string, fileName string, opts *SJWTCertOptions, pubKey *ecdsa.PublicKey,
+	issuerCert *x509.Certificate, issuerKey *ecdsa.PrivateKey) (*x509.Certificate, []byte, error) {
+	certPEM, _, err := SJWTCreateCertificate(opts, pubKey, issuerCert, issuerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, certPEM, sjwtLabWritePEM(dirPath, fileName, certPEM, 0644)
+}
+
+// SJWTBuildLabPKI - generate the keys, the certificates and the CRL of the
+// lab PKI in the directory, returning the manifest with the file names
+func SJWTBuildLabPKI(spec *SJWTLabPKISpec, dirPath string) (*SJWTLabPKIManifest, error) {
+	if len(spec.Leaves) == 0 {
+		return nil, errors.New("no leaf certificates in lab PKI spec")
+	}
+	names := make(map[string]bool)
+	for _, leaf := range spec.Leaves {
+		if !sjwtLabNameRegexp.MatchString(leaf.Name) || names[leaf.Name] {
+			return nil, fmt.Errorf("invalid or duplicate leaf name: %q", leaf.Name)
+		}
+		if len(leaf.SPC) == 0 {
+			return nil, fmt.Errorf("SPC not provided for leaf: %s", leaf.Name)
+		}
+		names[leaf.Name] = true
+	}
+	if err := os.MkdirAll(dirPath, 0750); err != nil {
+		return nil, err
+	}
+	days := spec.Days
+	if days <= 0 {
+		days = 365
+	}
+	manifest := &SJWTLabPKIManifest{
+		CAFile:         "root-ca.pem",
+		CAKeyFile:      "root-ca-private.pem",
+		CAInterFile:    "intermediate-ca.pem",
+		CAInterKeyFile: "intermediate-ca-private.pem",
+		CRLFile:        "crl.pem",
+	}
+
+	rootKey, err := sjwtLabNewKey(dirPath, manifest.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCert, _, err := sjwtLabNewCert(dirPath, manifest.CAFile, &SJWTCertOptions{
+		IsCA:         true,
+		CommonName:   spec.Root.CommonName,
+		Organization: spec.Root.Organization,
+		Country:      spec.Root.Country,
+		Days:         days * 2,
+		SerialNumber: 1,
+	}, &rootKey.PublicKey, nil, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	interKey, err := sjwtLabNewKey(dirPath, manifest.CAInterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	interCert, interPEM, err := sjwtLabNewCert(dirPath, manifest.CAInterFile, &SJWTCertOptions{
+		IsCA:         true,
+		CommonName:   spec.Intermediate.CommonName,
+		Organization: spec.Intermediate.Organization,
+		Country:      spec.Intermediate.Country,
+		Days:         days * 2,
+		SerialNumber: 2,
+	}, &interKey.PublicKey, rootCert, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tnow := time.Now()
+	var revoked []pkix.RevokedCertificate
+	for i, leafSpec := range spec.Leaves {
+		leaf := SJWTLabPKILeaf{
+			Name:      leafSpec.Name,
+			SPC:       leafSpec.SPC,
+			Revoked:   leafSpec.Revoked,
+			Expired:   leafSpec.Expired,
+			KeyFile:   leafSpec.Name + "-private.pem",
+			CertFile:  leafSpec.Name + "-cert.pem",
+			ChainFile: leafSpec.Name + "-chain.pem",
+		}
+		opts := &SJWTCertOptions{
+			SPC:          leafSpec.SPC,
+			CommonName:   leafSpec.CommonName,
+			Days:         days,
+			CRLURL:       spec.CRLURL,
+			SerialNumber: int64(100 + i),
+		}
+		if leafSpec.Expired {
+			opts.NotBefore = tnow.AddDate(0, 0, -days-1)
+			opts.NotAfter = tnow.AddDate(0, 0, -1)
+		}
+		key, err := sjwtLabNewKey(dirPath, leaf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, certPEM, err := sjwtLabNewCert(dirPath, leaf.CertFile, opts, &key.PublicKey, interCert, interKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = sjwtLabWritePEM(dirPath, leaf.ChainFile, append(certPEM, interPEM...), 0644); err != nil {
+			return nil, err
+		}
+		leaf.Serial = cert.SerialNumber.String()
+		if leafSpec.Revoked {
+			revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: tnow})
+		}
+		manifest.Leaves = append(manifest.Leaves, leaf)
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          tnow.Add(-time.Hour),
+		NextUpdate:          tnow.AddDate(0, 0, days),
+		RevokedCertificates: revoked,
+	}, interCert, interKey)
+	if err != nil {
+		return nil, err
+	}
+	err = sjwtLabWritePEM(dirPath, manifest.CRLFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = SJWTWriteFileAtomic(filepath.Join(dirPath, "manifest.json"), data, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,80 @@
+package secsipid_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestBuildLabPKI(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-labpki")
+	defer os.RemoveAll(workDir)
+
+	manifest, err := secsipid.SJWTBuildLabPKI(secsipid.SJWTDefaultLabPKISpec(), workDir)
+	if err != nil {
+		t.Fatalf("failed to build lab PKI: %v", err)
+	}
+	leafPEM := func(name string, chain bool) []byte {
+		for _, leaf := range manifest.Leaves {
+			if leaf.Name == name {
+				fileName := leaf.CertFile
+				if chain {
+					fileName = leaf.ChainFile
+				}
+				data, _ := ioutil.ReadFile(path.Join(workDir, fileName))
+				return data
+			}
+		}
+		t.Fatalf("leaf not found: %s", name)
+		return nil
+	}
+
+	secsipid.SJWTLibOptSetS("CertCAFile", path.Join(workDir, manifest.CAFile))
+	defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+	secsipid.SJWTLibOptSetS("CertCAInter", path.Join(workDir, manifest.CAInterFile))
+	defer secsipid.SJWTLibOptSetS("CertCAInter", "")
+	secsipid.SJWTLibOptSetS("CertCRLFile", path.Join(workDir, manifest.CRLFile))
+	defer secsipid.SJWTLibOptSetS("CertCRLFile", "")
+	defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	t.Run("OK with leaf and intermediate CA file", func(t *testing.T) {
+		secsipid.SJWTLibOptSetN("CertVerify", 0b11101)
+		expect := expectate.Expect(t)
+		ret, err := secsipid.SJWTPubKeyVerify(leafPEM("sp1", false))
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("OK with chain file", func(t *testing.T) {
+		secsipid.SJWTLibOptSetN("CertVerify", 0b10101)
+		expect := expectate.Expect(t)
+		ret, err := secsipid.SJWTPubKeyVerify(leafPEM("sp2", true))
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("ErrCertRevoked with revoked leaf", func(t *testing.T) {
+		secsipid.SJWTLibOptSetN("CertVerify", 0b10101)
+		expect := expectate.Expect(t)
+		ret, _ := secsipid.SJWTPubKeyVerify(leafPEM("revoked", true))
+		expect(ret).ToBe(secsipid.SJWTRetErrCertRevoked)
+	})
+
+	t.Run("ErrCertExpired with expired leaf", func(t *testing.T) {
+		secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+		expect := expectate.Expect(t)
+		ret, _ := secsipid.SJWTPubKeyVerify(leafPEM("expired", true))
+		expect(ret).ToBe(secsipid.SJWTRetErrCertExpired)
+	})
+
+	t.Run("error with invalid leaf name", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		spec, _ := secsipid.SJWTParseLabPKISpec([]byte(`{"leaves":[{"name":"../sp","spc":"1001"}]}`))
+		_, err := secsipid.SJWTBuildLabPKI(spec, path.Join(workDir, "invalid"))
+		expect(err.Error()).ToBe(`invalid or duplicate leaf name: "../sp"`)
+	})
+}
@@ -0,0 +1,173 @@
+package secsipid
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SJWTLegacyIdentityResult - the outcome of verifying a RFC 4474 Identity
+// header (signature of the SIP message with the certificate from the
+// Identity-Info header)
+type SJWTLegacyIdentityResult struct {
+	Identity string `json:"identity"`
+	Info     string `json:"info,omitempty"`
+	Alg      string `json:"alg,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Ret      int    `json:"ret"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sjwtIsLegacyIdentity - true if the Identity header value is a RFC 4474
+// signature, which is a quoted base64 string
+func sjwtIsLegacyIdentity(identityVal string) bool {
+	return strings.HasPrefix(strings.TrimSpace(identityVal), "\"")
+}
+
+// sjwtSIPAddrSpec - return the addr-spec of a name-addr or addr-spec header
+// value, without display name and header parameters
+func sjwtSIPAddrSpec(value string) string {
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		value = value[start+1:]
+		if end := strings.IndexByte(value, '>'); end >= 0 {
+			return value[:end]
+		}
+		return value
+	}
+	if end := strings.IndexByte(value, ';'); end >= 0 {
+		value = value[:end]
+	}
+	return strings.TrimSpace(value)
+}
+
+// sjwtSIPURIHost - return the host part of the SIP URI, without port
+func sjwtSIPURIHost(uri string) string {
+	if idx := strings.IndexByte(uri, ':'); idx >= 0 {
+		uri = uri[idx+1:]
+	}
+	if idx := strings.LastIndexByte(uri, '@'); idx >= 0 {
+		uri = uri[idx+1:]
+	}
+	if end := strings.IndexAny(uri, ";?"); end >= 0 {
+		uri = uri[:end]
+	}
+	if host, _, err := net.SplitHostPort(uri); err == nil {
+		return host
+	}
+	return strings.Trim(uri, "[]")
+}
+
+// sjwtLegacyDigestString - build the digest string signed by RFC 4474
+// Identity (section 9): From and To addr-specs, Call-ID, CSeq, Date, Contact
+// addr-spec and the message body, separated by "|"
+func sjwtLegacyDigestString(msg *SJWTSIPMessage) string {
+	cseq := strings.Join(strings.Fields(msg.CSeq), " ")
+	contact := ""
+	if len(msg.Contact) > 0 {
+		contact = sjwtSIPAddrSpec(msg.Contact)
+	}
+	return sjwtSIPAddrSpec(msg.From) + "|" + sjwtSIPAddrSpec(msg.To) + "|" + msg.CallID + "|" +
+		cseq + "|" + msg.Date + "|" + contact + "|" + string(msg.Body)
+}
+
+// sjwtLegacyIdentityCount - the number of RFC 4474 Identity headers of the
+// SIP message
+func sjwtLegacyIdentityCount(msg *SJWTSIPMessage) int {
+	count := 0
+	for _, identityVal := range msg.Identity {
+		if sjwtIsLegacyIdentity(identityVal) {
+			count++
+		}
+	}
+	return count
+}
+
+// sjwtParseIdentityInfo - return the URI and the alg parameter of the
+// Identity-Info header
+func sjwtParseIdentityInfo(value string) (string, string, error) {
+	p := &sjwtIdentityParser{s: value}
+	p.skipSWS()
+	if p.pos >= len(p.s) || p.s[p.pos] != '<' {
+		return "", "", fmt.Errorf("invalid Identity-Info header")
+	}
+	uri, err := p.readParamValue("identity-info")
+	if err != nil {
+		return "", "", err
+	}
+	params, err := p.readParams("Identity-Info header")
+	if err != nil {
+		return "", "", err
+	}
+	return uri[1 : len(uri)-1], params["alg"], nil
+}
+
+// sjwtCheckLegacyIdentity - verify the RFC 4474 Identity header of the SIP
+// message: the signature over the digest string, with the certificate from
+// the Identity-Info URL, which has to be valid for the domain of From URI
+func sjwtCheckLegacyIdentity(msg *SJWTSIPMessage, identityVal string, timeoutVal int) (*SJWTLegacyIdentityResult, int, error) {
+	result := &SJWTLegacyIdentityResult{Identity: identityVal}
+	if sjwtLegacyIdentityCount(msg) > 1 {
+		return result, SJWTRetErrSIPHdrParse, fmt.Errorf("more than one RFC 4474 Identity header")
+	}
+	if len(msg.IdentityInfo) == 0 {
+		return result, SJWTRetErrSIPHdrInfo, fmt.Errorf("missing Identity-Info header")
+	}
+	if len(msg.IdentityInfo) > 1 {
+		return result, SJWTRetErrSIPHdrInfo, fmt.Errorf("more than one Identity-Info header")
+	}
+	info, alg, err := sjwtParseIdentityInfo(msg.IdentityInfo[0])
+	if err != nil {
+		return result, SJWTRetErrSIPHdrInfo, err
+	}
+	result.Info = info
+	result.Alg = alg
+	if len(alg) == 0 {
+		// default algorithm of RFC 4474
+		alg = "rsa-sha1"
+	}
+
+	var hashAlg crypto.Hash
+	var hashVal []byte
+	digestString := []byte(sjwtLegacyDigestString(msg))
+	switch strings.ToLower(alg) {
+	case "rsa-sha1":
+		if globalLibOptions.legacyIdentitySHA1 == 0 {
+			return result, SJWTRetErrSIPLegacyAlg, fmt.Errorf("Identity-Info alg not allowed: %s", alg)
+		}
+		sum := sha1.Sum(digestString)
+		hashAlg, hashVal = crypto.SHA1, sum[:]
+	case "rsa-sha256":
+		sum := sha256.Sum256(digestString)
+		hashAlg, hashVal = crypto.SHA256, sum[:]
+	default:
+		return result, SJWTRetErrSIPLegacyAlg, fmt.Errorf("unsupported Identity-Info alg: %s", alg)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(identityVal), "\""))
+	if err != nil {
+		return result, SJWTRetErrSIPHdrParse, fmt.Errorf("invalid legacy identity signature: %v", err)
+	}
+
+	cert, ret, err := sjwtGetVerifiedCertificate(info, timeoutVal)
+	if ret != SJWTRetOK {
+		return result, ret, err
+	}
+	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return result, SJWTRetErrCertInvalid, fmt.Errorf("not RSA public key")
+	}
+
+	result.Domain = sjwtSIPURIHost(sjwtSIPAddrSpec(msg.From))
+	if err = cert.VerifyHostname(result.Domain); err != nil {
+		return result, SJWTRetErrSIPLegacyDomain, fmt.Errorf("certificate not valid for From domain: %s", result.Domain)
+	}
+	if err = rsa.VerifyPKCS1v15(pubKey, hashAlg, hashVal, sig); err != nil {
+		return result, SJWTRetErrSIPLegacySignature, fmt.Errorf("invalid legacy identity signature")
+	}
+	return result, SJWTRetOK, nil
+}
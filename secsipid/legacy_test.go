@@ -0,0 +1,232 @@
+package secsipid_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// legacyTestCAPEM, legacyTestCertPEM - RSA CA and certificate for
+// example.com, generated with openssl and valid until 2126
+const legacyTestCAPEM = `-----BEGIN CERTIFICATE-----
+MIIDNzCCAh+gAwIBAgIUXfTwbhk63hxWehNdpkerhqRs95kwDQYJKoZIhvcNAQEL
+BQAwIjEgMB4GA1UEAwwXTGVnYWN5IElkZW50aXR5IFRlc3QgQ0EwIBcNMjYxMDE5
+MTYxMzIyWhgPMjEyNjA5MjUxNjEzMjJaMCIxIDAeBgNVBAMMF0xlZ2FjeSBJZGVu
+dGl0eSBUZXN0IENBMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjhM9
+jECTAHNho+7x+qmUd8EXReqwsXPJETVYO664VNdIbc7IMuTq2HP0Z8AVBZRj5U0V
+FoaVWxRJHsMuINdY9A9LBNqKPOA8v4lChZtSBXdww7rrhZ/mYdquisQ7baxMSj+G
+cDFwr9rCsYn1xyuOztgqmrtECbfRqFFn1lqj2QmpB8LA/l2JMBqK2KjNPVQ2jyvm
+n9rk/CY0NBQfncTxJYDChBpZzGR9ggwvZD1j0BRSiYchLRaK3QMy6tt7h0p4PL+d
+n+Yz43r3ncC28/JCUZfolZWyMf52zcnttxqN/AUPYuViAklBPeW7IKP/Qm8Y0ztT
+XSLNIVy/zB29D+K4kwIDAQABo2MwYTAdBgNVHQ4EFgQUoQt1ngHY9x4eylRUCEa7
+imuPkgcwHwYDVR0jBBgwFoAUoQt1ngHY9x4eylRUCEa7imuPkgcwDwYDVR0TAQH/
+BAUwAwEB/zAOBgNVHQ8BAf8EBAMCAQYwDQYJKoZIhvcNAQELBQADggEBAHlGxas4
+dTzOT/VXdkA8l+wsUuHFA8H9tciXudaZzvYIVA/7aH0boViETWKc/Onv0xOBvLvl
+1zd9NE9fV7geG9RBd2GkEJGcRKr0eTrw8bHku/rM4ZuIY7J6gW8Xl9683YeHOtz0
+Iryh++Lexo0NsFXFYtkpJfy6JkPEDDH5fLeJxlWDG1nHhw1SLpmRNF1YotMvxyRD
+1QmOr1rsGD65Tod2Zz/KvjLXqGg5WbARgNBgnWrwGuSBSW0CzbXy4LbrsDxJWnJS
+p5oxOmUyJjBzCb4AteRTaA+GiSYJLGK19qHGZBVhgW+VuDP2nlff9JuNSQUg8eTz
+UjLRkIS5exeT4N0=
+-----END CERTIFICATE-----
+`
+
+const legacyTestCertPEM = `-----BEGIN CERTIFICATE-----
+MIIDKjCCAhKgAwIBAgIBAjANBgkqhkiG9w0BAQsFADAiMSAwHgYDVQQDDBdMZWdh
+Y3kgSWRlbnRpdHkgVGVzdCBDQTAgFw0yNjEwMTkxNjEzMjJaGA8yMTI2MDkyNTE2
+MTMyMlowFjEUMBIGA1UEAwwLZXhhbXBsZS5jb20wggEiMA0GCSqGSIb3DQEBAQUA
+A4IBDwAwggEKAoIBAQC4LkXq85IoExZnuDDf9gLBHSoYvzG4PHTHy/qXfBGKVEI9
+GjmXqdeAFf6DgV7LMiynGnc/kgwakd6rJ9z84XCmMN4oNa096S/21O7zmcQ8tT7T
+6reP1xjmdl/ogIpmGN87tt4xXOvkvSSxQHcW5n5rzpl2zIFo9RMJo2Z/lgn5OttV
+Wrb7S0BZJrOKLJzlCx9QPuuSIDAqO5Hi5K/zdwdRxrIzls1KTcIPTxEnfcHrm7ts
+sraqoeGByDOT7Vnia9+YSJcJ3UP+tJouAGv0BuMYjbm7uT+ixhh12Xla7fPZv/dM
+3sXSACHS89YFoBEXWh7RcXbXwxyFiHdoZ/VZHS7dAgMBAAGjdTBzMBYGA1UdEQQP
+MA2CC2V4YW1wbGUuY29tMA4GA1UdDwEB/wQEAwIHgDAJBgNVHRMEAjAAMB0GA1Ud
+DgQWBBTLsTtTWDK4KZ3FYBtIncDchKZmGDAfBgNVHSMEGDAWgBShC3WeAdj3Hh7K
+VFQIRruKa4+SBzANBgkqhkiG9w0BAQsFAAOCAQEAdHTInZB6+GqY21pBW61X5mpr
+I4UUu/n3+Mb2s1uvVcoNm0KBlw9u5NS8DUxlIQr10ylDxng7OCS2Tz8pLgDykyjc
+dL/y9lk7AlMJyRu/aCYI89o7YECkRhrNduQNEd2BhXoqu608NW1GtS9F0PNBePy3
+iJSUMaH3aGaCKQIP7JIhfXlEILA8ul1t+MAV2tGIZ7+Ivmc00INYskQ+77UHCLyg
+WecaG2thA2A57L8nzmmqoIponNtkkQuCkh5rY0vNt4r64f36vtXKkTI9C4ZuAOOG
+o8Cr+AxQ0+XCgetlWvtzb1wH2rRvkLv8Nouxoy74c0agN1ga8hOsQvUa7SJopw==
+-----END CERTIFICATE-----
+`
+
+// legacyTestDigest - RFC 4474 digest string of the INVITE built by
+// newLegacyTestInvite() from example.com with the body "v=0\r\n"
+const legacyTestDigest = "sip:alice@example.com|sip:bob@biloxi.example.org|a84b4c76e66710|" +
+	"314159 INVITE|Thu, 21 Feb 2002 13:02:03 GMT|sip:alice@pc33.example.com|v=0\r\n"
+
+// legacyTestSigSHA256, legacyTestSigSHA1 - signatures of legacyTestDigest
+// with the key of legacyTestCertPEM, generated with openssl dgst -sign
+const legacyTestSigSHA256 = "GA0QIS/mppHd2KIGKFeXhSC1uaaKBnBd+cqZvOr9m1b9BW4c1OliqB5P8siqYURW" +
+	"v1MVMsiUaB9XybbP7hBUhb/mAdseALji40MdHlnOmA+MBkhPmJFR23otvHxM8md+" +
+	"Wlj/NgzdV5AYSrxqXEkkvjSqGxzw9abJnLHlD0NdzfKFuoOy20F5PZONXbkChi5h" +
+	"IlmyOGS+NSlksYzluLU3ELoUsXev1ES+pa8dskE8IQdQJorz+CKDkwN/lj+dLEzM" +
+	"+PepkMT1vTQzAHIqKbQSES6LoS5Hlf8miLiFASBopjnCkP2KAgd8ywqD41Xt8zOo" +
+	"K3AhMvigoA5mHVtTuN8yog=="
+
+const legacyTestSigSHA1 = "W6Opxx5uPtWYQMTUcr5w8S/McN5/24D0e+goEVKuCRiXF4fbpldu+bVfh1POg6nT" +
+	"3ZZ0aoYRb8ujfD9MwD6dyDWnYFXFB9yg2gVhh2ajixAZ1wSuJXUHSCsCATcbZfgo" +
+	"SRCcMbK6h37XieJ5qFMA4wkCOJVXRW9tP9YvwkNeWq+9d4x+FXu7HuZBf9T7L5Co" +
+	"g7bhNCE+wbnrQGiVChgQMx7Q60lFeBR9If9ma5hgeO1dm3bi9u8LLdJI5LBHQqbX" +
+	"wpNxdpkfruYA/9cwLvZzL1e/H/FwopUrsFBbxWJ/Oofqu3AKvRncQVZ42/Uqb84P" +
+	"3tGWxI5uGSmmEYvEwTHAug=="
+
+// newLegacyTestInvite - INVITE with RFC 4474 Identity and Identity-Info
+// headers, with the extra headers added before the body
+func newLegacyTestInvite(infoURL string, from string, body string, alg string, sig string, extraHeaders ...string) []byte {
+	headers := []string{
+		"INVITE sip:bob@biloxi.example.org SIP/2.0",
+		"From: Alice <sip:alice@" + from + ">;tag=1928301774",
+		"To: Bob <sip:bob@biloxi.example.org>",
+		"Call-ID: a84b4c76e66710",
+		"CSeq:  314159   INVITE",
+		"Date: Thu, 21 Feb 2002 13:02:03 GMT",
+		"m: <sip:alice@pc33.example.com>;expires=3600",
+		"Identity-Info: <" + infoURL + ">;alg=" + alg,
+		"Identity: \"" + sig + "\"",
+	}
+	headers = append(headers, extraHeaders...)
+	headers = append(headers, "Content-Length: 5", "", body)
+	return []byte(strings.Join(headers, "\r\n"))
+}
+
+func TestCheckLegacyIdentity(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-legacy")
+	defer os.RemoveAll(workDir)
+	caFile := filepath.Join(workDir, "ca.pem")
+	os.WriteFile(caFile, []byte(legacyTestCAPEM), 0640)
+
+	secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+	defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+	secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+	defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write([]byte(legacyTestCertPEM))
+	}))
+	defer server.Close()
+	infoURL := server.URL + "/example.com.pem"
+
+	t.Run("OK with signature of test digest", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		block, _ := pem.Decode([]byte(legacyTestCertPEM))
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		sig, _ := base64.StdEncoding.DecodeString(legacyTestSigSHA256)
+		hash := sha256.Sum256([]byte(legacyTestDigest))
+		expect(rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, hash[:], sig)).ToBe(nil)
+	})
+
+	t.Run("ErrSIPHdrParse when legacy identity is not enabled", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256)
+		result, ret, _ := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrParse)
+		expect(len(result.Results)).ToBe(1)
+		expect(len(result.Legacy)).ToBe(0)
+	})
+
+	secsipid.SJWTLibOptSetN("LegacyIdentity", 1)
+	defer secsipid.SJWTLibOptSetN("LegacyIdentity", 0)
+
+	t.Run("OK with valid legacy identity", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256)
+		result, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(len(result.Results)).ToBe(0)
+		expect(len(result.Legacy)).ToBe(1)
+		expect(result.Legacy[0].Info).ToBe(infoURL)
+		expect(result.Legacy[0].Alg).ToBe("rsa-sha256")
+		expect(result.Legacy[0].Domain).ToBe("example.com")
+	})
+
+	t.Run("ErrSIPLegacySignature with modified body", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=1\r\n", "rsa-sha256", legacyTestSigSHA256)
+		_, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPLegacySignature)
+		expect(getMsgFromErr(err)).ToBe("invalid legacy identity signature")
+	})
+
+	t.Run("ErrSIPLegacyDomain with From in other domain", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.net", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256)
+		result, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPLegacyDomain)
+		expect(getMsgFromErr(err)).ToBe("certificate not valid for From domain: example.net")
+		expect(result.Legacy[0].Ret).ToBe(secsipid.SJWTRetErrSIPLegacyDomain)
+	})
+
+	t.Run("ErrSIPLegacyAlg with rsa-sha1 not allowed", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha1", legacyTestSigSHA1)
+		_, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPLegacyAlg)
+		expect(getMsgFromErr(err)).ToBe("Identity-Info alg not allowed: rsa-sha1")
+	})
+
+	t.Run("OK with rsa-sha1 allowed", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTLibOptSetN("LegacyIdentitySHA1", 1)
+		defer secsipid.SJWTLibOptSetN("LegacyIdentitySHA1", 0)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha1", legacyTestSigSHA1)
+		_, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("ErrSIPHdrInfo with more than one Identity-Info header", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256,
+			"Identity-Info: <"+server.URL+"/other.pem>;alg=rsa-sha256")
+		_, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrInfo)
+		expect(getMsgFromErr(err)).ToBe("more than one Identity-Info header")
+	})
+
+	t.Run("ErrSIPHdrParse with more than one legacy Identity header", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg := newLegacyTestInvite(infoURL, "example.com", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256,
+			"Identity: \""+legacyTestSigSHA1+"\"")
+		result, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrParse)
+		expect(getMsgFromErr(err)).ToBe("more than one RFC 4474 Identity header")
+		expect(len(result.Legacy)).ToBe(2)
+	})
+
+	t.Run("OK with certificate from configured fetcher and key cache", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		staticURL := "https://certs.example.invalid/example.com.pem"
+		secsipid.SetURLFileCacheOptions("", 3600)
+		defer secsipid.SetURLFileCacheOptions("", 0)
+		secsipid.SJWTSetCertificateFetcher(secsipid.NewSJWTStaticFetcher(map[string][]byte{
+			staticURL: []byte(legacyTestCertPEM),
+		}))
+		defer secsipid.SJWTSetCertificateFetcher(nil)
+
+		msg := newLegacyTestInvite(staticURL, "example.com", "v=0\r\n", "rsa-sha256", legacyTestSigSHA256)
+		for i := 0; i < 2; i++ {
+			_, ret, err := secsipid.SJWTCheckSIPMessage(msg, 0, 5)
+			expect(err).ToBe(nil)
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+		}
+		info := secsipid.SJWTGetKeyCacheInfo()
+		expect(info.Misses).ToBe(1)
+		expect(info.Hits).ToBe(1)
+	})
+}
@@ -0,0 +1,135 @@
+package secsipid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// offlineManifestName - the name of the manifest file in a bundle directory
+const offlineManifestName = "manifest.json"
+
+// globalOfflineBundle - the certificates used instead of downloading them,
+// loaded from the bundle set with the `OfflineBundle` option
+var globalOfflineBundle = struct {
+	sync.RWMutex
+	fetcher *SJWTStaticFetcher
+}{}
+
+// sjwtOfflineManifestPath - the path of the manifest, given directly or as
+// the bundle directory
+func sjwtOfflineManifestPath(bundlePath string) string {
+	if fileInfo, err := os.Stat(bundlePath); err == nil && fileInfo.IsDir() {
+		return filepath.Join(bundlePath, offlineManifestName)
+	}
+	return bundlePath
+}
+
+// SJWTLoadOfflineBundle - load the certificates from a bundle, given as the
+// path to its directory (with a `manifest.json` file) or to the manifest;
+// the manifest is a JSON object mapping the x5u URLs to the files with the
+// certificates in PEM format, relative to the directory of the manifest
+func SJWTLoadOfflineBundle(bundlePath string) (*SJWTStaticFetcher, error) {
+	manifestPath := sjwtOfflineManifestPath(bundlePath)
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := make(map[string]string)
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid offline bundle manifest: %v", err)
+	}
+	certs := make(map[string][]byte, len(manifest))
+	for urlVal, fileName := range manifest {
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(filepath.Dir(manifestPath), fileName)
+		}
+		certData, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offline bundle certificate for %s: %v", urlVal, err)
+		}
+		certs[urlVal] = certData
+	}
+	return NewSJWTStaticFetcher(certs), nil
+}
+
+// sjwtSetOfflineBundle - load the bundle set with the `OfflineBundle` option,
+// an empty path disables the offline mode
+func sjwtSetOfflineBundle(bundlePath string) error {
+	var fetcher *SJWTStaticFetcher
+	if len(bundlePath) > 0 {
+		var err error
+		if fetcher, err = SJWTLoadOfflineBundle(bundlePath); err != nil {
+			return err
+		}
+	}
+	globalLibOptions.offlineBundle = bundlePath
+	globalOfflineBundle.Lock()
+	globalOfflineBundle.fetcher = fetcher
+	globalOfflineBundle.Unlock()
+	SJWTResetKeyCache()
+	return nil
+}
+
+// sjwtOfflineBundle - the certificates of the offline bundle, nil if the
+// offline mode is not enabled
+func sjwtOfflineBundle() *SJWTStaticFetcher {
+	globalOfflineBundle.RLock()
+	defer globalOfflineBundle.RUnlock()
+	return globalOfflineBundle.fetcher
+}
+
+// sjwtOfflineFetch - get the certificate from the offline bundle
+func sjwtOfflineFetch(bundle *SJWTStaticFetcher, urlVal string) ([]byte, time.Time, int, error) {
+	data, expires, ret, err := bundle.Fetch(urlVal, 0)
+	if ret == SJWTRetErrFetchNotFound {
+		return nil, time.Time{}, SJWTRetErrOfflineNotFound, fmt.Errorf("x5u not found in offline bundle: %s", urlVal)
+	}
+	return data, expires, ret, err
+}
+
+// SJWTBuildOfflineBundle - write to the bundle directory the valid cached
+// certificates from the cache directory, together with the manifest mapping
+// their URLs to the files; the cache files without URL (stored by older
+// versions) are skipped; return the number of certificates in the bundle
+func SJWTBuildOfflineBundle(cacheDir string, bundleDir string) (int, error) {
+	entries, err := SJWTListURLCache(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(bundleDir, 0750); err != nil {
+		return 0, err
+	}
+	manifest := make(map[string]string)
+	tnow := time.Now()
+	for _, entry := range entries {
+		if len(entry.URL) == 0 || len(entry.Error) > 0 || !tnow.Before(entry.NotAfter) {
+			continue
+		}
+		data, err := ioutil.ReadFile(entry.FilePath)
+		if err != nil {
+			return 0, err
+		}
+		fileName := filepath.Base(sjwtURLCacheFilePath("", entry.URL)) + ".pem"
+		if err = SJWTWriteFileAtomic(filepath.Join(bundleDir, fileName), data, 0640); err != nil {
+			return 0, err
+		}
+		manifest[entry.URL] = fileName
+	}
+	if len(manifest) == 0 {
+		return 0, errors.New("no valid certificates with URL in cache directory")
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err = SJWTWriteFileAtomic(filepath.Join(bundleDir, offlineManifestName), data, 0640); err != nil {
+		return 0, err
+	}
+	return len(manifest), nil
+}
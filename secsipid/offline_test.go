@@ -0,0 +1,73 @@
+package secsipid_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestOfflineBundle(t *testing.T) {
+	_, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	workDir, _ := os.MkdirTemp("", "secsipid-offline")
+	defer os.RemoveAll(workDir)
+	cacheDir := filepath.Join(workDir, "cache")
+	bundleDir := filepath.Join(workDir, "bundle")
+	os.Mkdir(cacheDir, 0750)
+
+	x5u := "https://certs.example.invalid/cert.pem"
+	secsipid.SetURLFileCacheOptions(cacheDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+	secsipid.SJWTSetURLCachedContent(x5u, certPEM)
+	secsipid.SJWTSetURLCachedContent("https://certs.example.invalid/bad.pem", []byte("not a certificate"))
+	secsipid.SetURLFileCacheOptions("", 3600)
+
+	t.Run("Err building bundle from empty cache directory", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		emptyDir := filepath.Join(workDir, "empty")
+		os.Mkdir(emptyDir, 0750)
+		n, err := secsipid.SJWTBuildOfflineBundle(emptyDir, filepath.Join(workDir, "other"))
+		expect(n).ToBe(0)
+		expect(getMsgFromErr(err)).ToBe("no valid certificates with URL in cache directory")
+	})
+
+	t.Run("OK building bundle from cache directory", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		n, err := secsipid.SJWTBuildOfflineBundle(cacheDir, bundleDir)
+		expect(err).ToBe(nil)
+		expect(n).ToBe(1)
+	})
+
+	t.Run("OK verifying with offline bundle", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		expect(secsipid.SJWTLibOptSetS("OfflineBundle", bundleDir)).ToBe(secsipid.SJWTRetOK)
+		defer secsipid.SJWTLibOptSetS("OfflineBundle", "")
+
+		identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", x5u, keyPEM)
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(getMsgFromErr(err)).ToBe("")
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("ErrOfflineNotFound with x5u missing from bundle", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		expect(secsipid.SJWTLibOptSetS("OfflineBundle", filepath.Join(bundleDir, "manifest.json"))).ToBe(secsipid.SJWTRetOK)
+		defer secsipid.SJWTLibOptSetS("OfflineBundle", "")
+
+		identity, _, _ := secsipid.SJWTGetIdentityPrvKey("12345", "67890", "A", "", "https://certs.example.invalid/other.pem", keyPEM)
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, 0, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrOfflineNotFound)
+		expect(getMsgFromErr(err)).ToBe("x5u not found in offline bundle: https://certs.example.invalid/other.pem")
+
+		data, ret, _ := secsipid.SJWTGetURLContent("https://certs.example.invalid/other.pem", 5)
+		expect(data == nil).ToBe(true)
+		expect(ret).ToBe(secsipid.SJWTRetErrOfflineNotFound)
+	})
+
+	t.Run("Err with invalid bundle", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		expect(secsipid.SJWTLibOptSetS("OfflineBundle", filepath.Join(workDir, "missing"))).ToBe(secsipid.SJWTRetErr)
+	})
+}
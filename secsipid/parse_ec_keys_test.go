@@ -10,8 +10,8 @@ import (
 	"encoding/pem"
 	"testing"
 
-	"github.com/asipto/secsipidx/secsipid"
 	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
 )
 
 type ParseECPrivateKeyTest struct {
@@ -14,8 +14,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/asipto/secsipidx/secsipid"
 	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
 )
 
 type PubKeyVerifyTest struct {
@@ -0,0 +1,179 @@
+package secsipid
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheRefreshTimeout - the timeout (in seconds) of the background downloads
+const cacheRefreshTimeout = 5
+
+// cacheRefreshMaxItems - the maximum number of URLs tracked for refreshing
+const cacheRefreshMaxItems = 4096
+
+// refreshItem - the accesses to the cached content of an URL since it was
+// fetched and the time when the content expires
+type refreshItem struct {
+	hits    int
+	expires time.Time
+}
+
+// cacheRefresher - the URLs tracked for refreshing before expiry, and the
+// background refreshing
+var cacheRefresher = struct {
+	sync.Mutex
+	items map[string]*refreshItem
+	stop  chan struct{}
+}{items: make(map[string]*refreshItem)}
+
+// sjwtRefreshTrack - count the access to the cached content of the URL; the
+// expire time is only moved forward, the parsed keys cache can report the
+// one of the content before it was refreshed
+func sjwtRefreshTrack(urlVal string, expires time.Time) {
+	if globalLibOptions.cacheRefreshAhead <= 0 {
+		return
+	}
+	if sjwtCacheStorage() == nil && len(globalLibOptions.cacheDirPath) == 0 {
+		return
+	}
+	cacheRefresher.Lock()
+	defer cacheRefresher.Unlock()
+	item, ok := cacheRefresher.items[urlVal]
+	if !ok {
+		if len(cacheRefresher.items) >= cacheRefreshMaxItems {
+			return
+		}
+		item = &refreshItem{}
+		cacheRefresher.items[urlVal] = item
+	}
+	item.hits++
+	if expires.After(item.expires) {
+		item.expires = expires
+	}
+}
+
+// SJWTRefreshCache - download again the cached content of the URLs accessed
+// at least `CacheRefreshMinHits` times that expire in less than
+// `CacheRefreshAhead` seconds; if the download fails, the cached content is
+// used further for `CacheRefreshAhead` seconds, as long as the certificate
+// is valid; return the number of refreshed URLs
+func SJWTRefreshCache() int {
+	ahead := time.Duration(globalLibOptions.cacheRefreshAhead) * time.Second
+	tnow := time.Now()
+	var due []string
+	cacheRefresher.Lock()
+	for urlVal, item := range cacheRefresher.items {
+		if item.expires.Before(tnow.Add(-ahead)) {
+			// not accessed since long time after expiry
+			delete(cacheRefresher.items, urlVal)
+			continue
+		}
+		if item.hits >= globalLibOptions.cacheRefreshMinHits && tnow.Before(item.expires) &&
+			item.expires.Sub(tnow) <= ahead {
+			item.hits = 0
+			due = append(due, urlVal)
+		}
+	}
+	cacheRefresher.Unlock()
+
+	refreshed := 0
+	for _, urlVal := range due {
+		_, expires, ret, _ := sjwtGuardedFetch(urlVal, urlVal, func() ([]byte, time.Time, int, error) {
+			if storage := sjwtCacheStorage(); storage != nil {
+				return sjwtFetchURLToStorage(storage, urlVal, cacheRefreshTimeout)
+			}
+			return sjwtFetchURLToCache(urlVal, cacheRefreshTimeout, true)
+		})
+		if ret != SJWTRetOK {
+			expires = sjwtRefreshExtend(urlVal, ahead)
+		} else {
+			refreshed++
+		}
+		if !expires.IsZero() {
+			cacheRefresher.Lock()
+			if item, ok := cacheRefresher.items[urlVal]; ok {
+				item.expires = expires
+			}
+			cacheRefresher.Unlock()
+		}
+	}
+	return refreshed
+}
+
+// sjwtRefreshExtend - keep using the cached content of the URL for the
+// interval, if it holds a certificate that is still valid; return the new
+// expire time, zero time if not extended
+func sjwtRefreshExtend(urlVal string, interval time.Duration) time.Time {
+	storage := sjwtCacheStorage()
+	var data []byte
+	var expires time.Time
+	if storage != nil {
+		data, expires, _ = storage.Get(urlVal)
+	} else {
+		data, expires, _ = sjwtGetCachedFileContent(SJWTGetURLCacheFilePath(urlVal))
+	}
+	if data == nil {
+		return time.Time{}
+	}
+	cert := sjwtParseLeafCertificate(data)
+	if cert == nil {
+		return time.Time{}
+	}
+	newExpires := time.Now().Add(interval)
+	if cert.NotAfter.Before(newExpires) {
+		newExpires = cert.NotAfter
+	}
+	if !newExpires.After(expires) {
+		return time.Time{}
+	}
+	if storage != nil {
+		storage.Set(urlVal, data, time.Until(newExpires))
+		return newExpires
+	}
+	filePath := SJWTGetURLCacheFilePath(urlVal)
+	meta := sjwtReadURLCacheMeta(filePath)
+	if meta == nil {
+		meta = &urlCacheMeta{URL: urlVal, Fetched: time.Now()}
+	}
+	meta.Expires = newExpires
+	if sjwtWriteURLCacheMeta(filePath, meta) != nil {
+		return time.Time{}
+	}
+	return newExpires
+}
+
+// sjwtSetCacheRefreshAhead - start, restart or stop (if ahead is 0) the
+// background refreshing of the cached content
+func sjwtSetCacheRefreshAhead(ahead int) {
+	cacheRefresher.Lock()
+	defer cacheRefresher.Unlock()
+	if cacheRefresher.stop != nil {
+		close(cacheRefresher.stop)
+		cacheRefresher.stop = nil
+	}
+	if ahead <= 0 {
+		cacheRefresher.items = make(map[string]*refreshItem)
+		return
+	}
+	// check a few times within the refresh interval, at most every minute
+	interval := time.Duration(ahead) * time.Second / 4
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Minute {
+		interval = time.Minute
+	}
+	stop := make(chan struct{})
+	cacheRefresher.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				SJWTRefreshCache()
+			}
+		}
+	}()
+}
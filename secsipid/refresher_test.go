@@ -0,0 +1,90 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestRefreshCache(t *testing.T) {
+	_, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	var downloads int32
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=2")
+		w.Write(certPEM)
+	}))
+	defer server.Close()
+
+	workDir, _ := os.MkdirTemp("", "secsipid-refresh")
+	defer os.RemoveAll(workDir)
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+	secsipid.SJWTLibOptSetN("CacheRefreshMinHits", 3)
+	defer secsipid.SJWTLibOptSetN("CacheRefreshMinHits", 10)
+	// the background refreshing runs only every minute, the test calls it
+	secsipid.SJWTLibOptSetN("CacheRefreshAhead", 3600)
+	defer secsipid.SJWTLibOptSetN("CacheRefreshAhead", 0)
+
+	secsipid.SJWTLibOptSetN("CertVerify", 0)
+	// the repeated checks are answered by the parsed keys cache
+	secsipid.SJWTLibOptSetN("CertMemCacheSize", 1024)
+	secsipid.SJWTResetKeyCache()
+	defer secsipid.SJWTResetKeyCache()
+
+	hotURL := server.URL + "/hot.pem"
+	coldURL := server.URL + "/cold.pem"
+	hotIdentity, _, _ := secsipid.SJWTGetIdentityPrvKey("15551234567", "15557654321", "A", "", hotURL, keyPEM)
+	coldIdentity, _, _ := secsipid.SJWTGetIdentityPrvKey("15551234567", "15557654321", "A", "", coldURL, keyPEM)
+	check := func(identity string) int {
+		ret, _ := secsipid.SJWTCheckFullIdentityURL(identity, 3600, 5)
+		return ret
+	}
+
+	t.Run("OK refreshing only the hot entries", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		for i := 0; i < 3; i++ {
+			expect(check(hotIdentity)).ToBe(secsipid.SJWTRetOK)
+		}
+		expect(check(coldIdentity)).ToBe(secsipid.SJWTRetOK)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(2))
+		expect(secsipid.SJWTGetKeyCacheInfo().Hits).ToBe(2)
+
+		expect(secsipid.SJWTRefreshCache()).ToBe(1)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(3))
+
+		// the hits are counted again after refreshing
+		expect(secsipid.SJWTRefreshCache()).ToBe(0)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(3))
+	})
+
+	t.Run("OK serving the cached certificate when refreshing fails", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		for i := 0; i < 3; i++ {
+			expect(check(hotIdentity)).ToBe(secsipid.SJWTRetOK)
+		}
+		atomic.StoreInt32(&failing, 1)
+		defer atomic.StoreInt32(&failing, 0)
+
+		expect(secsipid.SJWTRefreshCache()).ToBe(0)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(4))
+
+		// after the max-age of the response, the extended entry is still used
+		time.Sleep(2100 * time.Millisecond)
+		expect(check(hotIdentity)).ToBe(secsipid.SJWTRetOK)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(4))
+
+		expect(check(coldIdentity)).ToBe(secsipid.SJWTRetErrHTTPStatusCode)
+	})
+}
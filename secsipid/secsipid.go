@@ -4,18 +4,18 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
-	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -43,6 +43,7 @@ const (
 	SJWTRetErrCertReadCRLFile     = -111
 	SJWTRetErrCertRevoked         = -112
 	SJWTRetErrCertInvalidEC       = -114
+	SJWTRetErrCertAIAFetch        = -115
 	SJWTRetErrPrvKeyInvalid       = -151
 	SJWTRetErrPrvKeyInvalidFormat = -152
 	SJWTRetErrPrvKeyInvalidEC     = -152
@@ -59,17 +60,34 @@ const (
 	SJWTRetErrJSONSignatureSize     = -253
 	SJWTRetErrJSONSignatureFailure  = -254
 	// identity SIP header errors: -300..-399
-	SJWTRetErrSIPHdrParse = -301
-	SJWTRetErrSIPHdrAlg   = -302
-	SJWTRetErrSIPHdrPpt   = -303
-	SJWTRetErrSIPHdrInfo  = -303
-	SJWTRetErrSIPHdrEmpty = -304
+	SJWTRetErrSIPHdrParse        = -301
+	SJWTRetErrSIPHdrAlg          = -302
+	SJWTRetErrSIPHdrPpt          = -303
+	SJWTRetErrSIPHdrInfo         = -303
+	SJWTRetErrSIPHdrEmpty        = -304
+	SJWTRetErrSIPMsgParse        = -305
+	SJWTRetErrSIPHdrOrig         = -306
+	SJWTRetErrSIPHdrDest         = -307
+	SJWTRetErrSIPHdrDate         = -308
+	SJWTRetErrSIPLegacyAlg       = -309
+	SJWTRetErrSIPLegacySignature = -310
+	SJWTRetErrSIPLegacyDomain    = -311
 	// http and file operations errors: -400..-499
 	SJWTRetErrHTTPInvalidURL = -401
 	SJWTRetErrHTTPGet        = -402
 	SJWTRetErrHTTPStatusCode = -403
 	SJWTRetErrHTTPReadBody   = -404
-	SJWTRetErrFileRead       = -451
+	SJWTRetErrHTTPHostDown   = -405
+	// fetch policy errors
+	SJWTRetErrHTTPSchemeNotAllowed  = -406
+	SJWTRetErrHTTPHostNotAllowed    = -407
+	SJWTRetErrHTTPAddressNotAllowed = -408
+	SJWTRetErrHTTPBodyTooLarge      = -409
+	SJWTRetErrHTTPTooManyRedirects  = -410
+	SJWTRetErrHTTPContentType       = -411
+	SJWTRetErrFileRead              = -451
+	SJWTRetErrFetchNotFound         = -452
+	SJWTRetErrOfflineNotFound       = -453
 )
 
 // SJWTHeader - header for JWT
@@ -100,23 +118,73 @@ type SJWTPayload struct {
 }
 
 type SJWTLibOptions struct {
-	cacheDirPath string
-	cacheExpire  int
-	certCAFile   string
-	certCAInter  string
-	certCRLFile  string
-	certVerify   int
-	x5u          string
+	cacheDirPath         string
+	cacheStorage         string
+	offlineBundle        string
+	cacheExpire          int
+	cacheMaxSize         int
+	cacheCleanInterval   int
+	cacheRefreshAhead    int
+	cacheRefreshMinHits  int
+	certCAFile           string
+	certCAInter          string
+	certCRLFile          string
+	certCADir            string
+	certCATrustList      string
+	certReloadInterval   int
+	certVerify           int
+	certAIADepth         int
+	certAIATimeout       int
+	certMemCacheSize     int
+	negCacheExpire       int
+	negCacheStatusExpire int
+	hostBreakerThreshold int
+	hostBreakerOpenTime  int
+	urlRequireHTTPS      int
+	urlBlockPrivateIPs   int
+	urlAllowHosts        string
+	urlDenyHosts         string
+	urlMaxBodySize       int
+	urlMaxRedirects      int
+	urlContentTypes      string
+	legacyIdentity       int
+	legacyIdentitySHA1   int
+	x5u                  string
 }
 
 var globalLibOptions = SJWTLibOptions{
-	cacheDirPath: "",
-	cacheExpire:  3600,
-	certCAFile:   "",
-	certCAInter:  "",
-	certCRLFile:  "",
-	certVerify:   0,
-	x5u:          "https://127.0.0.1/cert.pem",
+	cacheDirPath:         "",
+	cacheStorage:         "",
+	offlineBundle:        "",
+	cacheExpire:          3600,
+	cacheMaxSize:         0,
+	cacheCleanInterval:   0,
+	cacheRefreshAhead:    0,
+	cacheRefreshMinHits:  10,
+	certCAFile:           "",
+	certCAInter:          "",
+	certCRLFile:          "",
+	certCADir:            "",
+	certCATrustList:      "",
+	certReloadInterval:   60,
+	certVerify:           0,
+	certAIADepth:         4,
+	certAIATimeout:       5,
+	certMemCacheSize:     1024,
+	negCacheExpire:       0,
+	negCacheStatusExpire: 0,
+	hostBreakerThreshold: 0,
+	hostBreakerOpenTime:  60,
+	urlRequireHTTPS:      0,
+	urlBlockPrivateIPs:   0,
+	urlAllowHosts:        "",
+	urlDenyHosts:         "",
+	urlMaxBodySize:       131072,
+	urlMaxRedirects:      10,
+	urlContentTypes:      "",
+	legacyIdentity:       0,
+	legacyIdentitySHA1:   0,
+	x5u:                  "https://127.0.0.1/cert.pem",
 }
 
 var (
@@ -136,6 +204,16 @@ func SJWTLibOptSetS(optname string, optval string) int {
 	case "CacheDirPath":
 		globalLibOptions.cacheDirPath = optval
 		return SJWTRetOK
+	case "CacheStorage":
+		if sjwtSetCacheStorageSpec(optval) != nil {
+			return SJWTRetErr
+		}
+		return SJWTRetOK
+	case "OfflineBundle":
+		if sjwtSetOfflineBundle(optval) != nil {
+			return SJWTRetErr
+		}
+		return SJWTRetOK
 	case "CertCAFile":
 		globalLibOptions.certCAFile = optval
 		return SJWTRetOK
@@ -145,6 +223,21 @@ func SJWTLibOptSetS(optname string, optval string) int {
 	case "CertCAInter":
 		globalLibOptions.certCAInter = optval
 		return SJWTRetOK
+	case "CertCADir":
+		globalLibOptions.certCADir = optval
+		return SJWTRetOK
+	case "CertCATrustList":
+		globalLibOptions.certCATrustList = optval
+		return SJWTRetOK
+	case "URLAllowHosts":
+		globalLibOptions.urlAllowHosts = optval
+		return SJWTRetOK
+	case "URLDenyHosts":
+		globalLibOptions.urlDenyHosts = optval
+		return SJWTRetOK
+	case "URLContentTypes":
+		globalLibOptions.urlContentTypes = optval
+		return SJWTRetOK
 	case "x5u":
 		globalLibOptions.x5u = optval
 		return SJWTRetOK
@@ -158,9 +251,65 @@ func SJWTLibOptSetN(optname string, optval int) int {
 	case "CacheExpires":
 		globalLibOptions.cacheExpire = optval
 		return SJWTRetOK
+	case "CacheMaxSize":
+		globalLibOptions.cacheMaxSize = optval
+		return SJWTRetOK
+	case "CacheCleanInterval":
+		globalLibOptions.cacheCleanInterval = optval
+		sjwtSetCacheCleanInterval(optval)
+		return SJWTRetOK
+	case "CacheRefreshAhead":
+		globalLibOptions.cacheRefreshAhead = optval
+		sjwtSetCacheRefreshAhead(optval)
+		return SJWTRetOK
+	case "CacheRefreshMinHits":
+		globalLibOptions.cacheRefreshMinHits = optval
+		return SJWTRetOK
 	case "CertVerify":
 		globalLibOptions.certVerify = optval
 		return SJWTRetOK
+	case "CertAIADepth":
+		globalLibOptions.certAIADepth = optval
+		return SJWTRetOK
+	case "CertAIATimeout":
+		globalLibOptions.certAIATimeout = optval
+		return SJWTRetOK
+	case "CertReloadInterval":
+		globalLibOptions.certReloadInterval = optval
+		return SJWTRetOK
+	case "CertMemCacheSize":
+		globalLibOptions.certMemCacheSize = optval
+		return SJWTRetOK
+	case "NegCacheExpire":
+		globalLibOptions.negCacheExpire = optval
+		return SJWTRetOK
+	case "NegCacheStatusExpire":
+		globalLibOptions.negCacheStatusExpire = optval
+		return SJWTRetOK
+	case "HostBreakerThreshold":
+		globalLibOptions.hostBreakerThreshold = optval
+		return SJWTRetOK
+	case "HostBreakerOpenTime":
+		globalLibOptions.hostBreakerOpenTime = optval
+		return SJWTRetOK
+	case "URLRequireHTTPS":
+		globalLibOptions.urlRequireHTTPS = optval
+		return SJWTRetOK
+	case "URLBlockPrivateIPs":
+		globalLibOptions.urlBlockPrivateIPs = optval
+		return SJWTRetOK
+	case "URLMaxBodySize":
+		globalLibOptions.urlMaxBodySize = optval
+		return SJWTRetOK
+	case "URLMaxRedirects":
+		globalLibOptions.urlMaxRedirects = optval
+		return SJWTRetOK
+	case "LegacyIdentity":
+		globalLibOptions.legacyIdentity = optval
+		return SJWTRetOK
+	case "LegacyIdentitySHA1":
+		globalLibOptions.legacyIdentitySHA1 = optval
+		return SJWTRetOK
 	}
 	return SJWTRetErr
 }
@@ -171,10 +320,14 @@ func SJWTLibOptSetV(optnameval string) int {
 	optName := optArray[0]
 	optVal := optArray[1]
 	switch optName {
-	case "CacheExpires", "CertVerify":
+	case "CacheExpires", "CacheMaxSize", "CacheCleanInterval", "CacheRefreshAhead",
+		"CacheRefreshMinHits", "CertVerify", "CertAIADepth", "CertAIATimeout", "CertReloadInterval", "CertMemCacheSize", "NegCacheExpire", "NegCacheStatusExpire", "HostBreakerThreshold",
+		"HostBreakerOpenTime", "URLRequireHTTPS", "URLBlockPrivateIPs", "URLMaxBodySize",
+		"URLMaxRedirects", "LegacyIdentity", "LegacyIdentitySHA1":
 		intVal, _ := strconv.Atoi(optVal)
 		return SJWTLibOptSetN(optName, intVal)
-	case "CacheDirPath", "CertCAFile", "CertCAInter", "CertCRLFile":
+	case "CacheDirPath", "CacheStorage", "OfflineBundle", "CertCAFile", "CertCAInter", "CertCRLFile",
+		"CertCADir", "CertCATrustList", "URLAllowHosts", "URLDenyHosts", "URLContentTypes":
 		return SJWTLibOptSetS(optName, optVal)
 	}
 	return SJWTRetErr
@@ -193,18 +346,44 @@ func SJWTRemoveWhiteSpaces(s string) string {
 
 // SJWTRemoveWhiteSpaces --
 func SJWTGetURLCacheFilePath(urlVal string) string {
+	return sjwtURLCacheFilePath(globalLibOptions.cacheDirPath, urlVal)
+}
+
+// sjwtURLCacheFilePath - path of the file in the cache directory for the URL,
+// named after the SHA-256 hash of the URL (the URL is stored in the metadata)
+func sjwtURLCacheFilePath(cacheDir string, urlVal string) string {
+	hash := sha256.Sum256([]byte(urlVal))
+	filePath := hex.EncodeToString(hash[:])
+	if len(cacheDir) > 0 {
+		filePath = cacheDir + "/" + filePath
+	}
+	return filePath
+}
+
+// sjwtLegacyURLCacheFilePath - path of the file in the cache directory for
+// the URL as named by older versions, replacing `://` and `/` with `_`
+func sjwtLegacyURLCacheFilePath(cacheDir string, urlVal string) string {
 	filePath := strings.Replace(urlVal, "://", "_", -1)
 	filePath = strings.Replace(filePath, "/", "_", -1)
-	if len(globalLibOptions.cacheDirPath) > 0 {
-		filePath = globalLibOptions.cacheDirPath + "/" + filePath
+	if len(cacheDir) > 0 {
+		filePath = cacheDir + "/" + filePath
 	}
 	return filePath
 }
 
 // SJWTPubKeyVerify -
 func SJWTPubKeyVerify(pubKey []byte) (int, error) {
+	_, ret, err := sjwtPubKeyVerify(pubKey)
+	return ret, err
+}
+
+// sjwtPubKeyVerify - verify the certificate and return also the time until
+// the outcome stays valid (the earliest of certificate expiry and CRL next
+// update), zero time if there is no limit
+func sjwtPubKeyVerify(pubKey []byte) (time.Time, int, error) {
+	var validUntil time.Time
 	if globalLibOptions.certVerify == 0 {
-		return SJWTRetOK, nil
+		return validUntil, SJWTRetOK, nil
 	}
 
 	var certVal *x509.Certificate
@@ -214,104 +393,69 @@ func SJWTPubKeyVerify(pubKey []byte) (int, error) {
 	var err error
 
 	// The public key may contain multiple intermediate certificates, we must
-	// parse those out and include them when doing the actual validation.
-	var toDecode = pubKey
-	var block *pem.Block
-	for true {
-		// Decode the next block in the public key. If there are no more blocks then
-		// this will return nil.
-		block, toDecode = pem.Decode(toDecode)
-		if block == nil {
-			break
-		}
-
-		// Parse the block as an x509 certificate.
-		blockCert, err := x509.ParseCertificate(block.Bytes)
-		if blockCert == nil {
-			return SJWTRetErrCertInvalidFormat, err
-		}
-
-		// If this was the first block then it represents the public certificate,
-		// otherwise it is an intermediate certificate.
-		if certVal == nil {
-			certVal = blockCert
-		} else {
-			certInter = append(certInter, blockCert)
-		}
-	}
-
-	if certVal == nil {
-		return SJWTRetErrCertInvalidFormat, errors.New("failed to parse certificate PEM")
+	// parse those out and include them when doing the actual validation. The
+	// first certificate represents the public certificate, the others are
+	// intermediate certificates.
+	certs, ret, err := SJWTParseCertificates(pubKey)
+	if ret != SJWTRetOK {
+		return validUntil, ret, err
 	}
+	certVal = certs[0]
+	certInter = certs[1:]
 
 	if (globalLibOptions.certVerify & (1 << 0)) != 0 {
 		if !time.Now().Before(certVal.NotAfter) {
-			return SJWTRetErrCertExpired, errors.New("certificate expired")
+			return validUntil, SJWTRetErrCertExpired, errors.New("certificate expired")
 		} else if !time.Now().After(certVal.NotBefore) {
-			return SJWTRetErrCertBeforeValidity, errors.New("certificate not valid yet")
+			return validUntil, SJWTRetErrCertBeforeValidity, errors.New("certificate not valid yet")
 		}
 	}
 
 	rootCAs = nil
 	interCAs = nil
-	if (globalLibOptions.certVerify & (1 << 1)) != 0 {
+	if (globalLibOptions.certVerify&(1<<1)) != 0 && (globalLibOptions.certVerify&(1<<2)) == 0 {
 		// Get the SystemCertPool
 		rootCAs, err = SystemCertPool()
 		if rootCAs == nil {
-			return SJWTRetErrCertProcessing, err
+			return validUntil, SJWTRetErrCertProcessing, err
 		}
 	}
 	if (globalLibOptions.certVerify & (1 << 2)) != 0 {
-		if len(globalLibOptions.certCAFile) <= 0 {
-			return SJWTRetErrCertNoCAFile, errors.New("no CA file")
+		if len(globalLibOptions.certCAFile) <= 0 && len(globalLibOptions.certCADir) <= 0 &&
+			len(globalLibOptions.certCATrustList) <= 0 {
+			return validUntil, SJWTRetErrCertNoCAFile, errors.New("no CA file")
 		}
 
+		// Get the root CAs from the trust store, together with the system CAs
+		// if they are enabled as well
+		var ret int
+		rootStore := sjwtGlobalRootStore((globalLibOptions.certVerify & (1 << 1)) != 0)
+		rootCAs, ret, err = rootStore.RootPool()
 		if rootCAs == nil {
-			rootCAs = x509.NewCertPool()
-			if rootCAs == nil {
-				return SJWTRetErrCertProcessing, errors.New("no new ca cert pool")
-			}
-		}
-		var certsCA []byte
-		// Read in the cert file
-		certsCA, err = ioutil.ReadFile(globalLibOptions.certCAFile)
-		if err != nil {
-			return SJWTRetErrCertReadCAFile, errors.New("failed to read CA file")
-		}
-
-		// Append our cert to the system pool
-		if ok := rootCAs.AppendCertsFromPEM(certsCA); !ok {
-			return SJWTRetErrCertProcessing, errors.New("failed to append CA file")
+			return validUntil, ret, err
 		}
 	}
+	var interStore []*x509.Certificate
 	if (globalLibOptions.certVerify & (1 << 3)) != 0 {
 		if len(globalLibOptions.certCAInter) <= 0 {
-			return SJWTRetErrCertNoCAInter, errors.New("no intermediate CA file")
-		}
-		interCAs = x509.NewCertPool()
-		if interCAs == nil {
-			return SJWTRetErrCertProcessing, errors.New("no new ca intermediate cert pool")
+			return validUntil, SJWTRetErrCertNoCAInter, errors.New("no intermediate CA file")
 		}
-		var certsCA []byte
-		// Read in the cert file
-		certsCA, err = ioutil.ReadFile(globalLibOptions.certCAInter)
-		if err != nil {
-			return SJWTRetErrCertReadCAInter, errors.New("failed to read intermediate CA file")
-		}
-
-		// Append our cert to the system pool
-		if ok := interCAs.AppendCertsFromPEM(certsCA); !ok {
-			return SJWTRetErrCertProcessing, errors.New("failed to append intermediate CA file")
+		var ret int
+		interStore, ret, err = sjwtGlobalInterStore().Intermediates()
+		if interStore == nil {
+			return validUntil, ret, err
 		}
 	}
 
-	// Append any intermediate certificates included in pubKey.
-	if len(certInter) > 0 {
+	// Build the intermediate pool with the certificates from the trust store
+	// and any intermediate certificates included in pubKey.
+	if len(interStore) > 0 || len(certInter) > 0 {
+		interCAs = x509.NewCertPool()
 		if interCAs == nil {
-			interCAs = x509.NewCertPool()
+			return validUntil, SJWTRetErrCertProcessing, errors.New("no new ca intermediate cert pool")
 		}
-		if interCAs == nil {
-			return SJWTRetErrCertProcessing, errors.New("no new ca intermediate cert pool")
+		for _, iCert := range interStore {
+			interCAs.AddCert(iCert)
 		}
 		// Append our certs
 		for _, iCert := range certInter {
@@ -326,12 +470,35 @@ func SJWTPubKeyVerify(pubKey []byte) (int, error) {
 	}
 
 	if _, err = certVal.Verify(opts); err != nil {
-		return SJWTRetErrCertInvalid, err
+		var uaErr x509.UnknownAuthorityError
+		if (globalLibOptions.certVerify&(1<<5)) == 0 || !errors.As(err, &uaErr) {
+			return validUntil, SJWTRetErrCertInvalid, err
+		}
+		// Try to download the missing intermediate certificates using the
+		// AIA caIssuers URLs and verify again.
+		var certAIA []*x509.Certificate
+		var ret int
+		certAIA, ret, err = SJWTCompleteChainAIA(certVal, append(append([]*x509.Certificate{}, interStore...), certInter...))
+		if ret != SJWTRetOK {
+			return validUntil, ret, err
+		}
+		if len(certAIA) == 0 {
+			return validUntil, SJWTRetErrCertInvalid, uaErr
+		}
+		if opts.Intermediates == nil {
+			opts.Intermediates = x509.NewCertPool()
+		}
+		for _, iCert := range certAIA {
+			opts.Intermediates.AddCert(iCert)
+		}
+		if _, err = certVal.Verify(opts); err != nil {
+			return validUntil, SJWTRetErrCertInvalid, err
+		}
 	}
 
 	if (globalLibOptions.certVerify & (1 << 4)) != 0 {
 		if len(globalLibOptions.certCRLFile) <= 0 {
-			return SJWTRetErrCertNoCRLFile, errors.New("no CRL file")
+			return validUntil, SJWTRetErrCertNoCRLFile, errors.New("no CRL file")
 		}
 		var rootCRL *pkix.CertificateList
 		rootCRL = nil
@@ -339,17 +506,24 @@ func SJWTPubKeyVerify(pubKey []byte) (int, error) {
 		// Read in the cert file
 		certsCRLData, err = ioutil.ReadFile(globalLibOptions.certCRLFile)
 		if err != nil {
-			return SJWTRetErrCertReadCRLFile, errors.New("failed to read CRL file")
+			return validUntil, SJWTRetErrCertReadCRLFile, errors.New("failed to read CRL file")
 		}
 		rootCRL, err = x509.ParseCRL(certsCRLData)
+		if err != nil {
+			return validUntil, SJWTRetErrCertReadCRLFile, errors.New("failed to parse CRL file")
+		}
+		validUntil = rootCRL.TBSCertList.NextUpdate
 		for _, revoked := range rootCRL.TBSCertList.RevokedCertificates {
 			if certVal.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
-				return SJWTRetErrCertRevoked, errors.New("serial number match - certificate is revoked")
+				return validUntil, SJWTRetErrCertRevoked, errors.New("serial number match - certificate is revoked")
 			}
 		}
 	}
 
-	return SJWTRetOK, nil
+	if validUntil.IsZero() || certVal.NotAfter.Before(validUntil) {
+		validUntil = certVal.NotAfter
+	}
+	return validUntil, SJWTRetOK, nil
 }
 
 // SJWTParseECPrivateKeyFromPEM Parse PEM encoded Elliptic Curve Private Key Structure
@@ -383,7 +557,19 @@ func SJWTParseECPublicKeyFromPEM(key []byte) (*ecdsa.PublicKey, int, error) {
 
 	var block *pem.Block
 	if block, _ = pem.Decode(key); block == nil {
-		return nil, SJWTRetErrCertInvalidFormat, errors.New("key must be PEM encoded")
+		// DER certificate or PKCS#7 bundle downloaded from x5u URL
+		certs, _, _ := SJWTParseCertificates(key)
+		if len(certs) == 0 {
+			return nil, SJWTRetErrCertInvalidFormat, errors.New("key must be PEM encoded")
+		}
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}
+	} else if block.Type == "PKCS7" || block.Type == "CMS" {
+		// PEM PKCS#7 bundle downloaded from x5u URL
+		certs, err := sjwtParsePKCS7Certificates(block.Bytes)
+		if err != nil {
+			return nil, SJWTRetErrCertInvalidFormat, err
+		}
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}
 	}
 
 	var parsedKey interface{}
@@ -441,66 +627,117 @@ func SJWTBase64DecodeBytes(seg string) ([]byte, error) {
 
 // SJWTGetURLCachedContent --
 func SJWTGetURLCachedContent(urlVal string) ([]byte, error) {
-	filePath := SJWTGetURLCacheFilePath(urlVal)
+	data, _, err := sjwtGetURLCachedContent(urlVal)
+	return data, err
+}
 
-	fileStat, err := os.Stat(filePath)
-	if err != nil {
-		return nil, err
+// SJWTSetURLCachedContent - store the content of the URL in the cache storage
+// or the cache directory, valid for the cache expire time; an error is
+// returned if the cache expire time is not positive, nothing is stored then
+func SJWTSetURLCachedContent(urlVal string, data []byte) error {
+	if globalLibOptions.cacheExpire <= 0 {
+		return fmt.Errorf("cache expire time not set: %d", globalLibOptions.cacheExpire)
 	}
-	tnow := time.Now()
-	if int(tnow.Sub(fileStat.ModTime()).Seconds()) > globalLibOptions.cacheExpire {
-		os.Remove(filePath)
-		return nil, nil
+	storage := sjwtCacheStorage()
+	if storage == nil {
+		storage = SJWTFileStorage{Dir: globalLibOptions.cacheDirPath}
 	}
-	return ioutil.ReadFile(filePath)
+	return storage.Set(urlVal, data, time.Duration(globalLibOptions.cacheExpire)*time.Second)
 }
 
-// SJWTSetURLCachedContent --
-func SJWTSetURLCachedContent(urlVal string, data []byte) error {
-	filePath := SJWTGetURLCacheFilePath(urlVal)
-
-	return ioutil.WriteFile(filePath, data, 0640)
+// SJWTDeleteURLCachedContent - remove the cached content of the URL from the
+// cache storage or the cache directory
+func SJWTDeleteURLCachedContent(urlVal string) error {
+	storage := sjwtCacheStorage()
+	if storage == nil {
+		storage = SJWTFileStorage{Dir: globalLibOptions.cacheDirPath}
+	}
+	return storage.Delete(urlVal)
 }
 
-// SJWTGetURLContent --
+// SJWTGetURLContent - get the content of the URL with the configured
+// certificate fetcher (by default, the URL cache and then HTTP download)
 func SJWTGetURLContent(urlVal string, timeoutVal int) ([]byte, int, error) {
-	if len(urlVal) == 0 {
-		return nil, SJWTRetErrHTTPInvalidURL, errors.New("no URL value")
+	data, _, ret, err := sjwtFetchCertificate(urlVal, timeoutVal)
+	return data, ret, err
+}
+
+// sjwtGetURLContent - get the content of the URL together with the time
+// until it can be used, based on the HTTP cache headers of the response
+func sjwtGetURLContent(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	if bundle := sjwtOfflineBundle(); bundle != nil {
+		return sjwtOfflineFetch(bundle, urlVal)
+	}
+	if ret, err := sjwtCheckFetchURL(urlVal); ret != SJWTRetOK {
+		return nil, time.Time{}, ret, err
 	}
 
-	if !(strings.HasPrefix(urlVal, "http://") || strings.HasPrefix(urlVal, "https://")) {
-		return nil, SJWTRetErrHTTPInvalidURL, errors.New("invalid URL value")
+	data, expires, ret, err := sjwtGetURLCachedOrFetch(urlVal, timeoutVal)
+	if ret == SJWTRetOK {
+		sjwtRefreshTrack(urlVal, expires)
+	}
+	return data, expires, ret, err
+}
+
+// sjwtGetURLCachedOrFetch - get the content of the URL from the cache or
+// download it
+func sjwtGetURLCachedOrFetch(urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	if storage := sjwtCacheStorage(); storage != nil {
+		// the storage failures are not fatal, the content is downloaded
+		if cdata, expires, _ := storage.Get(urlVal); cdata != nil {
+			return cdata, expires, SJWTRetOK, nil
+		}
+		return sjwtGuardedFetch(urlVal, urlVal, func() ([]byte, time.Time, int, error) {
+			return sjwtFetchURLToStorage(storage, urlVal, timeoutVal)
+		})
 	}
 
 	if len(globalLibOptions.cacheDirPath) > 0 {
-		cdata, cerr := SJWTGetURLCachedContent(urlVal)
+		cdata, expires, cerr := sjwtGetURLCachedContent(urlVal)
 		if cdata != nil {
-			return cdata, SJWTRetOK, cerr
+			return cdata, expires, SJWTRetOK, cerr
 		}
 	}
-	httpClient := http.Client{
-		Timeout: time.Duration(timeoutVal) * time.Second,
-	}
-	resp, err := httpClient.Get(urlVal)
-	if err != nil {
-		return nil, SJWTRetErrHTTPGet, fmt.Errorf("http get failure: %v", err)
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, SJWTRetErrHTTPStatusCode, fmt.Errorf("http status error: %v", resp.StatusCode)
+	return sjwtGuardedFetch(urlVal, urlVal, func() ([]byte, time.Time, int, error) {
+		return sjwtFetchURLToCache(urlVal, timeoutVal, false)
+	})
+}
+
+// sjwtCheckFetchURL - check that the URL is valid and allowed by the fetch
+// policy
+func sjwtCheckFetchURL(urlVal string) (int, error) {
+	if len(urlVal) == 0 {
+		return SJWTRetErrHTTPInvalidURL, errors.New("no URL value")
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, SJWTRetErrHTTPReadBody, fmt.Errorf("read http body failure: %v", err)
+	if !(strings.HasPrefix(urlVal, "http://") || strings.HasPrefix(urlVal, "https://")) {
+		return SJWTRetErrHTTPInvalidURL, errors.New("invalid URL value")
 	}
 
-	if len(globalLibOptions.cacheDirPath) > 0 {
-		SJWTSetURLCachedContent(urlVal, data)
+	return sjwtCheckURLPolicy(urlVal)
+}
+
+// sjwtGuardedFetch - run the download of the URL, failing fast for recently
+// failed URLs and for unreachable hosts; concurrent requests with the same
+// key wait for the first download
+func sjwtGuardedFetch(urlVal string, fetchKey string, fetchFunc func() ([]byte, time.Time, int, error)) ([]byte, time.Time, int, error) {
+	if ret, err := sjwtNegCacheGet(urlVal); ret != SJWTRetOK {
+		return nil, time.Time{}, ret, err
+	}
+	if ret, err := sjwtHostBreakerAllow(urlVal); ret != SJWTRetOK {
+		return nil, time.Time{}, ret, err
 	}
+	defer sjwtHostBreakerTrialEnd(urlVal)
 
-	return data, SJWTRetOK, nil
+	return sjwtFetchURLOnce(fetchKey, func() ([]byte, time.Time, int, error) {
+		data, expires, ret, err := fetchFunc()
+		sjwtHostBreakerResult(urlVal, ret, err)
+		if ret != SJWTRetOK {
+			sjwtNegCacheSet(urlVal, ret, err)
+		}
+		return data, expires, ret, err
+	})
 }
 
 // SJWTGetValidPayload --
@@ -671,6 +908,12 @@ func SJWTEncodeText(headerJSON string, payloadJSON string, prvkeyPath string) (s
 
 // SJWTCheckAttributes - implements the verify of attributes
 func SJWTCheckAttributes(bToken string, paramInfo string) (int, error) {
+	return sjwtCheckAttributesPpt(bToken, paramInfo, []string{"shaken"})
+}
+
+// sjwtCheckAttributesPpt - verify the attributes, accepting the PASSporT
+// types in ppts
+func sjwtCheckAttributesPpt(bToken string, paramInfo string, ppts []string) (int, error) {
 	vHeader, err := SJWTBase64DecodeString(bToken)
 
 	header := SJWTHeader{}
@@ -681,7 +924,7 @@ func SJWTCheckAttributes(bToken string, paramInfo string) (int, error) {
 	if len(header.Alg) > 0 && header.Alg != "ES256" {
 		return SJWTRetErrJSONHdrAlg, fmt.Errorf("invalid value for alg in json header")
 	}
-	if len(header.Ppt) > 0 && header.Ppt != "shaken" {
+	if len(header.Ppt) > 0 && !sjwtContainsFold(ppts, header.Ppt) {
 		return SJWTRetErrJSONHdrPpt, fmt.Errorf("invalid value for ppt in json header")
 	}
 	if len(header.Typ) > 0 && header.Typ != "passport" {
@@ -712,32 +955,37 @@ func SJWTCheckIdentityPKMode(identityVal string, expireVal int, pubkeyVal string
 		return ret, err
 	}
 
-	if pubkeyMode == 1 {
-		pubkey = []byte(pubkeyVal)
+	if pubkeyMode != 1 && (strings.HasPrefix(pubkeyVal, "http://") || strings.HasPrefix(pubkeyVal, "https://")) {
+		if ecdsaPubKey, ret, err = sjwtGetVerifiedPubKey(pubkeyVal, timeoutVal); err != nil {
+			return ret, err
+		}
 	} else {
-		if strings.HasPrefix(pubkeyVal, "http://") || strings.HasPrefix(pubkeyVal, "https://") {
-			pubkey, ret, err = SJWTGetURLContent(pubkeyVal, timeoutVal)
-		} else if strings.HasPrefix(pubkeyVal, "file://") {
-			fileUrl, _ := url.Parse(pubkeyVal)
-			pubkey, err = ioutil.ReadFile(fileUrl.Path)
-			ret = SJWTRetErrFileRead
+		if pubkeyMode == 1 {
+			pubkey = []byte(pubkeyVal)
 		} else {
-			pubkey, err = ioutil.ReadFile(pubkeyVal)
-			ret = SJWTRetErrFileRead
+			if strings.HasPrefix(pubkeyVal, "file://") {
+				fileUrl, _ := url.Parse(pubkeyVal)
+				pubkey, err = ioutil.ReadFile(fileUrl.Path)
+				ret = SJWTRetErrFileRead
+			} else {
+				pubkey, err = ioutil.ReadFile(pubkeyVal)
+				ret = SJWTRetErrFileRead
+			}
+			if err != nil {
+				return ret, err
+			}
 		}
-		if err != nil {
+
+		ret, err = SJWTPubKeyVerify(pubkey)
+		if ret != SJWTRetOK {
 			return ret, err
 		}
-	}
 
-	ret, err = SJWTPubKeyVerify(pubkey)
-	if ret != SJWTRetOK {
-		return ret, err
+		if ecdsaPubKey, ret, err = SJWTParseECPublicKeyFromPEM(pubkey); err != nil {
+			return ret, err
+		}
 	}
 
-	if ecdsaPubKey, ret, err = SJWTParseECPublicKeyFromPEM(pubkey); err != nil {
-		return ret, err
-	}
 	ret, err = SJWTVerifyWithPubKey(token[0]+"."+token[1], token[2], ecdsaPubKey)
 	if err == nil {
 		return SJWTRetOK, nil
@@ -751,33 +999,19 @@ func SJWTCheckIdentity(identityVal string, expireVal int, pubkeyPath string, tim
 	return SJWTCheckIdentityPKMode(identityVal, expireVal, pubkeyPath, 0, timeoutVal)
 }
 
-// SJWTGetValidInfoAttr - return info param value of alg and ppt are valid
+// SJWTGetValidInfoAttr - return info param value of alg and ppt are valid;
+// hdrtoken is the Identity header value split at ';'
+//
+// Deprecated: use SJWTParseIdentityHeader and SJWTCheckIdentityParams
 func SJWTGetValidInfoAttr(hdrtoken []string) (string, int, error) {
-	paramInfo := ""
-	for i := 1; i < len(hdrtoken); i++ {
-		ptoken := strings.Split(hdrtoken[i], "=")
-		if len(ptoken) == 2 {
-			if ptoken[0] == "alg" {
-				if ptoken[1] != "ES256" {
-					return "", SJWTRetErrSIPHdrAlg, fmt.Errorf("invalid value for alg header parameter")
-				}
-			} else if ptoken[0] == "ppt" {
-				if ptoken[1] != "shaken" && ptoken[1] != `"shaken"` {
-					return "", SJWTRetErrSIPHdrPpt, fmt.Errorf("invalid value for ppt header parameter")
-				}
-			} else if ptoken[0] == "info" {
-				paramInfo = ptoken[1]
-			}
-		}
-	}
-	if len(paramInfo) <= 2 {
-		return "", SJWTRetErrSIPHdrInfo, fmt.Errorf("invalid value info header parameter")
+	hdr, ret, err := SJWTParseIdentityHeader(strings.Join(hdrtoken, ";"))
+	if ret != SJWTRetOK {
+		return "", ret, err
 	}
-	if paramInfo[0] == '<' && paramInfo[len(paramInfo)-1] == '>' {
-		paramInfo = paramInfo[1 : len(paramInfo)-1]
+	if ret, err = SJWTCheckIdentityParams(hdr); ret != SJWTRetOK {
+		return "", ret, err
 	}
-
-	return paramInfo, SJWTRetOK, nil
+	return hdr.Info, SJWTRetOK, nil
 }
 
 // SJWTCheckFullIdentity - implements the verify of identity
@@ -786,118 +1020,130 @@ func SJWTCheckFullIdentity(identityVal string, expireVal int, pubkeyPath string,
 		return SJWTCheckFullIdentityURL(identityVal, expireVal, timeoutVal)
 	}
 
-	hdrtoken := strings.Split(SJWTRemoveWhiteSpaces(identityVal), ";")
+	hdr, ret, err := SJWTParseIdentityHeader(identityVal)
+	if ret != SJWTRetOK {
+		return ret, err
+	}
 
-	ret, err := SJWTCheckIdentity(hdrtoken[0], expireVal, pubkeyPath, timeoutVal)
+	ret, err = SJWTCheckIdentity(hdr.Token, expireVal, pubkeyPath, timeoutVal)
 	if ret != 0 {
 		return ret, err
 	}
 
-	if len(hdrtoken) == 1 {
-		return SJWTRetErrSIPHdrParse, nil
+	if !sjwtIdentityHasParams(hdr) {
+		return SJWTRetErrSIPHdrParse, fmt.Errorf("missing parts of the message header")
 	}
 
-	paramInfo := ""
-	paramInfo, ret, err = SJWTGetValidInfoAttr(hdrtoken)
-	if err != nil {
+	if ret, err = SJWTCheckIdentityParams(hdr); ret != SJWTRetOK {
 		return ret, err
 	}
 
-	btoken := strings.Split(strings.TrimSpace(hdrtoken[0]), ".")
+	btoken := strings.Split(hdr.Token, ".")
 
 	if len(btoken[0]) == 0 {
 		return SJWTRetErrJSONHdrParse, nil
 	}
-	return SJWTCheckAttributes(btoken[0], paramInfo)
+	return SJWTCheckAttributes(btoken[0], hdr.Info)
 }
 
 // SJWTCheckFullIdentityURL - implements the verify of identity using URL
 func SJWTCheckFullIdentityURL(identityVal string, expireVal int, timeoutVal int) (int, error) {
-	var ecdsaPubKey *ecdsa.PublicKey
-	var ret int
-	var err error
-	var pubkey []byte
-
-	hdrtoken := strings.Split(SJWTRemoveWhiteSpaces(identityVal), ";")
-
-	if len(hdrtoken) <= 1 {
-		return SJWTRetErrSIPHdrParse, fmt.Errorf("missing parts of the message header")
-	}
-
-	paramInfo := ""
-	paramInfo, ret, err = SJWTGetValidInfoAttr(hdrtoken)
-	if err != nil {
+	hdr, ret, err := SJWTParseIdentityHeader(identityVal)
+	if ret != SJWTRetOK {
 		return ret, err
 	}
 
-	pubkey, ret, err = SJWTGetURLContent(paramInfo, timeoutVal)
+	_, ret, err = sjwtCheckIdentityHeaderURL(hdr, expireVal, timeoutVal, []string{"shaken"})
+	return ret, err
+}
 
-	if pubkey == nil {
-		return ret, err
+// sjwtCheckIdentityHeaderURL - verify the parsed Identity header using the
+// certificate from the info URL, accepting the PASSporT types in ppts;
+// return also the payload of the PASSporT
+func sjwtCheckIdentityHeaderURL(hdr *SJWTIdentityHeader, expireVal int, timeoutVal int, ppts []string) (*SJWTPayload, int, error) {
+	var ecdsaPubKey *ecdsa.PublicKey
+
+	if !sjwtIdentityHasParams(hdr) {
+		return nil, SJWTRetErrSIPHdrParse, fmt.Errorf("missing parts of the message header")
 	}
 
-	ret, err = SJWTPubKeyVerify(pubkey)
+	ret, err := sjwtCheckIdentityParamsPpt(hdr, ppts)
 	if ret != SJWTRetOK {
-		return ret, err
+		return nil, ret, err
+	}
+	if len(hdr.Ppt) > 0 {
+		// the ppt of the PASSporT must match the header parameter
+		ppts = []string{hdr.Ppt}
 	}
 
-	if ecdsaPubKey, ret, err = SJWTParseECPublicKeyFromPEM(pubkey); err != nil {
-		return ret, err
+	ecdsaPubKey, ret, err = sjwtGetVerifiedPubKey(hdr.Info, timeoutVal)
+	if ecdsaPubKey == nil {
+		return nil, ret, err
 	}
 
-	btoken := strings.Split(strings.TrimSpace(hdrtoken[0]), ".")
+	btoken := strings.Split(hdr.Token, ".")
 
 	if len(btoken) != 3 {
-		return SJWTRetErrSIPHdrParse, fmt.Errorf("invalid token - must contain header, payload and signature")
+		return nil, SJWTRetErrSIPHdrParse, fmt.Errorf("invalid token - must contain header, payload and signature")
 	}
 
 	if len(btoken[0]) == 0 {
-		return SJWTRetErrSIPHdrParse, fmt.Errorf("no json header part")
+		return nil, SJWTRetErrSIPHdrParse, fmt.Errorf("no json header part")
 	}
 
 	var payload *SJWTPayload
 	payload, ret, err = SJWTGetValidPayload(btoken[1], expireVal)
 	if payload == nil || err != nil {
-		return ret, err
+		return nil, ret, err
 	}
 
 	ret, err = SJWTVerifyWithPubKey(btoken[0]+"."+btoken[1], btoken[2], ecdsaPubKey)
 	if err != nil {
-		return ret, err
+		return nil, ret, err
 	}
 
-	return SJWTCheckAttributes(btoken[0], paramInfo)
+	ret, err = sjwtCheckAttributesPpt(btoken[0], hdr.Info, ppts)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	return payload, SJWTRetOK, nil
 }
 
 // SJWTCheckFullIdentityPubKey - implements the verify of identity using public key
 func SJWTCheckFullIdentityPubKey(identityVal string, expireVal int, pubkeyVal string) (int, error) {
-	hdrtoken := strings.Split(SJWTRemoveWhiteSpaces(identityVal), ";")
+	hdr, ret, err := SJWTParseIdentityHeader(identityVal)
+	if ret != SJWTRetOK {
+		return ret, err
+	}
 
-	ret, err := SJWTCheckIdentityPKMode(hdrtoken[0], expireVal, pubkeyVal, 1, 5)
+	ret, err = SJWTCheckIdentityPKMode(hdr.Token, expireVal, pubkeyVal, 1, 5)
 	if ret != 0 {
 		return ret, err
 	}
 
-	if len(hdrtoken) == 1 {
+	if !sjwtIdentityHasParams(hdr) {
 		return SJWTRetOK, nil
 	}
 
-	paramInfo := ""
-	paramInfo, ret, err = SJWTGetValidInfoAttr(hdrtoken)
-	if err != nil {
+	if ret, err = SJWTCheckIdentityParams(hdr); ret != SJWTRetOK {
 		return ret, err
 	}
 
-	btoken := strings.Split(strings.TrimSpace(hdrtoken[0]), ".")
+	btoken := strings.Split(hdr.Token, ".")
 
 	if len(btoken[0]) == 0 {
 		return SJWTRetOK, nil
 	}
-	return SJWTCheckAttributes(btoken[0], paramInfo)
+	return SJWTCheckAttributes(btoken[0], hdr.Info)
 }
 
 // SJWTGetIdentityPrvKey --
 func SJWTGetIdentityPrvKey(origTN string, destTN string, attestVal string, origID string, x5uVal string, prvkeyData []byte) (string, int, error) {
+	return sjwtGetIdentityPrvKeyIAT(origTN, destTN, attestVal, origID, x5uVal, prvkeyData, time.Now().Unix())
+}
+
+// sjwtGetIdentityPrvKeyIAT - build the identity with the given iat
+func sjwtGetIdentityPrvKeyIAT(origTN string, destTN string, attestVal string, origID string, x5uVal string, prvkeyData []byte, iat int64) (string, int, error) {
 	var ret int
 	var err error
 	var vOrigID string
@@ -923,7 +1169,7 @@ func SJWTGetIdentityPrvKey(origTN string, destTN string, attestVal string, origI
 		Dest: SJWTDest{
 			TN: []string{destTN},
 		},
-		IAT: time.Now().Unix(),
+		IAT: iat,
 		Orig: SJWTOrig{
 			TN: origTN,
 		},
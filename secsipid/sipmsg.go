@@ -0,0 +1,384 @@
+package secsipid
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SJWTSIPMessage - the parts of a SIP request used for verifying the identity
+type SJWTSIPMessage struct {
+	Method     string   `json:"method"`
+	RequestURI string   `json:"requestURI"`
+	From       string   `json:"from,omitempty"`
+	To         string   `json:"to,omitempty"`
+	PAI        []string `json:"pai,omitempty"`
+	Date       string   `json:"date,omitempty"`
+	Identity   []string `json:"identity,omitempty"`
+	// the headers used only by the RFC 4474 legacy identity
+	CallID       string   `json:"callID,omitempty"`
+	CSeq         string   `json:"cseq,omitempty"`
+	Contact      string   `json:"contact,omitempty"`
+	IdentityInfo []string `json:"identityInfo,omitempty"`
+	Body         []byte   `json:"-"`
+}
+
+// SJWTIdentityResult - the outcome of verifying one Identity header of a SIP
+// message
+type SJWTIdentityResult struct {
+	Identity string `json:"identity"`
+	Ppt      string `json:"ppt,omitempty"`
+	Info     string `json:"info,omitempty"`
+	OrigTN   string `json:"origTN,omitempty"`
+	Ret      int    `json:"ret"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SJWTSIPCheckResult - the outcome of verifying all the Identity headers of a
+// SIP message, Ret is SJWTRetOK only if all of them are valid; the RFC 4474
+// Identity headers are in Legacy, if the `LegacyIdentity` option is set
+type SJWTSIPCheckResult struct {
+	Message *SJWTSIPMessage            `json:"message"`
+	Results []SJWTIdentityResult       `json:"results"`
+	Legacy  []SJWTLegacyIdentityResult `json:"legacy,omitempty"`
+	Ret     int                        `json:"ret"`
+}
+
+// sjwtSplitHeaderValues - split the comma-joined header values, ignoring the
+// commas inside quoted strings and angle brackets
+func sjwtSplitHeaderValues(value string) []string {
+	var values []string
+	quoted := false
+	inURI := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '<':
+			inURI = true
+		case !quoted && c == '>':
+			inURI = false
+		case !quoted && !inURI && c == ',':
+			if v := strings.TrimSpace(value[start:i]); len(v) > 0 {
+				values = append(values, v)
+			}
+			start = i + 1
+		}
+	}
+	if v := strings.TrimSpace(value[start:]); len(v) > 0 {
+		values = append(values, v)
+	}
+	return values
+}
+
+// sjwtSIPSplitMessage - split the SIP message in the header section and the
+// body, returning also the line ending; keep-alive empty lines can precede
+// the message
+func sjwtSIPSplitMessage(data []byte) (string, string, string) {
+	text := strings.TrimLeft(string(data), "\r\n")
+	eol := "\n"
+	if strings.Contains(text, "\r\n") {
+		eol = "\r\n"
+	}
+	if idx := strings.Index(text, eol+eol); idx >= 0 {
+		return text[:idx], text[idx+2*len(eol):], eol
+	}
+	return text, "", eol
+}
+
+// SJWTParseSIPMessage - parse the request line and the headers of a SIP
+// request, collecting the Identity (also in compact form and comma-joined),
+// From, To, P-Asserted-Identity and Date headers, as well as the ones used
+// by the RFC 4474 legacy identity
+func SJWTParseSIPMessage(data []byte) (*SJWTSIPMessage, int, error) {
+	head, body, eol := sjwtSIPSplitMessage(data)
+	lines := strings.Split(head, eol)
+
+	reqLine := strings.Fields(lines[0])
+	if len(reqLine) != 3 || !strings.HasPrefix(reqLine[2], "SIP/") {
+		return nil, SJWTRetErrSIPMsgParse, fmt.Errorf("invalid SIP request line: %q", lines[0])
+	}
+	msg := &SJWTSIPMessage{Method: reqLine[0], RequestURI: reqLine[1], Body: []byte(body)}
+
+	// unfold the header lines continued with white space
+	var headers []string
+	for _, line := range lines[1:] {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	for _, header := range headers {
+		idx := strings.IndexByte(header, ':')
+		if idx <= 0 {
+			return nil, SJWTRetErrSIPMsgParse, fmt.Errorf("invalid SIP header line: %q", header)
+		}
+		name := strings.ToLower(strings.TrimSpace(header[:idx]))
+		value := strings.TrimSpace(header[idx+1:])
+		switch name {
+		case "identity", "y":
+			msg.Identity = append(msg.Identity, sjwtSplitHeaderValues(value)...)
+		case "from", "f":
+			if len(msg.From) == 0 {
+				msg.From = value
+			}
+		case "to", "t":
+			if len(msg.To) == 0 {
+				msg.To = value
+			}
+		case "p-asserted-identity":
+			msg.PAI = append(msg.PAI, sjwtSplitHeaderValues(value)...)
+		case "date":
+			if len(msg.Date) == 0 {
+				msg.Date = value
+			}
+		case "call-id", "i":
+			msg.CallID = value
+		case "cseq":
+			msg.CSeq = value
+		case "contact", "m":
+			if len(msg.Contact) == 0 {
+				msg.Contact = value
+			}
+		case "identity-info", "n":
+			msg.IdentityInfo = append(msg.IdentityInfo, sjwtSplitHeaderValues(value)...)
+		}
+	}
+	return msg, SJWTRetOK, nil
+}
+
+// sjwtSIPTelNumber - return the telephone number (digits only) from the
+// name-addr or addr-spec of a header, or from a SIP or tel URI, empty if the
+// user part is not a telephone number
+func sjwtSIPTelNumber(value string) string {
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		value = value[start+1:]
+		if end := strings.IndexByte(value, '>'); end >= 0 {
+			value = value[:end]
+		}
+	}
+	lower := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(lower, "tel:"):
+		value = value[4:]
+	case strings.HasPrefix(lower, "sip:"):
+		value = value[4:]
+	case strings.HasPrefix(lower, "sips:"):
+		value = value[5:]
+	default:
+		return ""
+	}
+	if end := strings.IndexAny(value, "@;?>"); end >= 0 {
+		value = value[:end]
+	}
+	return sjwtNormalizeTN(value)
+}
+
+// sjwtNormalizeTN - return the digits of the telephone number, without the
+// leading '+' and the visual separators, empty if it is not a number
+func sjwtNormalizeTN(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= '0' && c <= '9':
+			sb.WriteByte(c)
+		case c == '+' && i == 0, c == '-', c == '.', c == '(', c == ')':
+		default:
+			return ""
+		}
+	}
+	return sb.String()
+}
+
+// sjwtMatchTN - true if the telephone number is in the list of numbers; also
+// true if there is no number to compare with (the headers have no TN)
+func sjwtMatchTN(tn string, numbers []string) bool {
+	matched := true
+	for _, number := range numbers {
+		if len(number) == 0 {
+			continue
+		}
+		if number == sjwtNormalizeTN(tn) {
+			return true
+		}
+		matched = false
+	}
+	return matched
+}
+
+// sjwtCheckSIPPayload - check the claims of the PASSporT against the headers
+// of the SIP message: the orig TN against P-Asserted-Identity and From, the
+// dest TN against To and Request-URI and iat against Date
+func sjwtCheckSIPPayload(msg *SJWTSIPMessage, payload *SJWTPayload, expireVal int) (int, error) {
+	if len(payload.Orig.TN) > 0 {
+		numbers := []string{sjwtSIPTelNumber(msg.From)}
+		for _, pai := range msg.PAI {
+			numbers = append(numbers, sjwtSIPTelNumber(pai))
+		}
+		if !sjwtMatchTN(payload.Orig.TN, numbers) {
+			return SJWTRetErrSIPHdrOrig, fmt.Errorf("orig tn not matching From or P-Asserted-Identity")
+		}
+	}
+	if len(payload.Dest.TN) > 0 {
+		numbers := []string{sjwtSIPTelNumber(msg.To), sjwtSIPTelNumber(msg.RequestURI)}
+		matched := false
+		for _, tn := range payload.Dest.TN {
+			if sjwtMatchTN(tn, numbers) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return SJWTRetErrSIPHdrDest, fmt.Errorf("dest tn not matching To or Request-URI")
+		}
+	}
+	if len(msg.Date) > 0 {
+		date, err := http.ParseTime(msg.Date)
+		if err != nil {
+			return SJWTRetErrSIPHdrDate, fmt.Errorf("invalid Date header: %v", err)
+		}
+		diff := date.Sub(time.Unix(payload.IAT, 0))
+		if diff < 0 {
+			diff = -diff
+		}
+		if expireVal > 0 && diff > time.Duration(expireVal)*time.Second {
+			return SJWTRetErrSIPHdrDate, fmt.Errorf("iat not matching Date header")
+		}
+	}
+	return SJWTRetOK, nil
+}
+
+// SJWTCheckSIPMessage - verify all the Identity headers of a SIP request
+// (SHAKEN and diversion PASSporTs), using the certificates from their info
+// URLs, and check their claims against From, P-Asserted-Identity, To,
+// Request-URI and Date headers; with the `LegacyIdentity` option set, the
+// RFC 4474 Identity headers are verified as well; return the results per
+// Identity header and the combined verdict, which is the outcome of the
+// first failed header
+func SJWTCheckSIPMessage(data []byte, expireVal int, timeoutVal int) (*SJWTSIPCheckResult, int, error) {
+	msg, ret, err := SJWTParseSIPMessage(data)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	result := &SJWTSIPCheckResult{Message: msg, Ret: SJWTRetOK}
+	if len(msg.Identity) == 0 {
+		result.Ret = SJWTRetErrSIPHdrEmpty
+		return result, result.Ret, fmt.Errorf("no identity header in SIP message")
+	}
+
+	var firstErr error
+	for _, identityVal := range msg.Identity {
+		if globalLibOptions.legacyIdentity != 0 && sjwtIsLegacyIdentity(identityVal) {
+			legacy, ret, err := sjwtCheckLegacyIdentity(msg, identityVal, timeoutVal)
+			legacy.Ret = ret
+			if err != nil {
+				legacy.Error = err.Error()
+			}
+			if ret != SJWTRetOK && result.Ret == SJWTRetOK {
+				result.Ret = ret
+				firstErr = err
+			}
+			result.Legacy = append(result.Legacy, *legacy)
+			continue
+		}
+		item := SJWTIdentityResult{Identity: identityVal}
+		hdr, ret, err := SJWTParseIdentityHeader(identityVal)
+		if ret == SJWTRetOK {
+			item.Ppt = hdr.Ppt
+			item.Info = hdr.Info
+			var payload *SJWTPayload
+			payload, ret, err = sjwtCheckIdentityHeaderURL(hdr, expireVal, timeoutVal, []string{"shaken", "div"})
+			if ret == SJWTRetOK {
+				item.OrigTN = payload.Orig.TN
+				ret, err = sjwtCheckSIPPayload(msg, payload, expireVal)
+			}
+		}
+		item.Ret = ret
+		if err != nil {
+			item.Error = err.Error()
+		}
+		if ret != SJWTRetOK && result.Ret == SJWTRetOK {
+			result.Ret = ret
+			firstErr = err
+		}
+		result.Results = append(result.Results, item)
+	}
+	return result, result.Ret, firstErr
+}
+
+// sjwtSIPInsertHeaders - return the SIP message with the Date headers
+// replaced and the new headers added at the end of the header section,
+// keeping the line endings and the body
+func sjwtSIPInsertHeaders(data []byte, newHeaders []string) []byte {
+	head, body, eol := sjwtSIPSplitMessage(data)
+
+	var lines []string
+	skipping := false
+	for _, line := range strings.Split(head, eol) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !skipping {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		skipping = false
+		if idx := strings.IndexByte(line, ':'); idx > 0 &&
+			strings.EqualFold(strings.TrimSpace(line[:idx]), "date") {
+			skipping = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, newHeaders...)
+	return []byte(strings.Join(lines, eol) + eol + eol + body)
+}
+
+// SJWTSignSIPMessage - build the SHAKEN Identity header for a SIP request and
+// return the request with it inserted, together with an updated Date header
+// matching the iat claim; the orig TN is taken from the first
+// P-Asserted-Identity with a telephone number or else from From header, the
+// dest TN from To header or else from Request-URI, both canonicalized to
+// digits only
+func SJWTSignSIPMessage(data []byte, attestVal string, origID string, x5uVal string, prvkeyData []byte) ([]byte, int, error) {
+	msg, ret, err := SJWTParseSIPMessage(data)
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+
+	origTN := ""
+	for _, pai := range msg.PAI {
+		if origTN = sjwtSIPTelNumber(pai); len(origTN) > 0 {
+			break
+		}
+	}
+	if len(origTN) == 0 {
+		origTN = sjwtSIPTelNumber(msg.From)
+	}
+	if len(origTN) == 0 {
+		return nil, SJWTRetErrSIPHdrOrig, fmt.Errorf("no telephone number in P-Asserted-Identity or From")
+	}
+	destTN := sjwtSIPTelNumber(msg.To)
+	if len(destTN) == 0 {
+		destTN = sjwtSIPTelNumber(msg.RequestURI)
+	}
+	if len(destTN) == 0 {
+		return nil, SJWTRetErrSIPHdrDest, fmt.Errorf("no telephone number in To or Request-URI")
+	}
+
+	tnow := time.Now()
+	identityVal, ret, err := sjwtGetIdentityPrvKeyIAT(origTN, destTN, attestVal, origID, x5uVal, prvkeyData, tnow.Unix())
+	if ret != SJWTRetOK {
+		return nil, ret, err
+	}
+	return sjwtSIPInsertHeaders(data, []string{
+		"Date: " + tnow.UTC().Format(http.TimeFormat),
+		"Identity: " + identityVal,
+	}), SJWTRetOK, nil
+}
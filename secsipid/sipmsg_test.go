@@ -0,0 +1,154 @@
+package secsipid_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// newSIPTestInvite - INVITE from 12155550111 to 12155550122, diverted to
+// 12155550133, with the given extra header lines
+func newSIPTestInvite(headers ...string) []byte {
+	lines := []string{
+		"INVITE sip:+12155550133@sbc.example.com;user=phone SIP/2.0",
+		"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK776asdhds",
+		"f: \"Alice\" <sip:+12155550111@example.com;user=phone>;tag=1928301774",
+		"To: <tel:+1-215-555-0122>",
+		"Call-ID: a84b4c76e66710@pc33.example.com",
+		"CSeq: 314159 INVITE",
+		"Date: " + time.Now().UTC().Format(http.TimeFormat),
+	}
+	lines = append(lines, headers...)
+	lines = append(lines, "Content-Length: 0", "", "")
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+func TestParseSIPMessage(t *testing.T) {
+	t.Run("OK with compact, folded and comma-joined headers", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg, ret, err := secsipid.SJWTParseSIPMessage(newSIPTestInvite(
+			"P-Asserted-Identity: <sip:+12155550111@example.com>, <tel:+12155550111>",
+			"Identity: aaa.bbb.ccc;info=<https://a.example.com/c.pem?x=1,2>",
+			"  ;alg=ES256;ppt=shaken, ddd.eee.fff;info=<https://b.example.com/c.pem>;ppt=\"div, x\"",
+			"y: ggg.hhh.iii;info=<https://c.example.com/c.pem>",
+		))
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(msg.Method).ToBe("INVITE")
+		expect(msg.RequestURI).ToBe("sip:+12155550133@sbc.example.com;user=phone")
+		expect(msg.From).ToBe("\"Alice\" <sip:+12155550111@example.com;user=phone>;tag=1928301774")
+		expect(msg.To).ToBe("<tel:+1-215-555-0122>")
+		expect(len(msg.PAI)).ToBe(2)
+		expect(len(msg.Identity)).ToBe(3)
+		expect(msg.Identity[0]).ToBe("aaa.bbb.ccc;info=<https://a.example.com/c.pem?x=1,2> ;alg=ES256;ppt=shaken")
+		expect(msg.Identity[1]).ToBe("ddd.eee.fff;info=<https://b.example.com/c.pem>;ppt=\"div, x\"")
+		expect(msg.Identity[2]).ToBe("ggg.hhh.iii;info=<https://c.example.com/c.pem>")
+	})
+
+	t.Run("ErrSIPMsgParse with SIP response", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		msg, ret, err := secsipid.SJWTParseSIPMessage([]byte("SIP/2.0 200 OK\r\nTo: <sip:a@b>\r\n\r\n"))
+		expect(msg == nil).ToBe(true)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPMsgParse)
+		expect(getMsgFromErr(err)).ToBe(`invalid SIP request line: "SIP/2.0 200 OK"`)
+	})
+}
+
+func TestCheckSIPMessage(t *testing.T) {
+	caPEM, certPEM, keyPEM := newTestCertChain("Key Cache Test")
+	workDir, _ := os.MkdirTemp("", "secsipid-sipmsg")
+	defer os.RemoveAll(workDir)
+	keyFile := filepath.Join(workDir, "key.pem")
+	os.WriteFile(keyFile, keyPEM, 0640)
+	caFile := filepath.Join(workDir, "ca.pem")
+	os.WriteFile(caFile, caPEM, 0640)
+
+	secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+	defer secsipid.SJWTLibOptSetS("CertCAFile", "")
+	secsipid.SJWTLibOptSetN("CertVerify", 0b00101)
+	defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(certPEM)
+	}))
+	defer server.Close()
+	x5u := server.URL + "/cert.pem"
+
+	shaken, _, _ := secsipid.SJWTGetIdentityPrvKey("12155550111", "12155550122", "A", "", x5u, keyPEM)
+	divToken, _, _ := secsipid.SJWTEncodeText(
+		`{"alg":"ES256","ppt":"div","typ":"passport","x5u":"`+x5u+`"}`,
+		fmt.Sprintf(`{"dest":{"tn":["12155550133"]},"div":{"tn":"12155550122"},"iat":%d,"orig":{"tn":"12155550111"}}`,
+			time.Now().Unix()), keyFile)
+	div := divToken + ";info=<" + x5u + ">;alg=ES256;ppt=div"
+	other, _, _ := secsipid.SJWTGetIdentityPrvKey("12155550999", "12155550122", "A", "", x5u, keyPEM)
+
+	t.Run("OK with shaken and div identity headers", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		result, ret, err := secsipid.SJWTCheckSIPMessage(newSIPTestInvite("Identity: "+shaken, "Identity: "+div), 300, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(len(result.Results)).ToBe(2)
+		expect(result.Results[0].Ppt).ToBe("shaken")
+		expect(result.Results[0].OrigTN).ToBe("12155550111")
+		expect(result.Results[1].Ppt).ToBe("div")
+		expect(result.Results[1].Ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("ErrSIPHdrOrig with orig tn not matching From", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		result, ret, err := secsipid.SJWTCheckSIPMessage(newSIPTestInvite("Identity: "+shaken+", "+other), 300, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrOrig)
+		expect(getMsgFromErr(err)).ToBe("orig tn not matching From or P-Asserted-Identity")
+		expect(result.Results[0].Ret).ToBe(secsipid.SJWTRetOK)
+		expect(result.Results[1].Ret).ToBe(secsipid.SJWTRetErrSIPHdrOrig)
+	})
+
+	t.Run("OK with orig tn matching P-Asserted-Identity", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		_, ret, err := secsipid.SJWTCheckSIPMessage(newSIPTestInvite("P-Asserted-Identity: <tel:+12155550999>",
+			"Identity: "+other), 300, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+	})
+
+	t.Run("OK signing SIP request and verifying it", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		invite := append(newSIPTestInvite("P-Asserted-Identity: <sip:+1-215-555-0199@example.com>",
+			"Content-Type: application/sdp"), []byte("v=0\r\n")...)
+		signed, ret, err := secsipid.SJWTSignSIPMessage(invite, "A", "", x5u, keyPEM)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(strings.Count(string(signed), "\r\nDate: ")).ToBe(1)
+		expect(strings.HasSuffix(string(signed), "\r\n\r\nv=0\r\n")).ToBe(true)
+
+		result, ret, err := secsipid.SJWTCheckSIPMessage(signed, 300, 5)
+		expect(err).ToBe(nil)
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		expect(result.Results[0].OrigTN).ToBe("12155550199")
+	})
+
+	t.Run("ErrSIPHdrDest signing SIP request without dest number", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		invite := []byte("INVITE sip:bob@example.com SIP/2.0\r\nFrom: <tel:+12155550111>\r\nTo: <sip:bob@example.com>\r\n\r\n")
+		signed, ret, err := secsipid.SJWTSignSIPMessage(invite, "A", "", x5u, keyPEM)
+		expect(signed == nil).ToBe(true)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrDest)
+		expect(getMsgFromErr(err)).ToBe("no telephone number in To or Request-URI")
+	})
+
+	t.Run("ErrSIPHdrEmpty without identity header", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		result, ret, err := secsipid.SJWTCheckSIPMessage(newSIPTestInvite(), 300, 5)
+		expect(ret).ToBe(secsipid.SJWTRetErrSIPHdrEmpty)
+		expect(getMsgFromErr(err)).ToBe("no identity header in SIP message")
+		expect(len(result.Results)).ToBe(0)
+	})
+}
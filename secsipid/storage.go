@@ -0,0 +1,228 @@
+package secsipid
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SJWTCacheStorage - storage of the downloaded certificates, indexed by the
+// URL; Get returns nil data if the key is not found or it is expired, together
+// with the expire time of the content; Set keeps the data for ttl
+type SJWTCacheStorage interface {
+	Get(key string) ([]byte, time.Time, error)
+	Set(key string, data []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+// globalCacheStorage - the storage used by the URL cache instead of the
+// cache directory, built from the `CacheStorage` option or set with
+// SJWTSetCacheStorage()
+var globalCacheStorage = struct {
+	sync.Mutex
+	spec    string
+	storage SJWTCacheStorage
+	custom  bool
+}{}
+
+// SJWTNewCacheStorage - create the storage from its specification:
+//   - `memory` - in the memory of the process
+//   - `file:///path/to/dir` - files in the directory
+//   - `redis://[:password@]host[:port][/db][?prefix=name]` - a server
+//     speaking the Redis protocol (RESP)
+func SJWTNewCacheStorage(spec string) (SJWTCacheStorage, error) {
+	switch {
+	case spec == "memory":
+		return NewSJWTMemoryStorage(globalLibOptions.certMemCacheSize), nil
+	case strings.HasPrefix(spec, "file://"):
+		dir := strings.TrimPrefix(spec, "file://")
+		if len(dir) == 0 {
+			return nil, errors.New("no cache storage directory")
+		}
+		return SJWTFileStorage{Dir: dir}, nil
+	case strings.HasPrefix(spec, "redis://"):
+		return NewSJWTRESPStorageFromURL(spec)
+	}
+	return nil, fmt.Errorf("invalid cache storage: %s", spec)
+}
+
+// SJWTSetCacheStorage - set the storage used by the URL cache; nil restores
+// the storage given by the `CacheStorage` option (by default, the files in
+// the cache directory)
+func SJWTSetCacheStorage(storage SJWTCacheStorage) {
+	globalCacheStorage.Lock()
+	sjwtCloseCacheStorage(globalCacheStorage.storage)
+	globalCacheStorage.storage = storage
+	globalCacheStorage.custom = storage != nil
+	globalCacheStorage.spec = ""
+	globalCacheStorage.Unlock()
+}
+
+// sjwtSetCacheStorageSpec - set the `CacheStorage` option, replacing the
+// current storage if it is not set with SJWTSetCacheStorage()
+func sjwtSetCacheStorageSpec(spec string) error {
+	var storage SJWTCacheStorage
+	if len(spec) > 0 {
+		var err error
+		if storage, err = SJWTNewCacheStorage(spec); err != nil {
+			return err
+		}
+	}
+	globalLibOptions.cacheStorage = spec
+	globalCacheStorage.Lock()
+	defer globalCacheStorage.Unlock()
+	if globalCacheStorage.custom {
+		sjwtCloseCacheStorage(storage)
+		return nil
+	}
+	sjwtCloseCacheStorage(globalCacheStorage.storage)
+	globalCacheStorage.storage = storage
+	globalCacheStorage.spec = spec
+	return nil
+}
+
+// sjwtCacheStorage - the storage used by the URL cache, nil if the cache
+// directory is used
+func sjwtCacheStorage() SJWTCacheStorage {
+	globalCacheStorage.Lock()
+	defer globalCacheStorage.Unlock()
+	return globalCacheStorage.storage
+}
+
+// sjwtCloseCacheStorage - release the resources of the storage, if any
+func sjwtCloseCacheStorage(storage SJWTCacheStorage) {
+	if closer, ok := storage.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
+
+// sjwtFetchURLToStorage - download the content of the URL and keep it in the
+// storage until it expires
+func sjwtFetchURLToStorage(storage SJWTCacheStorage, urlVal string, timeoutVal int) ([]byte, time.Time, int, error) {
+	data, meta, ret, err := sjwtHTTPGetContent(urlVal, timeoutVal, nil, nil)
+	if data == nil {
+		return nil, time.Time{}, ret, err
+	}
+	if !meta.noStore {
+		storage.Set(urlVal, data, time.Until(meta.Expires))
+	}
+	return data, meta.Expires, SJWTRetOK, nil
+}
+
+// SJWTFileStorage - the content stored in files in a directory, with the
+// expire time in a `.meta` file next to each of them
+type SJWTFileStorage struct {
+	Dir string
+}
+
+// Get - read the content of the file if it is not expired
+func (s SJWTFileStorage) Get(key string) ([]byte, time.Time, error) {
+	data, expires, err := sjwtGetCacheDirContent(s.Dir, key)
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return data, expires, err
+}
+
+// Set - write the content to the file
+func (s SJWTFileStorage) Set(key string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	filePath := sjwtURLCacheFilePath(s.Dir, key)
+	if err := SJWTWriteFileAtomic(filePath, data, 0640); err != nil {
+		return err
+	}
+	tnow := time.Now()
+	return sjwtWriteURLCacheMeta(filePath, &urlCacheMeta{URL: key, Fetched: tnow, Expires: tnow.Add(ttl)})
+}
+
+// Delete - remove the file and its metadata, also if named by older
+// versions
+func (s SJWTFileStorage) Delete(key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	_, err := SJWTPurgeURLCache(s.Dir, key)
+	return err
+}
+
+// memStorageItem - content kept by the memory storage
+type memStorageItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// SJWTMemoryStorage - the content kept in memory, in a bounded LRU
+type SJWTMemoryStorage struct {
+	mu      sync.Mutex
+	maxSize int
+	items   map[string]*list.Element
+	lru     *list.List
+}
+
+// NewSJWTMemoryStorage - create a memory storage for up to maxSize items,
+// without limit if maxSize is 0
+func NewSJWTMemoryStorage(maxSize int) *SJWTMemoryStorage {
+	return &SJWTMemoryStorage{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get - return the content if it is not expired
+func (s *SJWTMemoryStorage) Get(key string) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, time.Time{}, nil
+	}
+	item := elem.Value.(*memStorageItem)
+	if !time.Now().Before(item.expires) {
+		s.lru.Remove(elem)
+		delete(s.items, key)
+		return nil, time.Time{}, nil
+	}
+	s.lru.MoveToFront(elem)
+	return item.data, item.expires, nil
+}
+
+// Set - keep the content in memory for ttl
+func (s *SJWTMemoryStorage) Set(key string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := &memStorageItem{key: key, data: data, expires: time.Now().Add(ttl)}
+	if elem, ok := s.items[key]; ok {
+		elem.Value = item
+		s.lru.MoveToFront(elem)
+		return nil
+	}
+	s.items[key] = s.lru.PushFront(item)
+	for s.maxSize > 0 && s.lru.Len() > s.maxSize {
+		elem := s.lru.Back()
+		s.lru.Remove(elem)
+		delete(s.items, elem.Value.(*memStorageItem).key)
+	}
+	return nil
+}
+
+// Delete - drop the content from memory
+func (s *SJWTMemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.lru.Remove(elem)
+		delete(s.items, key)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package secsipid
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// respMaxBulkLen - the maximum length of a bulk string reply (the limit of
+// the Redis server), to refuse the invalid lengths before allocating
+const respMaxBulkLen = 512 * 1024 * 1024
+
+// respError - error reply of the RESP server
+type respError string
+
+func (e respError) Error() string {
+	return "resp error: " + string(e)
+}
+
+// respConn - a connection to the RESP server
+type respConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// SJWTRESPStorage - the content stored in a server speaking the Redis
+// protocol (RESP), shared by all the nodes using it
+//   - Address - the `host:port` of the server
+//   - Password - if set, sent with AUTH on connect
+//   - DB - if not 0, selected on connect
+//   - Prefix - added to the URL to build the key
+//   - Timeout - for connecting and for each command
+type SJWTRESPStorage struct {
+	Address  string
+	Password string
+	DB       int
+	Prefix   string
+	Timeout  time.Duration
+
+	mu    sync.Mutex
+	idle  []*respConn
+	close bool
+}
+
+// respMaxIdleConns - the number of connections kept open for reuse
+const respMaxIdleConns = 4
+
+// NewSJWTRESPStorage - create the RESP storage for the server address
+func NewSJWTRESPStorage(address string, password string, db int) *SJWTRESPStorage {
+	return &SJWTRESPStorage{
+		Address:  address,
+		Password: password,
+		DB:       db,
+		Prefix:   "secsipid:",
+		Timeout:  2 * time.Second,
+	}
+}
+
+// NewSJWTRESPStorageFromURL - create the RESP storage from an URL like
+// `redis://[:password@]host[:port][/db][?prefix=name]`
+func NewSJWTRESPStorageFromURL(urlVal string) (*SJWTRESPStorage, error) {
+	u, err := url.Parse(urlVal)
+	if err != nil || u.Scheme != "redis" || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("invalid cache storage: %s", urlVal)
+	}
+	address := u.Host
+	if len(u.Port()) == 0 {
+		address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	password := ""
+	if u.User != nil {
+		password, _ = u.User.Password()
+	}
+	db := 0
+	if dbVal := strings.Trim(u.Path, "/"); len(dbVal) > 0 {
+		if db, err = strconv.Atoi(dbVal); err != nil {
+			return nil, fmt.Errorf("invalid cache storage db: %s", dbVal)
+		}
+	}
+	s := NewSJWTRESPStorage(address, password, db)
+	if prefix, ok := u.Query()["prefix"]; ok {
+		s.Prefix = prefix[0]
+	}
+	return s, nil
+}
+
+// Get - return the content and its expire time, using the TTL of the key
+func (s *SJWTRESPStorage) Get(key string) ([]byte, time.Time, error) {
+	replies, err := s.do([]string{"GET", s.Prefix + key}, []string{"PTTL", s.Prefix + key})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, _ := replies[0].([]byte)
+	if data == nil {
+		return nil, time.Time{}, nil
+	}
+	ttl, _ := replies[1].(int64)
+	if ttl <= 0 {
+		// no TTL set on the key
+		return data, time.Now().Add(time.Duration(globalLibOptions.cacheExpire) * time.Second), nil
+	}
+	return data, time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+// Set - store the content with the TTL
+func (s *SJWTRESPStorage) Set(key string, data []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return nil
+	}
+	_, err := s.do([]string{"SET", s.Prefix + key, string(data), "PX", strconv.FormatInt(ms, 10)})
+	return err
+}
+
+// Delete - remove the key
+func (s *SJWTRESPStorage) Delete(key string) error {
+	_, err := s.do([]string{"DEL", s.Prefix + key})
+	return err
+}
+
+// Close - close the idle connections
+func (s *SJWTRESPStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rc := range s.idle {
+		rc.conn.Close()
+	}
+	s.idle = nil
+	s.close = true
+	return nil
+}
+
+// do - send the commands in a pipeline and return their replies; the
+// connection is dropped on network or protocol errors
+func (s *SJWTRESPStorage) do(cmds ...[]string) ([]interface{}, error) {
+	rc, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := s.roundTrip(rc, cmds)
+	if err != nil {
+		var rerr respError
+		if !errors.As(err, &rerr) {
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+	s.putConn(rc)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if rerr, ok := reply.(respError); ok {
+			return nil, rerr
+		}
+	}
+	return replies, nil
+}
+
+// roundTrip - write the commands and read a reply for each of them
+func (s *SJWTRESPStorage) roundTrip(rc *respConn, cmds [][]string) ([]interface{}, error) {
+	if s.Timeout > 0 {
+		rc.conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	var sb strings.Builder
+	for _, cmd := range cmds {
+		respWriteCommand(&sb, cmd)
+	}
+	if _, err := io.WriteString(rc.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, 0, len(cmds))
+	for range cmds {
+		reply, err := respReadReply(rc.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// getConn - return an idle connection or open a new one
+func (s *SJWTRESPStorage) getConn() (*respConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		rc := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return rc, nil
+	}
+	s.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, rd: bufio.NewReader(conn)}
+	var cmds [][]string
+	if len(s.Password) > 0 {
+		cmds = append(cmds, []string{"AUTH", s.Password})
+	}
+	if s.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.DB)})
+	}
+	if len(cmds) > 0 {
+		replies, err := s.roundTrip(rc, cmds)
+		if err == nil {
+			for _, reply := range replies {
+				if rerr, ok := reply.(respError); ok {
+					err = rerr
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// putConn - keep the connection for reuse
+func (s *SJWTRESPStorage) putConn(rc *respConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.close || len(s.idle) >= respMaxIdleConns {
+		rc.conn.Close()
+		return
+	}
+	s.idle = append(s.idle, rc)
+}
+
+// respWriteCommand - encode the command as an array of bulk strings
+func respWriteCommand(sb *strings.Builder, cmd []string) {
+	fmt.Fprintf(sb, "*%d\r\n", len(cmd))
+	for _, arg := range cmd {
+		fmt.Fprintf(sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// respReadLine - read a line without the CRLF ending
+func respReadLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("resp protocol error: invalid line ending")
+	}
+	return line[:len(line)-2], nil
+}
+
+// respReadReply - read a reply: simple strings as string, errors as
+// respError, integers as int64, bulk strings as []byte (nil for null) and
+// arrays as []interface{}
+func respReadReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := respReadLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp protocol error: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("resp protocol error: invalid integer: %s", line[1:])
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp protocol error: invalid bulk length: %s", line[1:])
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		if n > respMaxBulkLen {
+			return nil, fmt.Errorf("resp protocol error: bulk length too large: %d", n)
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp protocol error: invalid array length: %s", line[1:])
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		// the items are read one by one, n is not trusted for allocating
+		capN := n
+		if capN > 64 {
+			capN = 64
+		}
+		items := make([]interface{}, 0, capN)
+		for i := 0; i < n; i++ {
+			item, err := respReadReply(rd)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("resp protocol error: invalid reply type: %c", line[0])
+}
@@ -0,0 +1,229 @@
+package secsipid_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// respTestServer - minimal stand-in for a Redis server, supporting the
+// commands used by the RESP storage
+type respTestServer struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	commands []string
+}
+
+func newRESPTestServer(password string) *respTestServer {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	srv := &respTestServer{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *respTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authenticated := len(srv.password) == 0
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = rd.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			io.ReadFull(rd, buf)
+			args[i] = string(buf[:size])
+		}
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, args[0])
+		if !authenticated && args[0] != "AUTH" {
+			srv.mu.Unlock()
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		reply := "-ERR unknown command\r\n"
+		switch args[0] {
+		case "AUTH":
+			if args[1] == srv.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "SELECT":
+			reply = "+OK\r\n"
+		case "SET":
+			ms, _ := strconv.Atoi(args[4])
+			srv.data[args[1]] = args[2]
+			srv.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			reply = "+OK\r\n"
+		case "GET":
+			if val, ok := srv.data[args[1]]; ok && time.Now().Before(srv.expires[args[1]]) {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "PTTL":
+			if _, ok := srv.data[args[1]]; ok {
+				reply = fmt.Sprintf(":%d\r\n", time.Until(srv.expires[args[1]]).Milliseconds())
+			} else {
+				reply = ":-2\r\n"
+			}
+		case "DEL":
+			delete(srv.data, args[1])
+			reply = ":1\r\n"
+		}
+		srv.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func TestCacheStorage(t *testing.T) {
+	t.Run("OK storing in memory until expired", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		storage := secsipid.NewSJWTMemoryStorage(2)
+
+		storage.Set("k1", []byte("v1"), time.Hour)
+		storage.Set("k2", []byte("v2"), time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		data, _, _ := storage.Get("k1")
+		expect(string(data)).ToBe("v1")
+		data, _, _ = storage.Get("k2")
+		expect(data == nil).ToBe(true)
+	})
+
+	t.Run("OK storing in files", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		workDir, _ := os.MkdirTemp("", "secsipid-storage")
+		defer os.RemoveAll(workDir)
+		storage := secsipid.SJWTFileStorage{Dir: workDir}
+
+		storage.Set("https://certs.example.com/cert.pem", []byte("cert"), time.Hour)
+		data, expires, err := storage.Get("https://certs.example.com/cert.pem")
+		expect(err).ToBe(nil)
+		expect(string(data)).ToBe("cert")
+		expect(expires.After(time.Now().Add(59 * time.Minute))).ToBe(true)
+
+		storage.Delete("https://certs.example.com/cert.pem")
+		data, _, err = storage.Get("https://certs.example.com/cert.pem")
+		expect(err).ToBe(nil)
+		expect(data == nil).ToBe(true)
+	})
+
+	t.Run("OK storing in RESP server with password", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		srv := newRESPTestServer("secret")
+		defer srv.listener.Close()
+		storage, err := secsipid.NewSJWTRESPStorageFromURL("redis://:secret@" + srv.listener.Addr().String() + "/2")
+		expect(err).ToBe(nil)
+		defer storage.Close()
+
+		err = storage.Set("https://certs.example.com/cert.pem", []byte("cert\r\ndata"), time.Hour)
+		expect(err).ToBe(nil)
+		data, expires, err := storage.Get("https://certs.example.com/cert.pem")
+		expect(err).ToBe(nil)
+		expect(string(data)).ToBe("cert\r\ndata")
+		expect(expires.After(time.Now().Add(59 * time.Minute))).ToBe(true)
+		expect(srv.data["secsipid:https://certs.example.com/cert.pem"]).ToBe("cert\r\ndata")
+		expect(strings.Join(srv.commands, ",")).ToBe("AUTH,SELECT,SET,GET,PTTL")
+
+		data, _, err = storage.Get("https://certs.example.com/other.pem")
+		expect(err).ToBe(nil)
+		expect(data == nil).ToBe(true)
+	})
+
+	t.Run("ErrRESP with wrong password", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		srv := newRESPTestServer("secret")
+		defer srv.listener.Close()
+		storage := secsipid.NewSJWTRESPStorage(srv.listener.Addr().String(), "wrong", 0)
+		defer storage.Close()
+
+		_, _, err := storage.Get("https://certs.example.com/cert.pem")
+		expect(getMsgFromErr(err)).ToBe("resp error: WRONGPASS invalid password")
+	})
+
+	t.Run("ErrRESP with bulk length over maximum", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			bufio.NewReader(conn).ReadString('\n')
+			io.WriteString(conn, "$4294967296\r\n")
+		}()
+		storage := secsipid.NewSJWTRESPStorage(listener.Addr().String(), "", 0)
+		defer storage.Close()
+
+		_, _, err := storage.Get("https://certs.example.com/cert.pem")
+		expect(getMsgFromErr(err)).ToBe("resp protocol error: bulk length too large: 4294967296")
+	})
+
+	t.Run("OK downloading once with CacheStorage option", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		srv := newRESPTestServer("")
+		defer srv.listener.Close()
+		downloads := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			downloads++
+			w.Write([]byte("content"))
+		}))
+		defer server.Close()
+
+		secsipid.SetURLFileCacheOptions("", 3600)
+		defer secsipid.SetURLFileCacheOptions("", 0)
+		ret := secsipid.SJWTLibOptSetV("CacheStorage=redis://" + srv.listener.Addr().String())
+		expect(ret).ToBe(secsipid.SJWTRetOK)
+		defer secsipid.SJWTLibOptSetS("CacheStorage", "")
+
+		for i := 0; i < 3; i++ {
+			data, ret, _ := secsipid.SJWTGetURLContent(server.URL+"/cert.pem", 5)
+			expect(ret).ToBe(secsipid.SJWTRetOK)
+			expect(string(data)).ToBe("content")
+		}
+		expect(downloads).ToBe(1)
+	})
+
+	t.Run("Err with invalid CacheStorage option", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		expect(secsipid.SJWTLibOptSetS("CacheStorage", "mongodb://localhost")).ToBe(secsipid.SJWTRetErr)
+	})
+}
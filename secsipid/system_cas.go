@@ -15,6 +15,7 @@ package secsipid
 
 import (
 	"crypto/x509"
+	"encoding/pem"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -48,30 +49,74 @@ var certDirectories = []string{
 	"/system/etc/security/cacerts", // Android
 }
 
+// the system CA pool state below is guarded by the lock of the global trust
+// stores (globalTrustStores)
+
 var systemCertPool *x509.CertPool = nil
 
+// systemCertList keeps the certificates added to systemCertPool, so they can
+// be copied in other pools (e.g., by the trust store)
+var systemCertList []*x509.Certificate = nil
+
+// systemCertGeneration is incremented every time the system CA pool is reset
+var systemCertGeneration = 0
+
 func SystemCertPool() (*x509.CertPool, error) {
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
+	if err := loadSystemCertPoolLocked(); err != nil {
+		return nil, err
+	}
+	return systemCertPool, nil
+}
+
+// loadSystemCertPoolLocked loads the system CA pool if it is not loaded yet
+// (must be called with globalTrustStores locked)
+func loadSystemCertPoolLocked() error {
 	if systemCertPool != nil {
-		return systemCertPool, nil
+		return nil
 	}
-	systemRoots, err := loadSystemRoots()
+	systemRoots, systemCerts, err := loadSystemRoots()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	systemCertPool = systemRoots
-	return systemCertPool, nil
+	systemCertList = systemCerts
+	return nil
+}
+
+// SystemCertificates returns the list of certificates in the system CA pool
+func SystemCertificates() ([]*x509.Certificate, error) {
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
+	if err := loadSystemCertPoolLocked(); err != nil {
+		return nil, err
+	}
+	return systemCertList, nil
 }
 
 func ResetSystemCertPool() {
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
 	systemCertPool = nil
+	systemCertList = nil
+	systemCertGeneration++
+}
+
+// sjwtSystemCertGeneration returns the number of resets of the system CA pool
+func sjwtSystemCertGeneration() int {
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
+	return systemCertGeneration
 }
 
 // On Unix systems other than macOS the environment variables SSL_CERT_FILE and
 // SSL_CERT_DIR can be used to override the system default locations for the SSL
 // certificate file and SSL certificate files directory, respectively. The
 // latter can be a colon-separated list.
-func loadSystemRoots() (*x509.CertPool, error) {
+func loadSystemRoots() (*x509.CertPool, []*x509.Certificate, error) {
 	roots := x509.NewCertPool()
+	var certs []*x509.Certificate
 
 	files := certFiles
 	if f := os.Getenv(certFileEnv); f != "" {
@@ -82,7 +127,7 @@ func loadSystemRoots() (*x509.CertPool, error) {
 	for _, file := range files {
 		data, err := os.ReadFile(file)
 		if err == nil {
-			roots.AppendCertsFromPEM(data)
+			certs = appendPoolCertsFromPEM(roots, certs, data)
 			break
 		}
 		if firstErr == nil && !os.IsNotExist(err) {
@@ -110,16 +155,39 @@ func loadSystemRoots() (*x509.CertPool, error) {
 		for _, fi := range fis {
 			data, err := os.ReadFile(directory + "/" + fi.Name())
 			if err == nil {
-				roots.AppendCertsFromPEM(data)
+				certs = appendPoolCertsFromPEM(roots, certs, data)
 			}
 		}
 	}
 
-	if len(roots.Subjects()) > 0 || firstErr == nil {
-		return roots, nil
+	if len(certs) > 0 || firstErr == nil {
+		return roots, certs, nil
 	}
 
-	return nil, firstErr
+	return nil, nil, firstErr
+}
+
+// appendPoolCertsFromPEM is like CertPool.AppendCertsFromPEM, but it returns
+// also the list of parsed certificates
+func appendPoolCertsFromPEM(pool *x509.CertPool, certs []*x509.Certificate, pemCerts []byte) []*x509.Certificate {
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		pool.AddCert(cert)
+		certs = append(certs, cert)
+	}
+	return certs
 }
 
 // readUniqueDirectoryEntries is like os.ReadDir but omits
@@ -0,0 +1,500 @@
+package secsipid
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trust store source types
+const (
+	// SJWTTrustSourceFile - file with PEM certificates
+	SJWTTrustSourceFile = iota
+	// SJWTTrustSourceDir - hashed directory (c_rehash style)
+	SJWTTrustSourceDir
+	// SJWTTrustSourceSTIPAList - STI-PA trust list in JSON format
+	SJWTTrustSourceSTIPAList
+	// SJWTTrustSourceSystem - system root CAs
+	SJWTTrustSourceSystem
+)
+
+// SJWTTrustSource - location of certificates for the trust store
+type SJWTTrustSource struct {
+	Type         int
+	Path         string
+	Intermediate bool
+}
+
+// SJWTTrustCertInfo - details about a certificate in the trust store
+type SJWTTrustCertInfo struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	Fingerprint  string    `json:"fingerprint"`
+	NotAfter     time.Time `json:"notAfter"`
+	Source       string    `json:"source"`
+	Intermediate bool      `json:"intermediate"`
+}
+
+// SJWTTrustStoreInfo - summary of the trust store content
+type SJWTTrustStoreInfo struct {
+	Roots         int                 `json:"roots"`
+	Intermediates int                 `json:"intermediates"`
+	Loaded        time.Time           `json:"loaded"`
+	LastError     string              `json:"lastError,omitempty"`
+	Certificates  []SJWTTrustCertInfo `json:"certificates"`
+}
+
+// trustStoreState - immutable snapshot of the loaded certificates
+type trustStoreState struct {
+	roots      *x509.CertPool
+	rootCerts  []*x509.Certificate
+	interCerts []*x509.Certificate
+	certsInfo  []SJWTTrustCertInfo
+	stamp      string
+	generation uint64
+	loaded     time.Time
+}
+
+// SJWTTrustStore - trust anchors and intermediate certificates combined from
+// multiple sources, parsed once and reloaded when the sources change
+type SJWTTrustStore struct {
+	sources        []SJWTTrustSource
+	reloadInterval time.Duration
+
+	mu      sync.Mutex
+	state   *trustStoreState
+	checked time.Time
+	lastErr error
+}
+
+// stiPATrustList - STI-PA trust list document
+type stiPATrustList struct {
+	TrustList []json.RawMessage `json:"trustList"`
+}
+
+// stiPATrustListCert - STI-PA trust list item given as an object
+type stiPATrustListCert struct {
+	Certificate string `json:"certificate"`
+}
+
+var hashedCertFileName = regexp.MustCompile(`^[0-9a-f]{8}\.[0-9]+$`)
+
+// trustStoreGeneration - counter of the loaded snapshots, to tell them apart
+// without comparing the stamps of the sources
+var trustStoreGeneration uint64
+
+// NewSJWTTrustStore - create a trust store for the list of sources
+// * reloadInterval - how often (in seconds) to check if the sources changed,
+//   if 0 the check is done on every use
+func NewSJWTTrustStore(sources []SJWTTrustSource, reloadInterval int) *SJWTTrustStore {
+	return &SJWTTrustStore{
+		sources:        sources,
+		reloadInterval: time.Duration(reloadInterval) * time.Second,
+	}
+}
+
+// sjwtSourceStamp - build a value that changes when the source is updated
+func sjwtSourceStamp(src SJWTTrustSource) string {
+	switch src.Type {
+	case SJWTTrustSourceSystem:
+		return fmt.Sprintf("system:%d", sjwtSystemCertGeneration())
+	case SJWTTrustSourceDir:
+		entries, err := ioutil.ReadDir(src.Path)
+		if err != nil {
+			return "dir:" + src.Path + ":error"
+		}
+		var sb strings.Builder
+		sb.WriteString("dir:" + src.Path)
+		for _, e := range entries {
+			fi, err := os.Stat(filepath.Join(src.Path, e.Name()))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&sb, ":%s/%d/%d", e.Name(), fi.ModTime().UnixNano(), fi.Size())
+		}
+		return sb.String()
+	}
+	fi, err := os.Stat(src.Path)
+	if err != nil {
+		return "file:" + src.Path + ":error"
+	}
+	return fmt.Sprintf("file:%s:%d/%d", src.Path, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// sjwtTrustSourceError - error codes and messages for a trust store source
+func sjwtTrustSourceError(src SJWTTrustSource, readErr bool) (int, error) {
+	if src.Intermediate {
+		if readErr {
+			return SJWTRetErrCertReadCAInter, errors.New("failed to read intermediate CA file")
+		}
+		return SJWTRetErrCertProcessing, errors.New("failed to append intermediate CA file")
+	}
+	switch src.Type {
+	case SJWTTrustSourceDir:
+		if readErr {
+			return SJWTRetErrCertReadCAFile, errors.New("failed to read CA directory")
+		}
+		return SJWTRetErrCertProcessing, errors.New("failed to append CA directory")
+	case SJWTTrustSourceSTIPAList:
+		if readErr {
+			return SJWTRetErrCertReadCAFile, errors.New("failed to read CA trust list")
+		}
+		return SJWTRetErrCertProcessing, errors.New("failed to parse CA trust list")
+	case SJWTTrustSourceSystem:
+		return SJWTRetErrCertProcessing, errors.New("failed to load system CAs")
+	}
+	if readErr {
+		return SJWTRetErrCertReadCAFile, errors.New("failed to read CA file")
+	}
+	return SJWTRetErrCertProcessing, errors.New("failed to append CA file")
+}
+
+// SJWTParseSTIPATrustList - get the certificates from a STI-PA trust list,
+// the items can be PEM or base64 DER certificates, given as strings or
+// as objects with a `certificate` field
+func SJWTParseSTIPATrustList(data []byte) ([]*x509.Certificate, error) {
+	var tlist stiPATrustList
+	if err := json.Unmarshal(data, &tlist); err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, item := range tlist.TrustList {
+		var certVal string
+		if err := json.Unmarshal(item, &certVal); err != nil {
+			var certObj stiPATrustListCert
+			if err = json.Unmarshal(item, &certObj); err != nil {
+				return nil, err
+			}
+			certVal = certObj.Certificate
+		}
+		certVal = strings.TrimSpace(certVal)
+		if strings.HasPrefix(certVal, "-----BEGIN") {
+			pemCerts := appendPoolCertsFromPEM(x509.NewCertPool(), nil, []byte(certVal))
+			if len(pemCerts) == 0 {
+				return nil, errors.New("invalid PEM certificate in trust list")
+			}
+			certs = append(certs, pemCerts...)
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(certVal)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// sjwtLoadTrustSource - read and parse the certificates from a source
+func sjwtLoadTrustSource(src SJWTTrustSource) ([]*x509.Certificate, int, error) {
+	switch src.Type {
+	case SJWTTrustSourceSystem:
+		certs, err := SystemCertificates()
+		if err != nil {
+			ret, _ := sjwtTrustSourceError(src, false)
+			return nil, ret, err
+		}
+		return certs, SJWTRetOK, nil
+	case SJWTTrustSourceDir:
+		entries, err := ioutil.ReadDir(src.Path)
+		if err != nil {
+			ret, rerr := sjwtTrustSourceError(src, true)
+			return nil, ret, rerr
+		}
+		hashed := false
+		for _, e := range entries {
+			if hashedCertFileName.MatchString(e.Name()) {
+				hashed = true
+				break
+			}
+		}
+		var certs []*x509.Certificate
+		for _, e := range entries {
+			if hashed && !hashedCertFileName.MatchString(e.Name()) {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(src.Path, e.Name()))
+			if err != nil {
+				continue
+			}
+			certs = appendPoolCertsFromPEM(x509.NewCertPool(), certs, data)
+		}
+		if len(certs) == 0 {
+			ret, rerr := sjwtTrustSourceError(src, false)
+			return nil, ret, rerr
+		}
+		return certs, SJWTRetOK, nil
+	}
+
+	data, err := ioutil.ReadFile(src.Path)
+	if err != nil {
+		ret, rerr := sjwtTrustSourceError(src, true)
+		return nil, ret, rerr
+	}
+	var certs []*x509.Certificate
+	if src.Type == SJWTTrustSourceSTIPAList {
+		certs, err = SJWTParseSTIPATrustList(data)
+	} else {
+		certs = appendPoolCertsFromPEM(x509.NewCertPool(), nil, data)
+	}
+	if err != nil || len(certs) == 0 {
+		ret, rerr := sjwtTrustSourceError(src, false)
+		return nil, ret, rerr
+	}
+	return certs, SJWTRetOK, nil
+}
+
+// sjwtCertFingerprint - SHA256 fingerprint of the certificate in hex format
+func sjwtCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// sjwtTrustSourceName - text representation of the source
+func sjwtTrustSourceName(src SJWTTrustSource) string {
+	switch src.Type {
+	case SJWTTrustSourceSystem:
+		return "system"
+	case SJWTTrustSourceDir:
+		return "dir:" + src.Path
+	case SJWTTrustSourceSTIPAList:
+		return "stipa:" + src.Path
+	}
+	return "file:" + src.Path
+}
+
+// load - build a new snapshot from the sources
+func (ts *SJWTTrustStore) load(stamp string) (*trustStoreState, int, error) {
+	state := &trustStoreState{
+		roots:      x509.NewCertPool(),
+		stamp:      stamp,
+		generation: atomic.AddUint64(&trustStoreGeneration, 1),
+		loaded:     time.Now(),
+	}
+	seen := make(map[string]bool)
+	for _, src := range ts.sources {
+		certs, ret, err := sjwtLoadTrustSource(src)
+		if ret != SJWTRetOK {
+			return nil, ret, err
+		}
+		for _, cert := range certs {
+			fp := sjwtCertFingerprint(cert)
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			if src.Intermediate {
+				state.interCerts = append(state.interCerts, cert)
+			} else {
+				state.roots.AddCert(cert)
+				state.rootCerts = append(state.rootCerts, cert)
+			}
+			state.certsInfo = append(state.certsInfo, SJWTTrustCertInfo{
+				Subject:      cert.Subject.String(),
+				Issuer:       cert.Issuer.String(),
+				Fingerprint:  fp,
+				NotAfter:     cert.NotAfter,
+				Source:       sjwtTrustSourceName(src),
+				Intermediate: src.Intermediate,
+			})
+		}
+	}
+	return state, SJWTRetOK, nil
+}
+
+// Reload - load again the certificates from the sources; if it fails, the
+// previously loaded certificates are still used
+func (ts *SJWTTrustStore) Reload() (int, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	_, ret, err := ts.current(true)
+	return ret, err
+}
+
+// current - return the snapshot, reloading it if the sources changed; if
+// reloading fails, the previous snapshot is returned together with the error
+// code (must be called locked)
+func (ts *SJWTTrustStore) current(force bool) (*trustStoreState, int, error) {
+	tnow := time.Now()
+	if !force && ts.state != nil && ts.reloadInterval > 0 && tnow.Sub(ts.checked) < ts.reloadInterval {
+		return ts.state, SJWTRetOK, nil
+	}
+	ts.checked = tnow
+
+	var sb strings.Builder
+	for _, src := range ts.sources {
+		sb.WriteString(sjwtSourceStamp(src))
+		sb.WriteString("|")
+	}
+	stamp := sb.String()
+	if !force && ts.state != nil && ts.state.stamp == stamp {
+		return ts.state, SJWTRetOK, nil
+	}
+
+	state, ret, err := ts.load(stamp)
+	if ret != SJWTRetOK {
+		ts.lastErr = err
+		return ts.state, ret, err
+	}
+	ts.lastErr = nil
+	ts.state = state
+	return ts.state, SJWTRetOK, nil
+}
+
+// snapshot - get the current snapshot of the trust store
+func (ts *SJWTTrustStore) snapshot() (*trustStoreState, int, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.current(false)
+}
+
+// RootPool - return the pool with trust anchors; the pool must not be changed
+func (ts *SJWTTrustStore) RootPool() (*x509.CertPool, int, error) {
+	state, ret, err := ts.snapshot()
+	if state == nil {
+		return nil, ret, err
+	}
+	return state.roots, SJWTRetOK, nil
+}
+
+// Roots - return the list of trust anchors
+func (ts *SJWTTrustStore) Roots() ([]*x509.Certificate, int, error) {
+	state, ret, err := ts.snapshot()
+	if state == nil {
+		return nil, ret, err
+	}
+	return state.rootCerts, SJWTRetOK, nil
+}
+
+// Intermediates - return the list of intermediate certificates
+func (ts *SJWTTrustStore) Intermediates() ([]*x509.Certificate, int, error) {
+	state, ret, err := ts.snapshot()
+	if state == nil {
+		return nil, ret, err
+	}
+	return state.interCerts, SJWTRetOK, nil
+}
+
+// Info - return the counts and fingerprints of loaded certificates
+func (ts *SJWTTrustStore) Info() SJWTTrustStoreInfo {
+	state, _, err := ts.snapshot()
+	info := SJWTTrustStoreInfo{}
+	if err != nil {
+		info.LastError = err.Error()
+	}
+	ts.mu.Lock()
+	if ts.lastErr != nil {
+		info.LastError = ts.lastErr.Error()
+	}
+	ts.mu.Unlock()
+	if state == nil {
+		return info
+	}
+	info.Roots = len(state.rootCerts)
+	info.Intermediates = len(state.interCerts)
+	info.Loaded = state.loaded
+	info.Certificates = append(info.Certificates, state.certsInfo...)
+	sort.SliceStable(info.Certificates, func(i, j int) bool {
+		return !info.Certificates[i].Intermediate && info.Certificates[j].Intermediate
+	})
+	return info
+}
+
+// global trust stores built from library options
+var globalTrustStores = struct {
+	sync.Mutex
+	rootKey  string
+	roots    *SJWTTrustStore
+	interKey string
+	inter    *SJWTTrustStore
+}{}
+
+// sjwtGlobalRootStore - trust store with the root CAs set in library options
+func sjwtGlobalRootStore(withSystem bool) *SJWTTrustStore {
+	var sources []SJWTTrustSource
+	if withSystem {
+		sources = append(sources, SJWTTrustSource{Type: SJWTTrustSourceSystem})
+	}
+	if len(globalLibOptions.certCAFile) > 0 {
+		sources = append(sources, SJWTTrustSource{Type: SJWTTrustSourceFile, Path: globalLibOptions.certCAFile})
+	}
+	if len(globalLibOptions.certCADir) > 0 {
+		sources = append(sources, SJWTTrustSource{Type: SJWTTrustSourceDir, Path: globalLibOptions.certCADir})
+	}
+	if len(globalLibOptions.certCATrustList) > 0 {
+		sources = append(sources, SJWTTrustSource{Type: SJWTTrustSourceSTIPAList, Path: globalLibOptions.certCATrustList})
+	}
+	key := fmt.Sprintf("%v/%d", sources, globalLibOptions.certReloadInterval)
+
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
+	if globalTrustStores.roots == nil || globalTrustStores.rootKey != key {
+		globalTrustStores.roots = NewSJWTTrustStore(sources, globalLibOptions.certReloadInterval)
+		globalTrustStores.rootKey = key
+	}
+	return globalTrustStores.roots
+}
+
+// sjwtGlobalInterStore - trust store with the intermediate CAs set in
+// library options
+func sjwtGlobalInterStore() *SJWTTrustStore {
+	sources := []SJWTTrustSource{
+		{Type: SJWTTrustSourceFile, Path: globalLibOptions.certCAInter, Intermediate: true},
+	}
+	key := fmt.Sprintf("%v/%d", sources, globalLibOptions.certReloadInterval)
+
+	globalTrustStores.Lock()
+	defer globalTrustStores.Unlock()
+	if globalTrustStores.inter == nil || globalTrustStores.interKey != key {
+		globalTrustStores.inter = NewSJWTTrustStore(sources, globalLibOptions.certReloadInterval)
+		globalTrustStores.interKey = key
+	}
+	return globalTrustStores.inter
+}
+
+// SJWTGetTrustStoreInfo - return the details about the trust anchors and
+// intermediate certificates set in library options
+func SJWTGetTrustStoreInfo() SJWTTrustStoreInfo {
+	withSystem := (globalLibOptions.certVerify & (1 << 1)) != 0
+	info := sjwtGlobalRootStore(withSystem).Info()
+	if len(globalLibOptions.certCAInter) > 0 {
+		interInfo := sjwtGlobalInterStore().Info()
+		info.Intermediates = interInfo.Intermediates
+		info.Certificates = append(info.Certificates, interInfo.Certificates...)
+		if len(info.LastError) == 0 {
+			info.LastError = interInfo.LastError
+		}
+	}
+	return info
+}
+
+// SJWTReloadTrustStore - force reloading the trust anchors and intermediate
+// certificates set in library options
+func SJWTReloadTrustStore() (int, error) {
+	withSystem := (globalLibOptions.certVerify & (1 << 1)) != 0
+	ret, err := sjwtGlobalRootStore(withSystem).Reload()
+	if ret != SJWTRetOK {
+		return ret, err
+	}
+	if len(globalLibOptions.certCAInter) > 0 {
+		return sjwtGlobalInterStore().Reload()
+	}
+	return SJWTRetOK, nil
+}
@@ -0,0 +1,160 @@
+package secsipid_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestTrustStore(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-truststore")
+	defer os.RemoveAll(workDir)
+
+	fileCA := newTestCA("File Root", nil)
+	filePEM, fileDER := fileCA.certPEM(), fileCA.der
+	dirPEM := newTestCA("Dir Root", nil).certPEM()
+	listCA := newTestCA("List Root", nil)
+	listPEM, listDER := listCA.certPEM(), listCA.der
+	interPEM := newTestCA("Intermediate", nil).certPEM()
+
+	caFile := path.Join(workDir, "ca.pem")
+	caDir := path.Join(workDir, "certs")
+	caList := path.Join(workDir, "trustlist.json")
+	interFile := path.Join(workDir, "inter.pem")
+
+	os.WriteFile(caFile, filePEM, 0640)
+	os.Mkdir(caDir, 0750)
+	os.WriteFile(path.Join(caDir, "0a1b2c3d.0"), dirPEM, 0640)
+	os.WriteFile(path.Join(caDir, "README"), []byte("not a certificate"), 0640)
+	trustList, _ := json.Marshal(map[string]interface{}{
+		"trustList": []interface{}{
+			base64.StdEncoding.EncodeToString(listDER),
+			map[string]string{"certificate": string(listPEM)},
+		},
+	})
+	os.WriteFile(caList, trustList, 0640)
+	os.WriteFile(interFile, interPEM, 0640)
+
+	newStore := func() *secsipid.SJWTTrustStore {
+		return secsipid.NewSJWTTrustStore([]secsipid.SJWTTrustSource{
+			{Type: secsipid.SJWTTrustSourceFile, Path: caFile},
+			{Type: secsipid.SJWTTrustSourceDir, Path: caDir},
+			{Type: secsipid.SJWTTrustSourceSTIPAList, Path: caList},
+			{Type: secsipid.SJWTTrustSourceFile, Path: interFile, Intermediate: true},
+		}, 0)
+	}
+
+	t.Run("OK combining all sources", func(t *testing.T) {
+		expect := expectate.Expect(t)
+
+		info := newStore().Info()
+
+		expect(info.LastError).ToBe("")
+		expect(info.Roots).ToBe(3)
+		expect(info.Intermediates).ToBe(1)
+		expect(len(info.Certificates)).ToBe(4)
+		sum := sha256.Sum256(fileDER)
+		expect(info.Certificates[0].Fingerprint).ToBe(hex.EncodeToString(sum[:]))
+		expect(info.Certificates[0].Source).ToBe("file:" + caFile)
+		expect(info.Certificates[3].Intermediate).ToBe(true)
+	})
+
+	t.Run("OK reloading when a file changes", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		store := newStore()
+
+		roots, errCode, _ := store.Roots()
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(len(roots)).ToBe(3)
+
+		newPEM := newTestCA("Second File Root", nil).certPEM()
+		os.WriteFile(caFile, append(append([]byte{}, filePEM...), newPEM...), 0640)
+		defer os.WriteFile(caFile, filePEM, 0640)
+
+		roots, errCode, _ = store.Roots()
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(len(roots)).ToBe(4)
+	})
+
+	t.Run("OK keeping loaded certificates when reload fails", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		store := newStore()
+		store.Roots()
+
+		os.WriteFile(caFile, []byte("invalid cert"), 0640)
+		defer os.WriteFile(caFile, filePEM, 0640)
+
+		roots, errCode, _ := store.Roots()
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(len(roots)).ToBe(3)
+		expect(store.Info().LastError).ToBe("failed to append CA file")
+
+		errCode, err := store.Reload()
+		expect(errCode).ToBe(secsipid.SJWTRetErrCertProcessing)
+		expect(getMsgFromErr(err)).ToBe("failed to append CA file")
+	})
+
+	t.Run("ErrCertReadCAFile with missing trust list", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		store := secsipid.NewSJWTTrustStore([]secsipid.SJWTTrustSource{
+			{Type: secsipid.SJWTTrustSourceSTIPAList, Path: path.Join(workDir, "missing.json")},
+		}, 0)
+
+		pool, errCode, err := store.RootPool()
+		expect(pool == nil).ToBe(true)
+		expect(errCode).ToBe(secsipid.SJWTRetErrCertReadCAFile)
+		expect(getMsgFromErr(err)).ToBe("failed to read CA trust list")
+	})
+
+	t.Run("OK verifying with CA directory from library options", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		certGenerator := NewDummyCA()
+		cert := certGenerator.generateValidCert()
+		os.WriteFile(path.Join(caDir, "1a2b3c4d.0"), certGenerator.caPEMBytes, 0640)
+
+		secsipid.SJWTLibOptSetS("CertCAFile", "")
+		secsipid.SJWTLibOptSetS("CertCADir", caDir)
+		defer secsipid.SJWTLibOptSetS("CertCADir", "")
+		secsipid.SJWTLibOptSetN("CertVerify", 0b00100)
+		defer secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+		errCode, err := secsipid.SJWTPubKeyVerify(cert)
+		expect(errCode).ToBe(secsipid.SJWTRetOK)
+		expect(getMsgFromErr(err)).ToBe("")
+		expect(secsipid.SJWTGetTrustStoreInfo().Roots).ToBe(2)
+	})
+
+	t.Run("OK resetting the system CAs while they are used", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		store := secsipid.NewSJWTTrustStore([]secsipid.SJWTTrustSource{
+			{Type: secsipid.SJWTTrustSourceSystem},
+		}, 0)
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					secsipid.ResetSystemCertPool()
+				}
+			}
+		}()
+		for i := 0; i < 20; i++ {
+			_, errCode, _ := store.Roots()
+			expect(errCode).ToBe(secsipid.SJWTRetOK)
+		}
+		close(stop)
+		<-done
+	})
+}
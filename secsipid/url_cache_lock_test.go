@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// lockTestFile - create the file and take an exclusive lock on it
+func lockTestFile(lockPath string) *os.File {
+	f, _ := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0640)
+	syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	return f
+}
+
+func TestURLCacheLockFile(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write([]byte("Hello from the server!"))
+	}))
+	defer server.Close()
+
+	workDir, _ := os.MkdirTemp("", "secsipid-urllock")
+	defer os.RemoveAll(workDir)
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+
+	t.Run("OK waiting for the new lock file when the old one is removed", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		urlVal := server.URL + "/cert.pem"
+		lockPath := secsipid.SJWTGetURLCacheFilePath(urlVal) + ".lock"
+		oldLock := lockTestFile(lockPath)
+
+		done := make(chan []byte)
+		go func() {
+			content, _, _ := secsipid.SJWTGetURLContent(urlVal, 5)
+			done <- content
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// the lock file is removed, like by the cache cleaning, and another
+		// process creates and locks a new one
+		os.Remove(lockPath)
+		newLock := lockTestFile(lockPath)
+		oldLock.Close()
+
+		time.Sleep(200 * time.Millisecond)
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(0))
+
+		newLock.Close()
+		expect(<-done).ToEqual([]byte("Hello from the server!"))
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(1))
+	})
+}
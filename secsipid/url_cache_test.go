@@ -2,15 +2,24 @@ package secsipid_test
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/asipto/secsipidx/secsipid"
 	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
 )
 
 type GetURLValueTest struct {
@@ -85,7 +94,8 @@ func TestGetURLContent(t *testing.T) {
 	})
 
 	t.Run("ErrHTTPGet with no cache file and no running server", func(t *testing.T) {
-		workDir, _ := os.Getwd()
+		workDir, _ := os.MkdirTemp("", "secsipid-urlcache")
+		defer os.RemoveAll(workDir)
 		secsipid.SetURLFileCacheOptions(workDir, int(time.Hour))
 		defer secsipid.SetURLFileCacheOptions("", 0)
 
@@ -185,8 +195,10 @@ func TestGetURLContent(t *testing.T) {
 	})
 
 	t.Run("OK and caches if cacheDirPath is set", func(t *testing.T) {
-		workDir, _ := os.Getwd()
+		workDir, _ := os.MkdirTemp("", "secsipid-urlcache")
+		defer os.RemoveAll(workDir)
 		secsipid.SetURLFileCacheOptions(workDir, int(time.Hour))
+		defer secsipid.SetURLFileCacheOptions("", 0)
 
 		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Hello from the server!"))
@@ -212,8 +224,6 @@ func TestGetURLContent(t *testing.T) {
 			expectedErrCode: secsipid.SJWTRetOK,
 			expectedErrMsg:  "",
 		})
-
-		os.Remove("http_localhost:5555_foo")
 	})
 
 	t.Run("Not OK if cache expires", func(t *testing.T) {
@@ -221,8 +231,10 @@ func TestGetURLContent(t *testing.T) {
 			t.Skip("This test takes a long time. $GO_TEST_ALL must be set to 'on'")
 		}
 
-		workDir, _ := os.Getwd()
+		workDir, _ := os.MkdirTemp("", "secsipid-urlcache")
+		defer os.RemoveAll(workDir)
 		secsipid.SetURLFileCacheOptions(workDir, 1)
+		defer secsipid.SetURLFileCacheOptions("", 0)
 
 		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Hello from the server!"))
@@ -249,11 +261,105 @@ func TestGetURLContent(t *testing.T) {
 			expectedErrCode: secsipid.SJWTRetErrHTTPGet,
 			expectedErrMsg:  tcpDialErrMsg,
 		})
+	})
+}
+
+func TestGetURLContentConcurrent(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("Hello from the server!"))
+	}))
+	defer server.Close()
+
+	runConcurrent := func(urlVal string) [][]byte {
+		var wg sync.WaitGroup
+		contents := make([][]byte, 20)
+		for i := range contents {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				contents[i], _, _ = secsipid.SJWTGetURLContent(urlVal, 10)
+			}(i)
+		}
+		wg.Wait()
+		return contents
+	}
+
+	t.Run("OK downloading once without cache dir", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SetURLFileCacheOptions("", 0)
+		atomic.StoreInt32(&downloads, 0)
+
+		for _, content := range runConcurrent(server.URL + "/foo") {
+			expect(content).ToEqual([]byte("Hello from the server!"))
+		}
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(1))
+	})
+
+	t.Run("OK downloading once and caching with cache dir", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		workDir, _ := os.MkdirTemp("", "secsipid-urlcache")
+		defer os.RemoveAll(workDir)
+		secsipid.SetURLFileCacheOptions(workDir, 3600)
+		defer secsipid.SetURLFileCacheOptions("", 0)
+		atomic.StoreInt32(&downloads, 0)
+
+		for _, content := range runConcurrent(server.URL + "/bar") {
+			expect(content).ToEqual([]byte("Hello from the server!"))
+		}
+		expect(atomic.LoadInt32(&downloads)).ToBe(int32(1))
+
+		cached, err := os.ReadFile(secsipid.SJWTGetURLCacheFilePath(server.URL + "/bar"))
+		expect(err).ToBe(nil)
+		expect(cached).ToEqual([]byte("Hello from the server!"))
+	})
 
-		os.Remove("http_localhost:5555_foo")
+	t.Run("ErrHTTPGet for the waiting requests when the download panics", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		fetcher := secsipid.SJWTHTTPFetcher{Client: &http.Client{
+			Transport: panicTransport{started: started, release: release},
+		}}
+		urlVal := server.URL + "/panic"
+
+		go func() {
+			defer func() { recover() }()
+			fetcher.Fetch(urlVal, 10)
+		}()
+		<-started
+
+		done := make(chan int)
+		go func() {
+			_, _, ret, _ := fetcher.Fetch(urlVal, 10)
+			done <- ret
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		select {
+		case ret := <-done:
+			expect(ret).ToBe(secsipid.SJWTRetErrHTTPGet)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the waiting request was not released")
+		}
 	})
 }
 
+// panicTransport - HTTP transport that panics once released
+type panicTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p panicTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	close(p.started)
+	<-p.release
+	panic("transport failure")
+}
+
 func startTestServer(handler http.Handler) (shutdown func()) {
 	server := http.Server{
 		Addr:    "127.0.0.1:5555",
@@ -275,3 +381,177 @@ func getTcpDialErrMsg() string {
 	_, tcpDialErr := http.Get("http://localhost:5555/foo")
 	return "http get failure: " + tcpDialErr.Error()
 }
+
+func TestGetURLContentHTTPCache(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-httpcache")
+	defer os.RemoveAll(workDir)
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+
+	_, certPEM, _ := newTestCertChain("Key Cache Test")
+	requests := 0
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/cert":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+			w.Write(certPEM)
+			return
+		}
+		w.Write([]byte("Hello from the server!"))
+	}))
+	defer server.Close()
+
+	getTwice := func(t *testing.T, urlVal string) {
+		expect := expectate.Expect(t)
+		for i := 0; i < 2; i++ {
+			content, errCode, err := secsipid.SJWTGetURLContent(urlVal, 10)
+			expect(getMsgFromErr(err)).ToBe("")
+			expect(errCode).ToBe(secsipid.SJWTRetOK)
+			expect(content).ToEqual([]byte("Hello from the server!"))
+		}
+	}
+
+	t.Run("OK revalidating with If-None-Match when expired", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		requests, notModified = 0, 0
+
+		getTwice(t, server.URL+"/revalidate")
+		expect(requests).ToBe(2)
+		expect(notModified).ToBe(1)
+	})
+
+	t.Run("OK using cached content until max-age", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		requests = 0
+
+		getTwice(t, server.URL+"/fresh")
+		expect(requests).ToBe(1)
+	})
+
+	t.Run("OK not caching with no-store", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		requests = 0
+
+		getTwice(t, server.URL+"/nostore")
+		expect(requests).ToBe(2)
+		_, err := os.Stat(secsipid.SJWTGetURLCacheFilePath(server.URL + "/nostore"))
+		expect(os.IsNotExist(err)).ToBe(true)
+	})
+
+	t.Run("OK limiting expiry to certificate validity", func(t *testing.T) {
+		expect := expectate.Expect(t)
+
+		secsipid.SJWTGetURLContent(server.URL+"/cert", 10)
+		metaData, err := os.ReadFile(secsipid.SJWTGetURLCacheFilePath(server.URL+"/cert") + ".meta")
+		expect(err).ToBe(nil)
+		var meta struct {
+			Expires time.Time `json:"expires"`
+		}
+		json.Unmarshal(metaData, &meta)
+		block, _ := pem.Decode(certPEM)
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		expect(meta.Expires.Equal(cert.NotAfter)).ToBe(true)
+	})
+}
+
+func TestCleanURLCache(t *testing.T) {
+	workDir, _ := os.MkdirTemp("", "secsipid-janitor")
+	defer os.RemoveAll(workDir)
+	secsipid.SetURLFileCacheOptions(workDir, 3600)
+	defer secsipid.SetURLFileCacheOptions("", 0)
+
+	t.Run("OK using hashed file names", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		urlVal := "https://certs.example.com/../cert.pem?" + strings.Repeat("x", 300)
+		expect(secsipid.SJWTSetURLCachedContent(urlVal, []byte("cert"))).ToBe(nil)
+
+		filePath := secsipid.SJWTGetURLCacheFilePath(urlVal)
+		expect(filepath.Dir(filePath)).ToBe(workDir)
+		expect(len(filepath.Base(filePath))).ToBe(64)
+		metaData, err := os.ReadFile(filePath + ".meta")
+		expect(err).ToBe(nil)
+		expect(strings.Contains(string(metaData), `"url":"https://certs.example.com/../cert.pem?`)).ToBe(true)
+	})
+
+	t.Run("Error storing content when cache expire is not set", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		urlVal := "https://certs.example.com/no-expire.pem"
+		secsipid.SJWTLibOptSetN("CacheExpires", 0)
+		defer secsipid.SJWTLibOptSetN("CacheExpires", 3600)
+
+		err := secsipid.SJWTSetURLCachedContent(urlVal, []byte("cert"))
+		expect(getMsgFromErr(err)).ToBe("cache expire time not set: 0")
+		_, err = os.Stat(secsipid.SJWTGetURLCacheFilePath(urlVal))
+		expect(os.IsNotExist(err)).ToBe(true)
+	})
+
+	t.Run("OK removing expired entries and enforcing maximum size", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		os.WriteFile(filepath.Join(workDir, "notes.txt"), []byte("not a cache file"), 0640)
+		os.WriteFile(filepath.Join(workDir, "http_example.com_old"), []byte("legacy"), 0640)
+		oldTime := time.Now().Add(-2 * time.Hour)
+		os.Chtimes(filepath.Join(workDir, "http_example.com_old"), oldTime, oldTime)
+		os.WriteFile(filepath.Join(workDir, ".http_example.com_tmp.tmp123"), []byte("partial"), 0640)
+		os.Chtimes(filepath.Join(workDir, ".http_example.com_tmp.tmp123"), oldTime, oldTime)
+
+		secsipid.SJWTLibOptSetN("CacheExpires", 1)
+		secsipid.SJWTSetURLCachedContent("https://certs.example.com/expired.pem", []byte("expired"))
+		secsipid.SJWTLibOptSetN("CacheExpires", 3600)
+		secsipid.SJWTSetURLCachedContent("https://certs.example.com/first.pem", []byte("first"))
+		time.Sleep(1100 * time.Millisecond)
+		secsipid.SJWTSetURLCachedContent("https://certs.example.com/second.pem", []byte("second"))
+
+		firstPath := secsipid.SJWTGetURLCacheFilePath("https://certs.example.com/first.pem")
+		secondPath := secsipid.SJWTGetURLCacheFilePath("https://certs.example.com/second.pem")
+		secondInfo, _ := os.Stat(secondPath)
+		secondMetaInfo, _ := os.Stat(secondPath + ".meta")
+		secondSize := secondInfo.Size() + secondMetaInfo.Size()
+
+		result, err := secsipid.SJWTCleanURLCache(workDir, secondSize)
+		expect(err).ToBe(nil)
+		expect(result.Removed).ToBe(5)
+		expect(result.Files).ToBe(1)
+		expect(result.Size).ToBe(secondSize)
+
+		_, err = os.Stat(firstPath)
+		expect(os.IsNotExist(err)).ToBe(true)
+		_, err = os.Stat(secondPath)
+		expect(err).ToBe(nil)
+		_, err = os.Stat(filepath.Join(workDir, "notes.txt"))
+		expect(err).ToBe(nil)
+	})
+
+	t.Run("OK removing lock files without content", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("File locking is not supported on windows")
+		}
+		expect := expectate.Expect(t)
+		secondPath := secsipid.SJWTGetURLCacheFilePath("https://certs.example.com/second.pem")
+		orphanPath := secsipid.SJWTGetURLCacheFilePath("https://certs.example.com/orphan.pem")
+		os.WriteFile(secondPath+".lock", nil, 0640)
+		os.WriteFile(orphanPath+".lock", nil, 0640)
+
+		result, err := secsipid.SJWTCleanURLCache(workDir, 0)
+		expect(err).ToBe(nil)
+		expect(result.Removed).ToBe(1)
+
+		_, err = os.Stat(orphanPath + ".lock")
+		expect(os.IsNotExist(err)).ToBe(true)
+		_, err = os.Stat(secondPath + ".lock")
+		expect(err).ToBe(nil)
+	})
+}
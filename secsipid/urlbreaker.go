@@ -0,0 +1,202 @@
+package secsipid
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// urlNegCacheItem - a failed download of an URL
+type urlNegCacheItem struct {
+	ret     int
+	err     error
+	expires time.Time
+}
+
+// urlNegCache - the failed downloads indexed by URL, to return the failure
+// without waiting again for the timeout
+var urlNegCache = struct {
+	sync.Mutex
+	items map[string]urlNegCacheItem
+}{items: make(map[string]urlNegCacheItem)}
+
+// hostBreaker - the state of the circuit breaker for a host
+type hostBreaker struct {
+	failures  int
+	openUntil time.Time
+	trial     bool
+	lastError string
+	lastTime  time.Time
+}
+
+// hostBreakers - the circuit breakers indexed by host
+var hostBreakers = struct {
+	sync.Mutex
+	hosts map[string]*hostBreaker
+}{hosts: make(map[string]*hostBreaker)}
+
+// SJWTHostStatus - the state of the circuit breaker for a x5u host
+type SJWTHostStatus struct {
+	Host         string    `json:"host"`
+	Failures     int       `json:"failures"`
+	Tripped      bool      `json:"tripped"`
+	TrippedUntil time.Time `json:"trippedUntil,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastFailure  time.Time `json:"lastFailure,omitempty"`
+}
+
+// SJWTResetURLFailures - drop the cached download failures and reset the
+// circuit breakers of all hosts
+func SJWTResetURLFailures() {
+	urlNegCache.Lock()
+	urlNegCache.items = make(map[string]urlNegCacheItem)
+	urlNegCache.Unlock()
+	hostBreakers.Lock()
+	hostBreakers.hosts = make(map[string]*hostBreaker)
+	hostBreakers.Unlock()
+}
+
+// SJWTGetHostsStatus - return the state of the circuit breakers for the hosts
+// with failed downloads; if onlyTripped is true, only the hosts for which the
+// downloads are currently failing fast are returned
+func SJWTGetHostsStatus(onlyTripped bool) []SJWTHostStatus {
+	tnow := time.Now()
+	hostBreakers.Lock()
+	defer hostBreakers.Unlock()
+	hosts := make([]SJWTHostStatus, 0, len(hostBreakers.hosts))
+	for host, hb := range hostBreakers.hosts {
+		status := SJWTHostStatus{
+			Host:        host,
+			Failures:    hb.failures,
+			Tripped:     tnow.Before(hb.openUntil),
+			LastError:   hb.lastError,
+			LastFailure: hb.lastTime,
+		}
+		if status.Tripped {
+			status.TrippedUntil = hb.openUntil
+		} else if onlyTripped {
+			continue
+		}
+		hosts = append(hosts, status)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// sjwtURLHost - return the host part of the URL
+func sjwtURLHost(urlVal string) string {
+	u, err := url.Parse(urlVal)
+	if err != nil {
+		return urlVal
+	}
+	return u.Host
+}
+
+// sjwtNegCacheGet - return the cached failure for the URL, if any
+func sjwtNegCacheGet(urlVal string) (int, error) {
+	urlNegCache.Lock()
+	defer urlNegCache.Unlock()
+	item, ok := urlNegCache.items[urlVal]
+	if !ok {
+		return SJWTRetOK, nil
+	}
+	if !time.Now().Before(item.expires) {
+		delete(urlNegCache.items, urlVal)
+		return SJWTRetOK, nil
+	}
+	return item.ret, item.err
+}
+
+// sjwtNegCacheSet - cache the download failure for the URL, the connection
+// failures and timeouts are kept for `NegCacheExpire` seconds and the HTTP
+// status or body errors for `NegCacheStatusExpire` seconds
+func sjwtNegCacheSet(urlVal string, ret int, err error) {
+	expire := globalLibOptions.negCacheStatusExpire
+	if ret == SJWTRetErrHTTPGet {
+		expire = globalLibOptions.negCacheExpire
+	}
+	if expire <= 0 {
+		return
+	}
+	urlNegCache.Lock()
+	urlNegCache.items[urlVal] = urlNegCacheItem{
+		ret:     ret,
+		err:     err,
+		expires: time.Now().Add(time.Duration(expire) * time.Second),
+	}
+	urlNegCache.Unlock()
+}
+
+// sjwtHostBreakerAllow - check if downloads from the host of the URL can be
+// done; when the breaker is open, only one trial download is allowed after
+// the open interval passes
+func sjwtHostBreakerAllow(urlVal string) (int, error) {
+	if globalLibOptions.hostBreakerThreshold <= 0 {
+		return SJWTRetOK, nil
+	}
+	host := sjwtURLHost(urlVal)
+	tnow := time.Now()
+	hostBreakers.Lock()
+	defer hostBreakers.Unlock()
+	hb, ok := hostBreakers.hosts[host]
+	if !ok || hb.failures < globalLibOptions.hostBreakerThreshold {
+		return SJWTRetOK, nil
+	}
+	if tnow.Before(hb.openUntil) || hb.trial {
+		return SJWTRetErrHTTPHostDown, fmt.Errorf("host unreachable: %s (%s)", host, hb.lastError)
+	}
+	hb.trial = true
+	return SJWTRetOK, nil
+}
+
+// sjwtHostBreakerTrialEnd - allow a new trial download from the host of the
+// URL, also if the outcome of the previous one was not reported (e.g., it
+// panicked or it waited for a download already in progress)
+func sjwtHostBreakerTrialEnd(urlVal string) {
+	if globalLibOptions.hostBreakerThreshold <= 0 {
+		return
+	}
+	host := sjwtURLHost(urlVal)
+	hostBreakers.Lock()
+	defer hostBreakers.Unlock()
+	if hb, ok := hostBreakers.hosts[host]; ok {
+		hb.trial = false
+	}
+}
+
+// sjwtHostBreakerResult - update the circuit breaker of the host with the
+// result of the download; only connection failures and timeouts are counted
+func sjwtHostBreakerResult(urlVal string, ret int, err error) {
+	if globalLibOptions.hostBreakerThreshold <= 0 {
+		return
+	}
+	host := sjwtURLHost(urlVal)
+	hostBreakers.Lock()
+	defer hostBreakers.Unlock()
+	hb, ok := hostBreakers.hosts[host]
+	if ret != SJWTRetErrHTTPGet {
+		if ok {
+			delete(hostBreakers.hosts, host)
+		}
+		return
+	}
+	if !ok {
+		hb = &hostBreaker{}
+		hostBreakers.hosts[host] = hb
+	}
+	hb.failures++
+	hb.trial = false
+	hb.lastTime = time.Now()
+	if err == nil {
+		err = errors.New("http get failure")
+	}
+	hb.lastError = err.Error()
+	if hb.failures >= globalLibOptions.hostBreakerThreshold {
+		hb.openUntil = hb.lastTime.Add(time.Duration(globalLibOptions.hostBreakerOpenTime) * time.Second)
+	}
+}
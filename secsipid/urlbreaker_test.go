@@ -0,0 +1,115 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestURLFailures(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadServer := httptest.NewServer(http.NotFoundHandler())
+	deadURL := deadServer.URL + "/cert.pem"
+	deadServer.Close()
+
+	t.Run("OK caching status failures", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		secsipid.SJWTLibOptSetN("NegCacheStatusExpire", 60)
+		defer secsipid.SJWTLibOptSetN("NegCacheStatusExpire", 0)
+		requests = 0
+
+		for i := 0; i < 3; i++ {
+			content, errCode, err := secsipid.SJWTGetURLContent(server.URL+"/cert.pem", 5)
+			expect(content == nil).ToBe(true)
+			expect(errCode).ToBe(secsipid.SJWTRetErrHTTPStatusCode)
+			expect(getMsgFromErr(err)).ToBe("http status error: 500")
+		}
+		expect(requests).ToBe(1)
+		expect(len(secsipid.SJWTGetHostsStatus(false))).ToBe(0)
+	})
+
+	t.Run("OK not caching failures by default", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		requests = 0
+
+		for i := 0; i < 2; i++ {
+			secsipid.SJWTGetURLContent(server.URL+"/cert.pem", 5)
+		}
+		expect(requests).ToBe(2)
+	})
+
+	t.Run("ErrHTTPHostDown after repeated connection failures", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		secsipid.SJWTLibOptSetN("HostBreakerThreshold", 2)
+		defer secsipid.SJWTLibOptSetN("HostBreakerThreshold", 0)
+
+		for i := 0; i < 2; i++ {
+			_, errCode, _ := secsipid.SJWTGetURLContent(deadURL, 5)
+			expect(errCode).ToBe(secsipid.SJWTRetErrHTTPGet)
+		}
+		expect(len(secsipid.SJWTGetHostsStatus(true))).ToBe(1)
+
+		_, errCode, err := secsipid.SJWTGetURLContent(strings.Replace(deadURL, "cert.pem", "other.pem", 1), 5)
+		expect(errCode).ToBe(secsipid.SJWTRetErrHTTPHostDown)
+		expect(strings.HasPrefix(getMsgFromErr(err), "host unreachable: ")).ToBe(true)
+
+		hosts := secsipid.SJWTGetHostsStatus(true)
+		expect(hosts[0].Host).ToBe(strings.TrimPrefix(deadServer.URL, "http://"))
+		expect(hosts[0].Failures).ToBe(2)
+		expect(hosts[0].Tripped).ToBe(true)
+	})
+
+	t.Run("OK trying again after the open interval", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		secsipid.SJWTLibOptSetN("HostBreakerThreshold", 1)
+		defer secsipid.SJWTLibOptSetN("HostBreakerThreshold", 0)
+		secsipid.SJWTLibOptSetN("HostBreakerOpenTime", 0)
+		defer secsipid.SJWTLibOptSetN("HostBreakerOpenTime", 60)
+
+		for i := 0; i < 2; i++ {
+			_, errCode, _ := secsipid.SJWTGetURLContent(deadURL, 5)
+			expect(errCode).ToBe(secsipid.SJWTRetErrHTTPGet)
+		}
+		expect(len(secsipid.SJWTGetHostsStatus(true))).ToBe(0)
+		expect(secsipid.SJWTGetHostsStatus(false)[0].Failures).ToBe(2)
+	})
+
+	t.Run("OK trying again when the trial download panics", func(t *testing.T) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		secsipid.SJWTLibOptSetN("HostBreakerThreshold", 1)
+		defer secsipid.SJWTLibOptSetN("HostBreakerThreshold", 0)
+		secsipid.SJWTLibOptSetN("HostBreakerOpenTime", 0)
+		defer secsipid.SJWTLibOptSetN("HostBreakerOpenTime", 60)
+
+		_, errCode, _ := secsipid.SJWTGetURLContent(deadURL, 5)
+		expect(errCode).ToBe(secsipid.SJWTRetErrHTTPGet)
+
+		release := make(chan struct{})
+		close(release)
+		fetcher := secsipid.SJWTHTTPFetcher{Client: &http.Client{
+			Transport: panicTransport{started: make(chan struct{}), release: release},
+		}}
+		func() {
+			defer func() { recover() }()
+			fetcher.Fetch(deadURL, 5)
+		}()
+
+		_, errCode, _ = secsipid.SJWTGetURLContent(deadURL, 5)
+		expect(errCode).ToBe(secsipid.SJWTRetErrHTTPGet)
+	})
+}
@@ -0,0 +1,330 @@
+package secsipid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// urlCacheMeta - HTTP metadata of the content stored in the cache directory,
+// kept in a `.meta` file next to the content file
+type urlCacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	Expires      time.Time `json:"expires"`
+	noStore      bool
+}
+
+// urlFetchCall - a download in progress, shared by the concurrent requests
+// for the same URL
+type urlFetchCall struct {
+	wg      sync.WaitGroup
+	data    []byte
+	expires time.Time
+	ret     int
+	err     error
+}
+
+// urlFetchCalls - the downloads in progress indexed by URL
+var urlFetchCalls = struct {
+	sync.Mutex
+	calls map[string]*urlFetchCall
+}{calls: make(map[string]*urlFetchCall)}
+
+// sjwtFetchURLOnce - run fetchFunc for the URL only once at a time, the
+// concurrent callers for the same URL wait and get its result
+func sjwtFetchURLOnce(urlVal string, fetchFunc func() ([]byte, time.Time, int, error)) ([]byte, time.Time, int, error) {
+	urlFetchCalls.Lock()
+	if call, ok := urlFetchCalls.calls[urlVal]; ok {
+		urlFetchCalls.Unlock()
+		call.wg.Wait()
+		return call.data, call.expires, call.ret, call.err
+	}
+	call := &urlFetchCall{}
+	call.wg.Add(1)
+	urlFetchCalls.calls[urlVal] = call
+	urlFetchCalls.Unlock()
+
+	// release the waiters also if fetchFunc panics, they get an error
+	call.ret, call.err = SJWTRetErrHTTPGet, errors.New("download failed")
+	defer func() {
+		urlFetchCalls.Lock()
+		delete(urlFetchCalls.calls, urlVal)
+		urlFetchCalls.Unlock()
+		call.wg.Done()
+	}()
+
+	call.data, call.expires, call.ret, call.err = fetchFunc()
+	return call.data, call.expires, call.ret, call.err
+}
+
+// sjwtReadURLCacheMeta - read the HTTP metadata of the cached content, nil
+// if there is none
+func sjwtReadURLCacheMeta(filePath string) *urlCacheMeta {
+	data, err := ioutil.ReadFile(filePath + ".meta")
+	if err != nil {
+		return nil
+	}
+	meta := &urlCacheMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil
+	}
+	return meta
+}
+
+// sjwtWriteURLCacheMeta - write the HTTP metadata of the cached content
+func sjwtWriteURLCacheMeta(filePath string, meta *urlCacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return SJWTWriteFileAtomic(filePath+".meta", data, 0640)
+}
+
+// sjwtGetURLCachedContent - return the cached content if it is not expired,
+// together with its expire time; the expired content is kept if it has HTTP
+// metadata, to be revalidated with a conditional request
+func sjwtGetURLCachedContent(urlVal string) ([]byte, time.Time, error) {
+	return sjwtGetCacheDirContent(globalLibOptions.cacheDirPath, urlVal)
+}
+
+// sjwtGetCacheDirContent - return the content for the URL from the cache
+// directory, falling back to the file named by older versions
+func sjwtGetCacheDirContent(cacheDir string, urlVal string) ([]byte, time.Time, error) {
+	data, expires, err := sjwtGetCachedFileContent(sjwtURLCacheFilePath(cacheDir, urlVal))
+	if err != nil && os.IsNotExist(err) {
+		legacyPath := sjwtLegacyURLCacheFilePath(cacheDir, urlVal)
+		if ldata, lexpires, lerr := sjwtGetCachedFileContent(legacyPath); ldata != nil {
+			return ldata, lexpires, lerr
+		}
+	}
+	return data, expires, err
+}
+
+// sjwtGetCachedFileContent - return the content of the cache file if it is
+// not expired, together with its expire time
+func sjwtGetCachedFileContent(filePath string) ([]byte, time.Time, error) {
+	fileStat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	tnow := time.Now()
+	if meta := sjwtReadURLCacheMeta(filePath); meta != nil {
+		if !tnow.Before(meta.Expires) {
+			return nil, time.Time{}, nil
+		}
+		data, err := ioutil.ReadFile(filePath)
+		return data, meta.Expires, err
+	}
+	if int(tnow.Sub(fileStat.ModTime()).Seconds()) > globalLibOptions.cacheExpire {
+		os.Remove(filePath)
+		return nil, time.Time{}, nil
+	}
+	data, err := ioutil.ReadFile(filePath)
+	return data, fileStat.ModTime().Add(time.Duration(globalLibOptions.cacheExpire) * time.Second), err
+}
+
+// sjwtResponseExpires - compute the expire time of the response from the
+// Cache-Control (s-maxage, max-age, no-cache, no-store) and Expires headers,
+// falling back to the cache expire option
+func sjwtResponseExpires(header http.Header, tnow time.Time) (time.Time, bool) {
+	maxAge := -1
+	noStore := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			noStore = true
+			maxAge = 0
+		case directive == "no-cache":
+			maxAge = 0
+		case strings.HasPrefix(directive, "s-maxage="):
+			if v, err := strconv.Atoi(strings.Trim(directive[9:], `"`)); err == nil {
+				maxAge = v
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if v, err := strconv.Atoi(strings.Trim(directive[8:], `"`)); err == nil && maxAge < 0 {
+				maxAge = v
+			}
+		}
+	}
+	if maxAge >= 0 {
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+			maxAge -= age
+		}
+		return tnow.Add(time.Duration(maxAge) * time.Second), noStore
+	}
+	if expiresVal := header.Get("Expires"); len(expiresVal) > 0 {
+		if expires, err := http.ParseTime(expiresVal); err == nil {
+			return expires, noStore
+		}
+		// invalid values (e.g., "0") mean already expired
+		return tnow, noStore
+	}
+	return tnow.Add(time.Duration(globalLibOptions.cacheExpire) * time.Second), noStore
+}
+
+// sjwtCapExpiresNotAfter - limit the expire time to the validity of the
+// certificate in the content, if it can be parsed
+func sjwtCapExpiresNotAfter(data []byte, expires time.Time) time.Time {
+	cert := sjwtParseLeafCertificate(data)
+	if cert == nil {
+		return expires
+	}
+	if cert.NotAfter.Before(expires) {
+		return cert.NotAfter
+	}
+	return expires
+}
+
+// sjwtHTTPGetContent - download the content of the URL; if cached metadata
+// is given, the request is conditional and, if the content is not modified,
+// the returned data is nil; if httpClient is nil, the client enforcing the
+// fetch policy is used
+func sjwtHTTPGetContent(urlVal string, timeoutVal int, cached *urlCacheMeta, httpClient *http.Client) ([]byte, *urlCacheMeta, int, error) {
+	if httpClient == nil {
+		httpClient = sjwtPolicyHTTPClient(timeoutVal)
+	}
+	req, err := http.NewRequest(http.MethodGet, urlVal, nil)
+	if err != nil {
+		return nil, nil, SJWTRetErrHTTPInvalidURL, fmt.Errorf("http request failure: %v", err)
+	}
+	if cached != nil {
+		if len(cached.ETag) > 0 {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if len(cached.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		ret, err := sjwtPolicyRequestError(err)
+		return nil, nil, ret, err
+	}
+	defer resp.Body.Close()
+
+	tnow := time.Now()
+	meta := &urlCacheMeta{
+		URL:          urlVal,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      tnow,
+	}
+	meta.Expires, meta.noStore = sjwtResponseExpires(resp.Header, tnow)
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		if len(meta.ETag) == 0 {
+			meta.ETag = cached.ETag
+		}
+		if len(meta.LastModified) == 0 {
+			meta.LastModified = cached.LastModified
+		}
+		return nil, meta, SJWTRetOK, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, SJWTRetErrHTTPStatusCode, fmt.Errorf("http status error: %v", resp.StatusCode)
+	}
+
+	if ret, err := sjwtCheckContentType(resp); ret != SJWTRetOK {
+		return nil, nil, ret, err
+	}
+	data, ret, err := sjwtReadLimitedBody(resp)
+	if ret != SJWTRetOK {
+		return nil, nil, ret, err
+	}
+	data = sjwtNormalizeCertContent(data, resp.Header.Get("Content-Type"))
+	meta.Expires = sjwtCapExpiresNotAfter(data, meta.Expires)
+
+	return data, meta, SJWTRetOK, nil
+}
+
+// sjwtFetchURLToCache - download the content of the URL and store it in the
+// cache directory if set; the cache file is locked while downloading, so
+// other processes using the same cache directory wait and then read the
+// stored content instead of downloading it again, unless refresh is true
+func sjwtFetchURLToCache(urlVal string, timeoutVal int, refresh bool) ([]byte, time.Time, int, error) {
+	if len(globalLibOptions.cacheDirPath) == 0 {
+		data, meta, ret, err := sjwtHTTPGetContent(urlVal, timeoutVal, nil, nil)
+		if data == nil {
+			return nil, time.Time{}, ret, err
+		}
+		return data, meta.Expires, SJWTRetOK, nil
+	}
+
+	filePath := SJWTGetURLCacheFilePath(urlVal)
+	if unlock, err := sjwtLockFile(filePath + ".lock"); err == nil {
+		defer unlock()
+	}
+
+	// the content may have been stored by another process while waiting
+	if !refresh {
+		if cdata, expires, cerr := sjwtGetURLCachedContent(urlVal); cdata != nil {
+			return cdata, expires, SJWTRetOK, cerr
+		}
+	}
+
+	// revalidate the expired or refreshed content if it has HTTP metadata
+	cached := sjwtReadURLCacheMeta(filePath)
+	if cached != nil && len(cached.ETag) == 0 && len(cached.LastModified) == 0 {
+		cached = nil
+	}
+	data, meta, ret, err := sjwtHTTPGetContent(urlVal, timeoutVal, cached, nil)
+	if meta == nil {
+		return nil, time.Time{}, ret, err
+	}
+	if data == nil {
+		// not modified
+		if data, err = ioutil.ReadFile(filePath); err != nil {
+			return nil, time.Time{}, SJWTRetErrFileRead, errors.New("failed to read cached content")
+		}
+		meta.Expires = sjwtCapExpiresNotAfter(data, meta.Expires)
+		if !meta.noStore {
+			sjwtWriteURLCacheMeta(filePath, meta)
+		}
+		return data, meta.Expires, SJWTRetOK, nil
+	}
+	if !meta.noStore {
+		if err = SJWTWriteFileAtomic(filePath, data, 0640); err == nil {
+			sjwtWriteURLCacheMeta(filePath, meta)
+		}
+	}
+
+	return data, meta.Expires, SJWTRetOK, nil
+}
+
+// SJWTWriteFileAtomic - write the data to a temporary file in the same
+// directory and rename it, so the readers never get a partial file (e.g.,
+// the cache files or the trust list and CRL files reloaded by the trust store)
+func SJWTWriteFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
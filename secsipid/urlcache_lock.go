@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package secsipid
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// sjwtLockFile - take an exclusive lock on the file, creating it if needed,
+// waiting for other processes holding it; returns the function to release it
+func sjwtLockFile(lockPath string) (func(), error) {
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0640)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if sjwtLockedFileCurrent(f, lockPath) {
+			return sjwtUnlockFunc(f), nil
+		}
+		// the lock file was removed by the cache cleaning while waiting
+		f.Close()
+	}
+}
+
+// sjwtTryLockFile - take an exclusive lock on an existing file without
+// waiting; returns the function to release it, or an error if the file is
+// missing or locked by another process
+func sjwtTryLockFile(lockPath string) (func(), error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !sjwtLockedFileCurrent(f, lockPath) {
+		f.Close()
+		return nil, errors.New("lock file replaced")
+	}
+	return sjwtUnlockFunc(f), nil
+}
+
+// sjwtLockedFileCurrent - true if the locked file is still the one at the
+// path, not removed or replaced after it was opened
+func sjwtLockedFileCurrent(f *os.File, lockPath string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(lockPath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+// sjwtUnlockFunc - the function releasing the lock and closing the file
+func sjwtUnlockFunc(f *os.File) func() {
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
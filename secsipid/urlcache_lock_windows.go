@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package secsipid
+
+import "errors"
+
+// sjwtLockFile - file locking is not supported on windows, only the
+// downloads within the same process are synchronized
+func sjwtLockFile(lockPath string) (func(), error) {
+	return nil, errors.New("file locking not supported")
+}
+
+// sjwtTryLockFile - file locking is not supported on windows
+func sjwtTryLockFile(lockPath string) (func(), error) {
+	return nil, errors.New("file locking not supported")
+}
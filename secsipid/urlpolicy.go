@@ -0,0 +1,198 @@
+package secsipid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// urlPolicyError - a download refused by the fetch policy
+type urlPolicyError struct {
+	ret int
+	msg string
+}
+
+func (e *urlPolicyError) Error() string {
+	return e.msg
+}
+
+// private, loopback, link-local and other non-public address ranges
+var nonPublicIPNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// sjwtIsPublicIP - true if the address is not in a private, loopback,
+// link-local or other reserved range
+func sjwtIsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range nonPublicIPNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// sjwtSplitList - split a comma separated list, dropping the empty items
+func sjwtSplitList(listVal string) []string {
+	var items []string
+	for _, item := range strings.Split(listVal, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sjwtMatchHost - true if the host matches one of the patterns (e.g.,
+// `*.example.com`, `certs.example.com`)
+func sjwtMatchHost(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sjwtCheckURLPolicy - check the scheme and the host of the URL against the
+// fetch policy
+func sjwtCheckURLPolicy(urlVal string) (int, error) {
+	u, err := url.Parse(urlVal)
+	if err != nil {
+		return SJWTRetErrHTTPInvalidURL, errors.New("invalid URL value")
+	}
+	if globalLibOptions.urlRequireHTTPS != 0 && u.Scheme != "https" {
+		return SJWTRetErrHTTPSchemeNotAllowed, fmt.Errorf("URL scheme not allowed: %s", u.Scheme)
+	}
+	host := u.Hostname()
+	if denyHosts := sjwtSplitList(globalLibOptions.urlDenyHosts); len(denyHosts) > 0 && sjwtMatchHost(host, denyHosts) {
+		return SJWTRetErrHTTPHostNotAllowed, fmt.Errorf("URL host not allowed: %s", host)
+	}
+	if allowHosts := sjwtSplitList(globalLibOptions.urlAllowHosts); len(allowHosts) > 0 && !sjwtMatchHost(host, allowHosts) {
+		return SJWTRetErrHTTPHostNotAllowed, fmt.Errorf("URL host not allowed: %s", host)
+	}
+	return SJWTRetOK, nil
+}
+
+// sjwtPolicyHTTPClient - build the HTTP client enforcing the fetch policy on
+// redirects and on the addresses connected to (after DNS resolution)
+func sjwtPolicyHTTPClient(timeoutVal int) *http.Client {
+	httpClient := &http.Client{
+		Timeout: time.Duration(timeoutVal) * time.Second,
+	}
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > globalLibOptions.urlMaxRedirects {
+			return &urlPolicyError{ret: SJWTRetErrHTTPTooManyRedirects,
+				msg: fmt.Sprintf("too many redirects: %d", len(via))}
+		}
+		if ret, err := sjwtCheckURLPolicy(req.URL.String()); ret != SJWTRetOK {
+			return &urlPolicyError{ret: ret, msg: err.Error()}
+		}
+		return nil
+	}
+	if globalLibOptions.urlBlockPrivateIPs != 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		// the proxy resolves the URL host by itself, so the addresses it
+		// connects to cannot be checked: refuse the downloads through a proxy
+		proxyFunc := transport.Proxy
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if proxyFunc == nil {
+				return nil, nil
+			}
+			proxyURL, err := proxyFunc(req)
+			if err != nil || proxyURL == nil {
+				return proxyURL, err
+			}
+			return nil, &urlPolicyError{ret: SJWTRetErrHTTPAddressNotAllowed,
+				msg: fmt.Sprintf("address check not possible through proxy: %s", proxyURL.Host)}
+		}
+		policyDialer := &net.Dialer{
+			Timeout:   time.Duration(timeoutVal) * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, _ := net.SplitHostPort(address)
+				ip := net.ParseIP(host)
+				if ip == nil || !sjwtIsPublicIP(ip) {
+					return &urlPolicyError{ret: SJWTRetErrHTTPAddressNotAllowed,
+						msg: fmt.Sprintf("address not allowed: %s", host)}
+				}
+				return nil
+			},
+		}
+		transport.DialContext = policyDialer.DialContext
+		httpClient.Transport = transport
+	}
+	return httpClient
+}
+
+// sjwtPolicyRequestError - return the error code for a failed request, with
+// the specific code if the fetch policy refused it
+func sjwtPolicyRequestError(err error) (int, error) {
+	var policyErr *urlPolicyError
+	if errors.As(err, &policyErr) {
+		return policyErr.ret, policyErr
+	}
+	return SJWTRetErrHTTPGet, fmt.Errorf("http get failure: %v", err)
+}
+
+// sjwtCheckContentType - check the Content-Type of the response against the
+// allowed types, if set
+func sjwtCheckContentType(resp *http.Response) (int, error) {
+	allowedTypes := sjwtSplitList(globalLibOptions.urlContentTypes)
+	if len(allowedTypes) == 0 {
+		return SJWTRetOK, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, allowedType := range allowedTypes {
+		if strings.EqualFold(mediaType, allowedType) {
+			return SJWTRetOK, nil
+		}
+	}
+	return SJWTRetErrHTTPContentType, fmt.Errorf("content type not allowed: %s", resp.Header.Get("Content-Type"))
+}
+
+// sjwtReadLimitedBody - read the response body, up to the maximum size if set
+func sjwtReadLimitedBody(resp *http.Response) ([]byte, int, error) {
+	maxSize := int64(globalLibOptions.urlMaxBodySize)
+	if maxSize <= 0 {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, SJWTRetErrHTTPReadBody, fmt.Errorf("read http body failure: %v", err)
+		}
+		return data, SJWTRetOK, nil
+	}
+	if resp.ContentLength > maxSize {
+		return nil, SJWTRetErrHTTPBodyTooLarge, fmt.Errorf("http body too large: %d", resp.ContentLength)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, SJWTRetErrHTTPReadBody, fmt.Errorf("read http body failure: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, SJWTRetErrHTTPBodyTooLarge, fmt.Errorf("http body too large: more than %d", maxSize)
+	}
+	return data, SJWTRetOK, nil
+}
@@ -0,0 +1,134 @@
+package secsipid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gomagedon/expectate"
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+func TestURLFetchPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/pem":
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			w.Write([]byte("Hello from the server!"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("Hello from the server!"))
+		}
+	}))
+	defer server.Close()
+
+	runTest := func(t *testing.T, optName string, optVal string, urlVal string, testCase GetURLValueTest) {
+		expect := expectate.Expect(t)
+		secsipid.SJWTResetURLFailures()
+		defaultVal := map[string]string{
+			"URLRequireHTTPS": "0", "URLBlockPrivateIPs": "0", "URLAllowHosts": "",
+			"URLDenyHosts": "", "URLMaxBodySize": "131072", "URLMaxRedirects": "10",
+			"URLContentTypes": "",
+		}[optName]
+		secsipid.SJWTLibOptSetV(optName + "=" + optVal)
+		defer secsipid.SJWTLibOptSetV(optName + "=" + defaultVal)
+
+		content, errCode, err := secsipid.SJWTGetURLContent(urlVal, 5)
+
+		expect(content).ToEqual(testCase.expectedContent)
+		expect(errCode).ToBe(testCase.expectedErrCode)
+		expect(getMsgFromErr(err)).ToBe(testCase.expectedErrMsg)
+	}
+
+	t.Run("ErrHTTPSchemeNotAllowed with http when https is required", func(t *testing.T) {
+		runTest(t, "URLRequireHTTPS", "1", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPSchemeNotAllowed,
+			expectedErrMsg:  "URL scheme not allowed: http",
+		})
+	})
+
+	t.Run("ErrHTTPHostNotAllowed with denied host", func(t *testing.T) {
+		runTest(t, "URLDenyHosts", "example.com,127.0.0.*", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPHostNotAllowed,
+			expectedErrMsg:  "URL host not allowed: 127.0.0.1",
+		})
+	})
+
+	t.Run("ErrHTTPHostNotAllowed with host not in allow list", func(t *testing.T) {
+		runTest(t, "URLAllowHosts", "*.example.com", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPHostNotAllowed,
+			expectedErrMsg:  "URL host not allowed: 127.0.0.1",
+		})
+	})
+
+	t.Run("OK with host in allow list", func(t *testing.T) {
+		runTest(t, "URLAllowHosts", "*.example.com,127.0.0.1", server.URL+"/cert", GetURLValueTest{
+			expectedContent: []byte("Hello from the server!"),
+			expectedErrCode: secsipid.SJWTRetOK,
+		})
+	})
+
+	t.Run("ErrHTTPAddressNotAllowed with loopback address", func(t *testing.T) {
+		runTest(t, "URLBlockPrivateIPs", "1", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPAddressNotAllowed,
+			expectedErrMsg:  "address not allowed: 127.0.0.1",
+		})
+	})
+
+	t.Run("ErrHTTPAddressNotAllowed with proxy", func(t *testing.T) {
+		transport := http.DefaultTransport.(*http.Transport)
+		proxyFunc := transport.Proxy
+		defer func() { transport.Proxy = proxyFunc }()
+		proxyURL, _ := url.Parse(server.URL)
+		transport.Proxy = http.ProxyURL(proxyURL)
+
+		runTest(t, "URLBlockPrivateIPs", "1", "http://192.0.2.10/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPAddressNotAllowed,
+			expectedErrMsg:  "address check not possible through proxy: " + proxyURL.Host,
+		})
+	})
+
+	t.Run("OK with proxy when private addresses are allowed", func(t *testing.T) {
+		transport := http.DefaultTransport.(*http.Transport)
+		proxyFunc := transport.Proxy
+		defer func() { transport.Proxy = proxyFunc }()
+		proxyURL, _ := url.Parse(server.URL)
+		transport.Proxy = http.ProxyURL(proxyURL)
+
+		runTest(t, "URLBlockPrivateIPs", "0", "http://192.0.2.10/cert", GetURLValueTest{
+			expectedContent: []byte("Hello from the server!"),
+			expectedErrCode: secsipid.SJWTRetOK,
+		})
+	})
+
+	t.Run("ErrHTTPBodyTooLarge with body over maximum size", func(t *testing.T) {
+		runTest(t, "URLMaxBodySize", "10", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPBodyTooLarge,
+			expectedErrMsg:  "http body too large: 22",
+		})
+	})
+
+	t.Run("ErrHTTPTooManyRedirects with redirect loop", func(t *testing.T) {
+		runTest(t, "URLMaxRedirects", "2", server.URL+"/loop", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPTooManyRedirects,
+			expectedErrMsg:  "too many redirects: 3",
+		})
+	})
+
+	t.Run("ErrHTTPContentType with content type not allowed", func(t *testing.T) {
+		runTest(t, "URLContentTypes", "application/x-pem-file,application/pkix-cert", server.URL+"/cert", GetURLValueTest{
+			expectedErrCode: secsipid.SJWTRetErrHTTPContentType,
+			expectedErrMsg:  "content type not allowed: text/plain",
+		})
+	})
+
+	t.Run("OK with allowed content type", func(t *testing.T) {
+		runTest(t, "URLContentTypes", "application/x-pem-file,application/pkix-cert", server.URL+"/pem", GetURLValueTest{
+			expectedContent: []byte("Hello from the server!"),
+			expectedErrCode: secsipid.SJWTRetOK,
+		})
+	})
+}
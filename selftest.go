@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/olegromanchuk/secsipidx/secsipid"
+)
+
+// selfTestResult - outcome of a step of the self-test
+type selfTestResult struct {
+	name string
+	err  error
+}
+
+// selfTest - the steps run by the self-test and their outcome
+type selfTest struct {
+	results []selfTestResult
+}
+
+// run the step and record its outcome
+func (st *selfTest) run(name string, fn func() error) {
+	st.results = append(st.results, selfTestResult{name: name, err: fn()})
+}
+
+// print the pass/fail table and return the number of failed steps
+func (st *selfTest) report() int {
+	failed := 0
+	fmt.Printf("%-6s  %-44s  %s\n", "RESULT", "TEST", "DETAILS")
+	for _, res := range st.results {
+		status, details := "PASS", ""
+		if res.err != nil {
+			status, details = "FAIL", res.err.Error()
+			failed++
+		}
+		fmt.Printf("%-6s  %-44s  %s\n", status, res.name, details)
+	}
+	fmt.Printf("passed: %d, failed: %d\n", len(st.results)-failed, failed)
+	return failed
+}
+
+// selfTestExpect - check the return code of a library function
+func selfTestExpect(ret int, err error, expected int) error {
+	if ret == expected {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("expected %d, got %d: %v", expected, ret, err)
+	}
+	return fmt.Errorf("expected %d, got %d", expected, ret)
+}
+
+// run the self-test with ephemeral keys and certificates from a lab PKI
+// served by an in-process x5u server, printing the pass/fail table
+func secsipidxCLISelfTest() int {
+	st := &selfTest{}
+	workDir, err := ioutil.TempDir("", "secsipidx-selftest")
+	if err != nil {
+		fmt.Printf("error message: %v\n", err)
+		return -1
+	}
+	defer os.RemoveAll(workDir)
+	pkiDir := filepath.Join(workDir, "pki")
+	pkiPath := func(name string) string {
+		return filepath.Join(pkiDir, name)
+	}
+
+	// the library options used by the self-test, not the ones of the command line
+	secsipid.SetURLFileCacheOptions(filepath.Join(workDir, "cache"), 3600)
+	secsipid.SJWTLibOptSetN("CertMemCacheSize", 0)
+	secsipid.SJWTLibOptSetN("CertVerify", 0)
+
+	st.run("generate lab PKI with ephemeral keys", func() error {
+		if err := os.MkdirAll(filepath.Join(workDir, "cache"), 0750); err != nil {
+			return err
+		}
+		_, err := secsipid.SJWTBuildLabPKI(secsipid.SJWTDefaultLabPKISpec(), pkiDir)
+		return err
+	})
+
+	var fetches int64
+	var baseURL string
+	st.run("start x5u server", func() error {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		fileServer := http.FileServer(http.Dir(pkiDir))
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&fetches, 1)
+			fileServer.ServeHTTP(w, r)
+		}))
+		baseURL = "http://" + listener.Addr().String() + "/"
+		return nil
+	})
+	x5uSP1 := baseURL + "sp1-chain.pem"
+
+	st.run("sign", func() error {
+		header := secsipid.SJWTHeader{Alg: "ES256", Ppt: "shaken", Typ: "passport", X5u: x5uSP1}
+		payload := secsipid.SJWTPayload{
+			ATTest: "A",
+			Dest:   secsipid.SJWTDest{TN: []string{"493044444444"}},
+			IAT:    time.Now().Unix(),
+			Orig:   secsipid.SJWTOrig{TN: "493055555555"},
+			OrigID: "32c7e392-33fc-11ea-840b-784f435c76a8",
+		}
+		headerJSON, _ := json.Marshal(header)
+		payloadJSON, _ := json.Marshal(payload)
+		token, ret, err := secsipid.SJWTEncodeText(string(headerJSON), string(payloadJSON), pkiPath("sp1-private.pem"))
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		certPEM, err := ioutil.ReadFile(pkiPath("sp1-cert.pem"))
+		if err != nil {
+			return err
+		}
+		pubKey, ret, err := secsipid.SJWTParseECPublicKeyFromPEM(certPEM)
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		if _, err = secsipid.SJWTDecodeWithPubKey(token, cliops.expire, pubKey); err != nil {
+			return err
+		}
+		return nil
+	})
+
+	signFull := func(name string, x5u string) (string, error) {
+		identity, ret, err := secsipid.SJWTGetIdentity("493055555555", "493044444444", "A", "", x5u, pkiPath(name+"-private.pem"))
+		if ret != secsipid.SJWTRetOK {
+			return "", selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		return identity, nil
+	}
+	var identity string
+	st.run("sign-full", func() error {
+		sp1Identity, err := signFull("sp1", x5uSP1)
+		if err != nil {
+			return err
+		}
+		identity = sp1Identity
+		if !strings.Contains(identity, ";info=<"+x5uSP1+">") {
+			return fmt.Errorf("missing info parameter: %s", identity)
+		}
+		if cliops.verbosity > 0 {
+			fmt.Printf("identity: %s\n", identity)
+		}
+		return nil
+	})
+
+	st.run("check with certificate file", func() error {
+		ret, err := secsipid.SJWTCheckFullIdentity(identity, cliops.expire, pkiPath("sp1-cert.pem"), cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+	})
+
+	st.run("check with other signing key", func() error {
+		otherIdentity, err := signFull("sp2", x5uSP1)
+		if err != nil {
+			return err
+		}
+		ret, err := secsipid.SJWTCheckFullIdentity(otherIdentity, cliops.expire, pkiPath("sp1-cert.pem"), cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetErrJSONSignatureInvalid)
+	})
+
+	st.run("check expired token", func() error {
+		header := `{"alg":"ES256","ppt":"shaken","typ":"passport","x5u":"` + x5uSP1 + `"}`
+		payload := fmt.Sprintf(`{"attest":"A","dest":{"tn":["493044444444"]},"iat":%d,"orig":{"tn":"493055555555"},"origid":"selftest"}`,
+			time.Now().Unix()-3600)
+		token, ret, err := secsipid.SJWTEncodeText(header, payload, pkiPath("sp1-private.pem"))
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		ret, err = secsipid.SJWTCheckFullIdentity(token+";info=<"+x5uSP1+">;alg=ES256;ppt=shaken", 60,
+			pkiPath("sp1-cert.pem"), cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetErrJSONPayloadIATExpired)
+	})
+
+	st.run("check with x5u fetch", func() error {
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, cliops.expire, cliops.timeout)
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		if n := atomic.LoadInt64(&fetches); n != 1 {
+			return fmt.Errorf("expected 1 download, got %d", n)
+		}
+		return nil
+	})
+
+	st.run("check with x5u from cache", func() error {
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, cliops.expire, cliops.timeout)
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		if n := atomic.LoadInt64(&fetches); n != 1 {
+			return fmt.Errorf("expected 1 download, got %d", n)
+		}
+		if data, err := secsipid.SJWTGetURLCachedContent(x5uSP1); len(data) == 0 {
+			return fmt.Errorf("certificate not in cache: %v", err)
+		}
+		return nil
+	})
+
+	secsipid.SJWTLibOptSetS("CertCAFile", pkiPath("root-ca.pem"))
+	secsipid.SJWTLibOptSetS("CertCAInter", pkiPath("intermediate-ca.pem"))
+	secsipid.SJWTLibOptSetS("CertCRLFile", pkiPath("crl.pem"))
+
+	st.run("verify time and CA file (cert-verify 5)", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 5)
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, cliops.expire, cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+	})
+
+	st.run("verify intermediate file (cert-verify 13)", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 13)
+		ret, err := secsipid.SJWTCheckFullIdentity(identity, cliops.expire, pkiPath("sp1-cert.pem"), cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+	})
+
+	st.run("verify CRL (cert-verify 21)", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 21)
+		ret, err := secsipid.SJWTCheckFullIdentityURL(identity, cliops.expire, cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+	})
+
+	st.run("verify revoked certificate (cert-verify 21)", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 21)
+		revokedIdentity, err := signFull("revoked", baseURL+"revoked-chain.pem")
+		if err != nil {
+			return err
+		}
+		ret, err := secsipid.SJWTCheckFullIdentityURL(revokedIdentity, cliops.expire, cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetErrCertRevoked)
+	})
+
+	st.run("verify expired certificate (cert-verify 5)", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 5)
+		expiredIdentity, err := signFull("expired", baseURL+"expired-chain.pem")
+		if err != nil {
+			return err
+		}
+		ret, err := secsipid.SJWTCheckFullIdentityURL(expiredIdentity, cliops.expire, cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetErrCertExpired)
+	})
+
+	st.run("verify untrusted CA (cert-verify 5)", func() error {
+		caKey, ret, err := secsipid.SJWTGenerateECKey()
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		caPEM, ret, err := secsipid.SJWTCreateCertificate(&secsipid.SJWTCertOptions{IsCA: true, CommonName: "Untrusted Test CA"},
+			&caKey.PublicKey, nil, caKey)
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		caFile := filepath.Join(workDir, "untrusted-ca.pem")
+		if err = ioutil.WriteFile(caFile, caPEM, 0640); err != nil {
+			return err
+		}
+		secsipid.SJWTLibOptSetN("CertVerify", 5)
+		secsipid.SJWTLibOptSetS("CertCAFile", caFile)
+		defer secsipid.SJWTLibOptSetS("CertCAFile", pkiPath("root-ca.pem"))
+		ret, err = secsipid.SJWTCheckFullIdentityURL(identity, cliops.expire, cliops.timeout)
+		return selfTestExpect(ret, err, secsipid.SJWTRetErrCertInvalid)
+	})
+
+	st.run("decode with certificate", func() error {
+		secsipid.SJWTLibOptSetN("CertVerify", 5)
+		decoded, ret, err := secsipid.SJWTDecodeIdentity(identity, true, cliops.timeout)
+		if ret != secsipid.SJWTRetOK {
+			return selfTestExpect(ret, err, secsipid.SJWTRetOK)
+		}
+		if decoded.Ppt != "shaken" || decoded.X5u != x5uSP1 {
+			return fmt.Errorf("unexpected ppt %q or x5u %q", decoded.Ppt, decoded.X5u)
+		}
+		if decoded.Cert == nil || decoded.Cert.SPC != "1001" || decoded.Cert.ChainStatus != "valid" {
+			return fmt.Errorf("unexpected certificate details: %+v", decoded.Cert)
+		}
+		return nil
+	})
+
+	if st.report() > 0 {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,236 @@
+package sipcapture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// link types of the capture files (https://www.tcpdump.org/linktypes.html)
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRawAlt   = 12
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+// IP protocol numbers
+const (
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6DestOptions = 60
+)
+
+// fragmentsTimeout - how long the fragments of an IP packet are kept waiting
+// for the missing ones
+const fragmentsTimeout = 30 * time.Second
+
+// ipPacket - the transport protocol, the addresses and the payload of an IP
+// packet
+type ipPacket struct {
+	proto   int
+	src     net.IP
+	dst     net.IP
+	payload []byte
+}
+
+// ipFragment - a fragment of an IP packet, the offset is in bytes
+type ipFragment struct {
+	offset int
+	data   []byte
+	last   bool
+}
+
+// ipFragments - the fragments received for an IP packet
+type ipFragments struct {
+	first     time.Time
+	fragments []ipFragment
+}
+
+// ipDecoder - decode the link and IP layers, reassembling the fragmented IP
+// packets
+type ipDecoder struct {
+	pending map[string]*ipFragments
+}
+
+func newIPDecoder() *ipDecoder {
+	return &ipDecoder{pending: make(map[string]*ipFragments)}
+}
+
+// linkPayload - return the IP packet carried by the link layer frame, nil if
+// it is not IPv4 or IPv6
+func linkPayload(linkType int, data []byte) []byte {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// 802.1Q and 802.1ad VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88A8 || etherType == 0x9100) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil
+		}
+		return data[4:]
+	case linkTypeRaw, linkTypeRawAlt, linkTypeIPv4, linkTypeIPv6:
+		return data
+	default:
+		return nil
+	}
+	if etherType != 0x0800 && etherType != 0x86DD {
+		return nil
+	}
+	return data
+}
+
+// decode - return the IP packet from the frame, nil if it is not an IP packet
+// or it is a fragment of a packet not yet complete
+func (d *ipDecoder) decode(linkType int, data []byte, ts time.Time) *ipPacket {
+	data = linkPayload(linkType, data)
+	if len(data) < 1 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return d.decodeIPv4(data, ts)
+	case 6:
+		return d.decodeIPv6(data, ts)
+	}
+	return nil
+}
+
+// decodeIPv4 - decode the IPv4 packet
+func (d *ipDecoder) decodeIPv4(data []byte, ts time.Time) *ipPacket {
+	if len(data) < 20 {
+		return nil
+	}
+	hdrLen := int(data[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if hdrLen < 20 || totalLen < hdrLen || totalLen > len(data) {
+		return nil
+	}
+	pkt := &ipPacket{
+		proto:   int(data[9]),
+		src:     net.IP(data[12:16]),
+		dst:     net.IP(data[16:20]),
+		payload: data[hdrLen:totalLen],
+	}
+	flagsOffset := binary.BigEndian.Uint16(data[6:8])
+	moreFragments := flagsOffset&0x2000 != 0
+	offset := int(flagsOffset&0x1FFF) * 8
+	if !moreFragments && offset == 0 {
+		return pkt
+	}
+	key := fmt.Sprintf("4/%s/%s/%d/%d", pkt.src, pkt.dst, binary.BigEndian.Uint16(data[4:6]), pkt.proto)
+	if pkt.payload = d.reassemble(key, offset, pkt.payload, !moreFragments, ts); pkt.payload == nil {
+		return nil
+	}
+	return pkt
+}
+
+// decodeIPv6 - decode the IPv6 packet, skipping the extension headers
+func (d *ipDecoder) decodeIPv6(data []byte, ts time.Time) *ipPacket {
+	if len(data) < 40 {
+		return nil
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	if 40+payloadLen > len(data) {
+		return nil
+	}
+	pkt := &ipPacket{
+		proto: int(data[6]),
+		src:   net.IP(data[8:24]),
+		dst:   net.IP(data[24:40]),
+	}
+	payload := data[40 : 40+payloadLen]
+	for {
+		switch pkt.proto {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(payload) < 8 {
+				return nil
+			}
+			extLen := (int(payload[1]) + 1) * 8
+			if extLen > len(payload) {
+				return nil
+			}
+			pkt.proto = int(payload[0])
+			payload = payload[extLen:]
+			continue
+		case ipv6Fragment:
+			if len(payload) < 8 {
+				return nil
+			}
+			pkt.proto = int(payload[0])
+			offsetFlags := binary.BigEndian.Uint16(payload[2:4])
+			key := fmt.Sprintf("6/%s/%s/%d/%d", pkt.src, pkt.dst, binary.BigEndian.Uint32(payload[4:8]), pkt.proto)
+			if payload = d.reassemble(key, int(offsetFlags>>3)*8, payload[8:], offsetFlags&1 == 0, ts); payload == nil {
+				return nil
+			}
+		}
+		pkt.payload = payload
+		return pkt
+	}
+}
+
+// reassemble - store the fragment and return the payload of the IP packet
+// once all the fragments were received
+func (d *ipDecoder) reassemble(key string, offset int, data []byte, last bool, ts time.Time) []byte {
+	for k, frags := range d.pending {
+		if ts.Sub(frags.first) > fragmentsTimeout {
+			delete(d.pending, k)
+		}
+	}
+	frags, ok := d.pending[key]
+	if !ok {
+		frags = &ipFragments{first: ts}
+		d.pending[key] = frags
+	}
+	frags.fragments = append(frags.fragments, ipFragment{offset: offset, data: append([]byte(nil), data...), last: last})
+
+	sort.Slice(frags.fragments, func(i, j int) bool {
+		return frags.fragments[i].offset < frags.fragments[j].offset
+	})
+	var payload []byte
+	for _, frag := range frags.fragments {
+		if frag.offset > len(payload) {
+			// missing fragment
+			return nil
+		}
+		if end := frag.offset + len(frag.data); end > len(payload) {
+			payload = append(payload, frag.data[len(payload)-frag.offset:]...)
+		}
+		if frag.last {
+			delete(d.pending, key)
+			return payload
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package sipcapture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Packet - a captured packet with the link type of its interface
+type Packet struct {
+	Time     time.Time
+	LinkType int
+	Data     []byte
+}
+
+// pcapng block types
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngObsoletePacket  = 0x00000002
+	pcapngSimplePacket    = 0x00000003
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptionTSResol   = 9
+	pcapMaxRecordSize     = 256 * 1024
+	pcapngMaxBlockSize    = 16 * 1024 * 1024
+	pcapMagicMicroseconds = 0xA1B2C3D4
+	pcapMagicNanoseconds  = 0xA1B23C4D
+	pcapGlobalHeaderSize  = 24
+	pcapRecordHeaderSize  = 16
+	pcapngBlockHeaderSize = 8
+	pcapngDefaultTSUnits  = 1000000
+)
+
+// pcapngInterface - the link type and the timestamp resolution (units per
+// second) of a pcapng interface
+type pcapngInterface struct {
+	linkType int
+	tsUnits  uint64
+}
+
+// Reader - reader of packets from a classic pcap or a pcapng file
+type Reader struct {
+	r         *bufio.Reader
+	ng        bool
+	order     binary.ByteOrder
+	linkType  int
+	tsUnits   uint64
+	ifaces    []pcapngInterface
+	headerBuf [pcapRecordHeaderSize]byte
+}
+
+// NewReader - detect the format (classic pcap or pcapng) and read the file
+// header
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture file header: %v", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, pcapGlobalHeaderSize)
+	if _, err = io.ReadFull(pr.r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagicMicroseconds:
+			pr.order, pr.tsUnits = order, 1000000
+		case pcapMagicNanoseconds:
+			pr.order, pr.tsUnits = order, 1000000000
+		}
+	}
+	if pr.order == nil {
+		return nil, errors.New("unknown capture file format")
+	}
+	pr.linkType = int(pr.order.Uint32(hdr[20:24]) & 0x0FFFFFFF)
+	return pr, nil
+}
+
+// Next - return the next packet, io.EOF at the end of the file
+func (pr *Reader) Next() (*Packet, error) {
+	if pr.ng {
+		return pr.nextBlock()
+	}
+	if _, err := io.ReadFull(pr.r, pr.headerBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	tsSec := pr.order.Uint32(pr.headerBuf[0:4])
+	tsFrac := pr.order.Uint32(pr.headerBuf[4:8])
+	capLen := pr.order.Uint32(pr.headerBuf[8:12])
+	if capLen > pcapMaxRecordSize {
+		return nil, fmt.Errorf("invalid pcap record length: %d", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, io.EOF
+	}
+	return &Packet{
+		Time:     pcapTime(uint64(tsSec)*pr.tsUnits+uint64(tsFrac), pr.tsUnits),
+		LinkType: pr.linkType,
+		Data:     data,
+	}, nil
+}
+
+// pcapTime - convert the timestamp in units per second to time
+func pcapTime(ts uint64, units uint64) time.Time {
+	sec := ts / units
+	frac := ts % units
+	return time.Unix(int64(sec), int64(frac*1000000000/units)).UTC()
+}
+
+// nextBlock - read pcapng blocks until the next packet
+func (pr *Reader) nextBlock() (*Packet, error) {
+	for {
+		hdr, err := pr.r.Peek(pcapngBlockHeaderSize)
+		if err != nil {
+			return nil, io.EOF
+		}
+		blockType := binary.LittleEndian.Uint32(hdr[0:4])
+		if blockType == pcapngSectionHeader {
+			// the byte order of the section is given by its header
+			if pr.order, err = pr.sectionOrder(); err != nil {
+				return nil, err
+			}
+		} else if pr.order == nil {
+			return nil, errors.New("pcapng block before section header")
+		}
+		blockType = pr.order.Uint32(hdr[0:4])
+		blockLen := pr.order.Uint32(hdr[4:8])
+		if blockLen < 12 || blockLen > pcapngMaxBlockSize || blockLen%4 != 0 {
+			return nil, fmt.Errorf("invalid pcapng block length: %d", blockLen)
+		}
+		block := make([]byte, blockLen)
+		if _, err = io.ReadFull(pr.r, block); err != nil {
+			return nil, io.EOF
+		}
+		body := block[pcapngBlockHeaderSize : blockLen-4]
+
+		switch blockType {
+		case pcapngSectionHeader:
+			pr.ifaces = nil
+		case pcapngInterfaceDesc:
+			if len(body) < 8 {
+				return nil, errors.New("invalid pcapng interface block")
+			}
+			pr.ifaces = append(pr.ifaces, pcapngInterface{
+				linkType: int(pr.order.Uint16(body[0:2])),
+				tsUnits:  pr.tsResolution(body[8:]),
+			})
+		case pcapngEnhancedPacket, pcapngObsoletePacket:
+			if len(body) < 20 {
+				return nil, errors.New("invalid pcapng packet block")
+			}
+			var ifaceID uint32
+			if blockType == pcapngEnhancedPacket {
+				ifaceID = pr.order.Uint32(body[0:4])
+			} else {
+				ifaceID = uint32(pr.order.Uint16(body[0:2]))
+			}
+			if int(ifaceID) >= len(pr.ifaces) {
+				return nil, fmt.Errorf("pcapng packet for unknown interface: %d", ifaceID)
+			}
+			iface := pr.ifaces[ifaceID]
+			ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+			capLen := pr.order.Uint32(body[12:16])
+			if int(capLen) > len(body)-20 {
+				return nil, errors.New("invalid pcapng packet length")
+			}
+			return &Packet{
+				Time:     pcapTime(ts, iface.tsUnits),
+				LinkType: iface.linkType,
+				Data:     body[20 : 20+capLen],
+			}, nil
+		case pcapngSimplePacket:
+			if len(pr.ifaces) == 0 || len(body) < 4 {
+				return nil, errors.New("invalid pcapng simple packet block")
+			}
+			capLen := pr.order.Uint32(body[0:4])
+			if int(capLen) > len(body)-4 {
+				capLen = uint32(len(body) - 4)
+			}
+			return &Packet{LinkType: pr.ifaces[0].linkType, Data: body[4 : 4+capLen]}, nil
+		}
+	}
+}
+
+// sectionOrder - return the byte order of the section from the byte-order
+// magic of its header
+func (pr *Reader) sectionOrder() (binary.ByteOrder, error) {
+	hdr, err := pr.r.Peek(12)
+	if err != nil {
+		return nil, io.EOF
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[8:12]) == pcapngByteOrderMagic:
+		return binary.LittleEndian, nil
+	case binary.BigEndian.Uint32(hdr[8:12]) == pcapngByteOrderMagic:
+		return binary.BigEndian, nil
+	}
+	return nil, errors.New("invalid pcapng byte-order magic")
+}
+
+// tsResolution - return the timestamp units per second from the options of
+// an interface description block
+func (pr *Reader) tsResolution(options []byte) uint64 {
+	for len(options) >= 4 {
+		code := pr.order.Uint16(options[0:2])
+		optLen := int(pr.order.Uint16(options[2:4]))
+		if code == 0 || 4+optLen > len(options) {
+			break
+		}
+		if code == pcapngOptionTSResol && optLen >= 1 {
+			resol := options[4]
+			if resol&0x80 != 0 {
+				return uint64(1) << (resol & 0x7F)
+			}
+			return uint64(math.Pow10(int(resol)))
+		}
+		options = options[4+(optLen+3)/4*4:]
+	}
+	return pcapngDefaultTSUnits
+}
@@ -0,0 +1,266 @@
+package sipcapture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStreamBuffer - the maximum size of the data kept for a TCP stream
+// waiting to complete a SIP message
+const maxStreamBuffer = 1024 * 1024
+
+// Message - a SIP message found in the capture
+type Message struct {
+	Time      time.Time
+	Transport string
+	Src       string
+	Dst       string
+	Data      []byte
+}
+
+// tcpSegment - a TCP segment received out of order
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// tcpStream - the data of one direction of a TCP connection
+type tcpStream struct {
+	init    bool
+	nextSeq uint32
+	pending []tcpSegment
+	buf     []byte
+	time    time.Time
+}
+
+// Extractor - extract the SIP messages from captured packets, reassembling
+// the IP fragments and the TCP streams
+type Extractor struct {
+	ip       *ipDecoder
+	streams  map[string]*tcpStream
+	Messages []*Message
+}
+
+// NewExtractor - return a new SIP messages extractor
+func NewExtractor() *Extractor {
+	return &Extractor{
+		ip:      newIPDecoder(),
+		streams: make(map[string]*tcpStream),
+	}
+}
+
+// ReadSIPMessages - return the SIP messages from the classic pcap or pcapng
+// capture
+func ReadSIPMessages(r io.Reader) ([]*Message, error) {
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	ex := NewExtractor()
+	for {
+		pkt, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ex.Messages, err
+		}
+		ex.AddPacket(pkt)
+	}
+	return ex.Messages, nil
+}
+
+// AddPacket - decode the packet and collect the SIP messages it completes
+func (ex *Extractor) AddPacket(pkt *Packet) {
+	ipPkt := ex.ip.decode(pkt.LinkType, pkt.Data, pkt.Time)
+	if ipPkt == nil {
+		return
+	}
+	switch ipPkt.proto {
+	case ipProtoUDP:
+		if len(ipPkt.payload) < 8 {
+			return
+		}
+		srcPort := binary.BigEndian.Uint16(ipPkt.payload[0:2])
+		dstPort := binary.BigEndian.Uint16(ipPkt.payload[2:4])
+		data := ipPkt.payload[8:]
+		if !isSIPStart(data) {
+			return
+		}
+		ex.Messages = append(ex.Messages, &Message{
+			Time:      pkt.Time,
+			Transport: "udp",
+			Src:       hostPort(ipPkt.src, srcPort),
+			Dst:       hostPort(ipPkt.dst, dstPort),
+			Data:      append([]byte(nil), data...),
+		})
+	case ipProtoTCP:
+		ex.addTCPSegment(ipPkt, pkt.Time)
+	}
+}
+
+// hostPort - return the address as host:port
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// addTCPSegment - add the TCP segment to its stream and collect the SIP
+// messages completed by it
+func (ex *Extractor) addTCPSegment(ipPkt *ipPacket, ts time.Time) {
+	seg := ipPkt.payload
+	if len(seg) < 20 {
+		return
+	}
+	dataOffset := int(seg[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(seg) {
+		return
+	}
+	src := hostPort(ipPkt.src, binary.BigEndian.Uint16(seg[0:2]))
+	dst := hostPort(ipPkt.dst, binary.BigEndian.Uint16(seg[2:4]))
+	seq := binary.BigEndian.Uint32(seg[4:8])
+	flags := seg[13]
+	data := seg[dataOffset:]
+	key := src + ">" + dst
+
+	if flags&0x04 != 0 {
+		// RST
+		delete(ex.streams, key)
+		return
+	}
+	st, ok := ex.streams[key]
+	if !ok || flags&0x02 != 0 {
+		st = &tcpStream{}
+		ex.streams[key] = st
+	}
+	if flags&0x02 != 0 {
+		// SYN takes one sequence number
+		st.init = true
+		st.nextSeq = seq + 1
+		return
+	}
+	if len(data) > 0 {
+		if !st.init {
+			// capture started in the middle of the connection
+			st.init = true
+			st.nextSeq = seq
+		}
+		st.addSegment(seq, data, ts)
+		ex.Messages = append(ex.Messages, st.messages(src, dst)...)
+	}
+	if flags&0x01 != 0 {
+		// FIN
+		delete(ex.streams, key)
+	}
+}
+
+// addSegment - append the in-order data to the stream buffer, keeping the
+// segments received ahead of the expected sequence number
+func (st *tcpStream) addSegment(seq uint32, data []byte, ts time.Time) {
+	st.pending = append(st.pending, tcpSegment{seq: seq, data: append([]byte(nil), data...)})
+	sort.Slice(st.pending, func(i, j int) bool {
+		return int32(st.pending[i].seq-st.nextSeq) < int32(st.pending[j].seq-st.nextSeq)
+	})
+	for len(st.pending) > 0 {
+		s := st.pending[0]
+		diff := int32(s.seq - st.nextSeq)
+		if diff > 0 {
+			// missing data before the segment
+			break
+		}
+		st.pending = st.pending[1:]
+		if int(-diff) >= len(s.data) {
+			// retransmission of data already received
+			continue
+		}
+		if len(st.buf) == 0 {
+			st.time = ts
+		}
+		st.buf = append(st.buf, s.data[-diff:]...)
+		st.nextSeq += uint32(len(s.data) + int(diff))
+	}
+	if len(st.buf) > maxStreamBuffer {
+		st.buf = nil
+	}
+}
+
+// messages - return the complete SIP messages from the stream buffer
+func (st *tcpStream) messages(src string, dst string) []*Message {
+	var msgs []*Message
+	for {
+		// skip the CRLF keepalives
+		st.buf = bytes.TrimLeft(st.buf, "\r\n")
+		if len(st.buf) == 0 {
+			return msgs
+		}
+		if bytes.IndexByte(st.buf, '\n') < 0 {
+			// first line not complete yet
+			return msgs
+		}
+		if !isSIPStart(st.buf) {
+			// not SIP or the capture started in the middle of a message
+			st.buf = nil
+			return msgs
+		}
+		size := sipMessageSize(st.buf)
+		if size <= 0 || size > len(st.buf) {
+			return msgs
+		}
+		msgs = append(msgs, &Message{
+			Time:      st.time,
+			Transport: "tcp",
+			Src:       src,
+			Dst:       dst,
+			Data:      append([]byte(nil), st.buf[:size]...),
+		})
+		st.buf = st.buf[size:]
+	}
+}
+
+// isSIPStart - true if the data starts with a SIP request or response line
+func isSIPStart(data []byte) bool {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		end = len(data)
+	}
+	line := strings.TrimRight(string(data[:end]), "\r")
+	if strings.HasPrefix(line, "SIP/2.0 ") {
+		return true
+	}
+	fields := strings.Fields(line)
+	return len(fields) == 3 && fields[2] == "SIP/2.0"
+}
+
+// sipMessageSize - return the size of the SIP message at the start of the
+// data, given by the headers and the Content-Length, or 0 if it is not
+// complete yet
+func sipMessageSize(data []byte) int {
+	eol := []byte("\r\n")
+	hdrEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if hdrEnd < 0 {
+		if hdrEnd = bytes.Index(data, []byte("\n\n")); hdrEnd < 0 {
+			return 0
+		}
+		eol = []byte("\n")
+	}
+	bodyStart := hdrEnd + 2*len(eol)
+	contentLength := 0
+	for _, line := range bytes.Split(data[:hdrEnd], eol) {
+		idx := bytes.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(string(line[:idx])))
+		if name == "content-length" || name == "l" {
+			if v, err := strconv.Atoi(strings.TrimSpace(string(line[idx+1:]))); err == nil && v >= 0 {
+				contentLength = v
+			}
+		}
+	}
+	return bodyStart + contentLength
+}
@@ -0,0 +1,192 @@
+package sipcapture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+const testInvite = "INVITE sip:+15551234567@example.com SIP/2.0\r\n" +
+	"From: <sip:+15557654321@example.com>;tag=1\r\n" +
+	"To: <sip:+15551234567@example.com>\r\n" +
+	"Call-ID: pcap-test-1\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Length: 5\r\n" +
+	"\r\n" +
+	"v=0\r\n"
+
+// ipv4Packet - IPv4 packet with the payload, offset in 8-byte units
+func ipv4Packet(proto byte, payload []byte, id uint16, offset uint16, more bool) []byte {
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(hdr[4:6], id)
+	flags := offset
+	if more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(hdr[6:8], flags)
+	hdr[8] = 64
+	hdr[9] = proto
+	copy(hdr[12:16], []byte{192, 0, 2, 1})
+	copy(hdr[16:20], []byte{192, 0, 2, 2})
+	return append(hdr, payload...)
+}
+
+// ethernetFrame - Ethernet frame carrying the IPv4 packet
+func ethernetFrame(ipPkt []byte) []byte {
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	return append(frame, ipPkt...)
+}
+
+func udpDatagram(payload []byte) []byte {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:2], 5060)
+	binary.BigEndian.PutUint16(hdr[2:4], 5060)
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(8+len(payload)))
+	return append(hdr, payload...)
+}
+
+func tcpSegmentData(seq uint32, flags byte, payload []byte) []byte {
+	hdr := make([]byte, 20)
+	binary.BigEndian.PutUint16(hdr[0:2], 40000)
+	binary.BigEndian.PutUint16(hdr[2:4], 5060)
+	binary.BigEndian.PutUint32(hdr[4:8], seq)
+	hdr[12] = 5 << 4
+	hdr[13] = flags
+	return append(hdr, payload...)
+}
+
+// classicPcap - classic pcap file with microseconds timestamps and Ethernet
+// link type
+func classicPcap(frames [][]byte) []byte {
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeEthernet)
+	buf.Write(hdr)
+	for i, frame := range frames {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:4], 1700000000+uint32(i))
+		binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// pcapngBlock - pcapng block with the body padded to 32 bits
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	order.PutUint32(block[0:4], blockType)
+	order.PutUint32(block[4:8], uint32(12+len(body)))
+	block = append(block, body...)
+	trailer := make([]byte, 4)
+	order.PutUint32(trailer, uint32(12+len(body)))
+	return append(block, trailer...)
+}
+
+// pcapngFile - big endian pcapng file with one raw IP interface using
+// nanoseconds timestamps
+func pcapngFile(packets [][]byte) []byte {
+	order := binary.BigEndian
+	var buf bytes.Buffer
+	shb := make([]byte, 16)
+	order.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	order.PutUint16(shb[4:6], 1)
+	binary.BigEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	buf.Write(pcapngBlock(order, pcapngSectionHeader, shb))
+
+	idb := make([]byte, 8)
+	order.PutUint16(idb[0:2], linkTypeRaw)
+	// if_tsresol option with 10^-9
+	idb = append(idb, 0, pcapngOptionTSResol, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0)
+	buf.Write(pcapngBlock(order, pcapngInterfaceDesc, idb))
+
+	for i, pkt := range packets {
+		ts := uint64(1700000000+i) * 1000000000
+		epb := make([]byte, 20)
+		order.PutUint32(epb[4:8], uint32(ts>>32))
+		order.PutUint32(epb[8:12], uint32(ts))
+		order.PutUint32(epb[12:16], uint32(len(pkt)))
+		order.PutUint32(epb[16:20], uint32(len(pkt)))
+		buf.Write(pcapngBlock(order, pcapngEnhancedPacket, append(epb, pkt...)))
+	}
+	return buf.Bytes()
+}
+
+func TestReadSIPMessagesUDPFragmented(t *testing.T) {
+	udp := udpDatagram([]byte(testInvite))
+	frames := [][]byte{
+		// second fragment first, then the first one
+		ethernetFrame(ipv4Packet(ipProtoUDP, udp[64:], 7, 64/8, false)),
+		ethernetFrame(ipv4Packet(ipProtoUDP, udp[:64], 7, 0, true)),
+		// not SIP
+		ethernetFrame(ipv4Packet(ipProtoUDP, udpDatagram([]byte("hello")), 8, 0, false)),
+	}
+	msgs, err := ReadSIPMessages(bytes.NewReader(classicPcap(frames)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if string(msgs[0].Data) != testInvite {
+		t.Errorf("unexpected message data: %q", msgs[0].Data)
+	}
+	if msgs[0].Transport != "udp" || msgs[0].Src != "192.0.2.1:5060" || msgs[0].Dst != "192.0.2.2:5060" {
+		t.Errorf("unexpected message addresses: %s %s %s", msgs[0].Transport, msgs[0].Src, msgs[0].Dst)
+	}
+	if msgs[0].Time.Unix() != 1700000001 {
+		t.Errorf("unexpected message time: %v", msgs[0].Time)
+	}
+}
+
+func TestReadSIPMessagesTCPSegmented(t *testing.T) {
+	data := []byte("\r\n" + testInvite + testInvite)
+	isn := uint32(0xFFFFFFF0)
+	start := isn + 1
+	packets := [][]byte{
+		ipv4Packet(ipProtoTCP, tcpSegmentData(isn, 0x02, nil), 1, 0, false),
+		ipv4Packet(ipProtoTCP, tcpSegmentData(start, 0x18, data[:100]), 2, 0, false),
+		// out of order
+		ipv4Packet(ipProtoTCP, tcpSegmentData(start+200, 0x18, data[200:]), 3, 0, false),
+		ipv4Packet(ipProtoTCP, tcpSegmentData(start+100, 0x18, data[100:200]), 4, 0, false),
+		// retransmission
+		ipv4Packet(ipProtoTCP, tcpSegmentData(start+100, 0x18, data[100:200]), 5, 0, false),
+	}
+	msgs, err := ReadSIPMessages(bytes.NewReader(pcapngFile(packets)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		if string(msg.Data) != testInvite {
+			t.Errorf("unexpected message data: %q", msg.Data)
+		}
+		if msg.Transport != "tcp" || msg.Dst != "192.0.2.2:5060" {
+			t.Errorf("unexpected message addresses: %s %s", msg.Transport, msg.Dst)
+		}
+	}
+	if msgs[0].Time.Unix() != 1700000001 {
+		t.Errorf("unexpected message time: %v", msgs[0].Time)
+	}
+}
+
+func TestNewReaderUnknownFormat(t *testing.T) {
+	_, err := NewReader(strings.NewReader(strings.Repeat("x", 32)))
+	if err == nil || err.Error() != "unknown capture file format" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}